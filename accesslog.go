@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat selects the layout of access log lines.
+type AccessLogFormat int
+
+const (
+	// CommonLogFormat is Apache's common log format:
+	//	host ident user [time] "request" status bytes
+	CommonLogFormat AccessLogFormat = iota
+	// CombinedLogFormat adds the quoted Referer and User-Agent.
+	CombinedLogFormat
+)
+
+// WithAccessLog writes an access log line in format for every request
+// answered with a proxied response, to w or, when w is nil, to the server's
+// logger at Info. Each line ends with the time taken in microseconds, like
+// Apache's %D. NATS has no remote address, so the host is the first
+// X-Forwarded-For entry if any, and the user comes from basic auth. Bytes
+// are those of the body as sent, hop compressed or not; streamed responses
+// are logged when their last chunk is sent. Error envelopes are not logged.
+func WithAccessLog(format AccessLogFormat, w io.Writer) ServerOption {
+	return func(s *Server) {
+		s.accessLog = &accessLog{format: format, w: w}
+	}
+}
+
+type accessLog struct {
+	format AccessLogFormat
+	mu     sync.Mutex
+	w      io.Writer
+}
+
+// logAccess writes the line for natsReq answered with status and a body of n
+// bytes.
+func (s *Server) logAccess(natsReq *NATSHTTPRequest, status int, n int64) {
+	line := s.accessLog.line(natsReq, status, n, s.clock.Now().Sub(natsReq.receivedAt))
+	if s.accessLog.w == nil {
+		s.logger.Info(line)
+		return
+	}
+	s.accessLog.mu.Lock()
+	defer s.accessLog.mu.Unlock()
+	io.WriteString(s.accessLog.w, line+"\n")
+}
+
+func (a *accessLog) line(natsReq *NATSHTTPRequest, status int, n int64, took time.Duration) string {
+	header := http.Header{}
+	for key, value := range natsReq.Header {
+		header.Set(key, value)
+	}
+	host := "-"
+	if forwarded, _, _ := strings.Cut(header.Get("X-Forwarded-For"), ","); strings.TrimSpace(forwarded) != "" {
+		host = strings.TrimSpace(forwarded)
+	}
+	user := "-"
+	if name, _, ok := (&http.Request{Header: header}).BasicAuth(); ok && name != "" {
+		user = name
+	}
+	method := natsReq.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	target := natsReq.URL
+	if u, err := url.Parse(natsReq.URL); err == nil {
+		target = u.RequestURI()
+	}
+	proto, _, _ := protoOrDefault(natsReq.Proto, natsReq.ProtoMajor, natsReq.ProtoMinor)
+	size := "-"
+	if n > 0 {
+		size = strconv.FormatInt(n, 10)
+	}
+	line := fmt.Sprintf("%s - %s [%s] %s %d %s", host, user,
+		natsReq.receivedAt.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(method+" "+target+" "+proto), status, size)
+	if a.format == CombinedLogFormat {
+		line += " " + quoteOrDash(header.Get("Referer")) + " " + quoteOrDash(header.Get("User-Agent"))
+	}
+	return line + " " + strconv.FormatInt(took.Microseconds(), 10)
+}
+
+func quoteOrDash(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
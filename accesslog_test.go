@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	for _, tc := range []struct {
+		format AccessLogFormat
+		want   string
+	}{
+		{CommonLogFormat, `^203\.0\.113\.9 - alice \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "POST /items\?id=1 HTTP/1\.1" 201 5 \d+\n` +
+			`- - - \[[^]]+\] "GET / HTTP/1\.1" 200 - \d+\n$`},
+		{CombinedLogFormat, `^203\.0\.113\.9 - alice \[[^]]+\] "POST /items\?id=1 HTTP/1\.1" 201 5 "http://ref\.example/" "test-agent" \d+\n` +
+			`- - - \[[^]]+\] "GET / HTTP/1\.1" 200 - "-" "-" \d+\n$`},
+	} {
+		nc := runNATS(t)
+		var log syncBuffer
+		tr := serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost {
+				w.WriteHeader(http.StatusCreated)
+				io.WriteString(w, "hello")
+			}
+		}), WithAccessLog(tc.format, &log))
+
+		req, _ := http.NewRequest("POST", "http://svc/items?id=1", strings.NewReader("x"))
+		req.SetBasicAuth("alice", "secret")
+		req.Header.Set("X-Forwarded-For", "203.0.113.9, 10.0.0.1")
+		req.Header.Set("Referer", "http://ref.example/")
+		req.Header.Set("User-Agent", "test-agent")
+		get, _ := http.NewRequest("GET", "http://svc/", nil)
+		for _, req := range []*http.Request{req, get} {
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+		// lines are written after the reply is sent
+		deadline := time.Now().Add(5 * time.Second)
+		for strings.Count(log.String(), "\n") < 2 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if !regexp.MustCompile(tc.want).MatchString(log.String()) {
+			t.Errorf("format %d: got\n%s", tc.format, log.String())
+		}
+	}
+}
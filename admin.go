@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// Admin messages carry the hex encoded HMAC-SHA256, keyed with the secret
+// given to WithAdmin, of their subject, timestamp, nonce and payload, so a
+// message seen on the bus can't be replayed: servers reject timestamps more
+// than AdminWindow away from their clock and nonces they have seen within
+// it, and a message signed for one admin subject is invalid on any other.
+const (
+	HeaderNATSSignature = "Nats-Signature"
+	// HeaderNATSTimestamp is the signing time in Unix nanoseconds.
+	HeaderNATSTimestamp = "Nats-Timestamp"
+	HeaderNATSNonce     = "Nats-Nonce"
+)
+
+// AdminWindow is how far the timestamp of an admin message may be from the
+// server's clock.
+const AdminWindow = 30 * time.Second
+
+// WithAdmin exposes an admin endpoint on subject for inspecting and tuning a
+// running server. Every admin message must be signed with key, see
+// SignAdminCommand; unsigned, wrongly signed and replayed messages are
+// rejected. An empty key makes Start fail.
+//
+// Hot-reloadable settings:
+//   - allowedHosts
+//   - upstreamTimeout
+//   - maxConcurrency, but only on servers started with WithMaxConcurrency.
+//     Going from serial to concurrent handling (or back) needs a restart.
+//
+// Everything else requires a restart.
+func WithAdmin(subject string, key []byte) ServerOption {
+	return func(s *Server) {
+		s.cfg.AdminSubject = subject
+		s.cfg.AdminKey = key
+	}
+}
+
+// AdminCommand is the payload sent to the admin subject. Command is "get" or
+// "set"; for "set" only the non-nil fields are applied.
+type AdminCommand struct {
+	Command         string   `json:"command"`
+	AllowedHosts    []string `json:"allowedHosts,omitempty"`
+	UpstreamTimeout *string  `json:"upstreamTimeout,omitempty"`
+	MaxConcurrency  *int     `json:"maxConcurrency,omitempty"`
+}
+
+// AdminSettings is the reply to every successful admin command.
+type AdminSettings struct {
+	AllowedHosts    []string `json:"allowedHosts"`
+	UpstreamTimeout string   `json:"upstreamTimeout"`
+	MaxConcurrency  int      `json:"maxConcurrency"`
+	Error           string   `json:"error,omitempty"`
+}
+
+// SignAdminCommand builds a signed admin message for subject, valid for
+// AdminWindow from now and only once.
+func SignAdminCommand(subject string, key []byte, cmd AdminCommand) (*nats.Msg, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(time.Now().UnixNano(), 10)
+	nonce := nuid.Next()
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	msg.Header.Set(HeaderNATSTimestamp, timestamp)
+	msg.Header.Set(HeaderNATSNonce, nonce)
+	msg.Header.Set(HeaderNATSSignature, hex.EncodeToString(adminMAC(key, subject, timestamp, nonce, data)))
+	return msg, nil
+}
+
+func adminMAC(key []byte, subject, timestamp, nonce string, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(subject + "\n" + timestamp + "\n" + nonce + "\n"))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// adminNonces remembers the nonces of admin messages until they would be
+// rejected for their timestamp anyway.
+type adminNonces struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// use records nonce and reports whether it is new.
+func (n *adminNonces) use(nonce string, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for seen, expires := range n.seen {
+		if now.After(expires) {
+			delete(n.seen, seen)
+		}
+	}
+	if _, ok := n.seen[nonce]; ok {
+		return false
+	}
+	if n.seen == nil {
+		n.seen = make(map[string]time.Time)
+	}
+	n.seen[nonce] = now.Add(2 * AdminWindow)
+	return true
+}
+
+// verifyAdmin checks the signature, timestamp and nonce of an admin
+// message.
+func (s *Server) verifyAdmin(msg *nats.Msg) error {
+	timestamp, nonce := msg.Header.Get(HeaderNATSTimestamp), msg.Header.Get(HeaderNATSNonce)
+	sig, err := hex.DecodeString(msg.Header.Get(HeaderNATSSignature))
+	if err != nil || nonce == "" || !hmac.Equal(sig, adminMAC(s.cfg.AdminKey, s.cfg.AdminSubject, timestamp, nonce, msg.Data)) {
+		return errors.New("invalid signature")
+	}
+	ns, err := strconv.ParseInt(timestamp, 10, 64)
+	now := s.clock.Now()
+	if err != nil || now.Sub(time.Unix(0, ns)).Abs() > AdminWindow {
+		return errors.New("stale timestamp")
+	}
+	if !s.adminNonces.use(nonce, now) {
+		return errors.New("replayed message")
+	}
+	return nil
+}
+
+func (s *Server) handleAdmin(msg *nats.Msg) {
+	reply := func(settings AdminSettings) {
+		data, _ := json.Marshal(settings)
+		s.nc.Publish(msg.Reply, data)
+	}
+	if err := s.verifyAdmin(msg); err != nil {
+		reply(AdminSettings{Error: err.Error()})
+		return
+	}
+	var cmd AdminCommand
+	if err := json.Unmarshal(msg.Data, &cmd); err != nil {
+		reply(AdminSettings{Error: "invalid command"})
+		return
+	}
+	switch cmd.Command {
+	case "get":
+	case "set":
+		if err := s.applyAdmin(cmd); err != nil {
+			settings := s.adminSettings()
+			settings.Error = err.Error()
+			reply(settings)
+			return
+		}
+	default:
+		reply(AdminSettings{Error: "unknown command"})
+		return
+	}
+	reply(s.adminSettings())
+}
+
+func (s *Server) applyAdmin(cmd AdminCommand) error {
+	var timeout time.Duration
+	if cmd.UpstreamTimeout != nil {
+		var err error
+		if timeout, err = time.ParseDuration(*cmd.UpstreamTimeout); err != nil || timeout < 0 {
+			return errors.New("invalid upstreamTimeout")
+		}
+	}
+	if cmd.MaxConcurrency != nil {
+		if s.limiter == nil {
+			return errors.New("maxConcurrency can only be changed on servers started with a limit")
+		}
+		if *cmd.MaxConcurrency < 1 {
+			return errors.New("maxConcurrency must be at least 1")
+		}
+	}
+
+	s.mu.Lock()
+	if cmd.AllowedHosts != nil {
+		s.cfg.AllowedHosts = cmd.AllowedHosts
+	}
+	if cmd.UpstreamTimeout != nil {
+		s.cfg.UpstreamTimeout = timeout
+	}
+	s.mu.Unlock()
+	if cmd.MaxConcurrency != nil {
+		s.limiter.setLimit(*cmd.MaxConcurrency)
+	}
+	return nil
+}
+
+func (s *Server) adminSettings() AdminSettings {
+	s.mu.RLock()
+	settings := AdminSettings{
+		AllowedHosts:    s.cfg.AllowedHosts,
+		UpstreamTimeout: s.cfg.UpstreamTimeout.String(),
+	}
+	s.mu.RUnlock()
+	if s.limiter != nil {
+		settings.MaxConcurrency = s.limiter.getLimit()
+	}
+	return settings
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestAdmin(t *testing.T) {
+	nc := runNATS(t)
+	key := []byte("secret")
+	serveHandler(t, nc, "svc", http.NotFoundHandler(), WithAdmin("svc.admin", key), WithMaxConcurrency(2))
+	send := func(msg *nats.Msg) AdminSettings {
+		t.Helper()
+		reply, err := nc.RequestMsg(msg, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var settings AdminSettings
+		if err := json.Unmarshal(reply.Data, &settings); err != nil {
+			t.Fatal(err)
+		}
+		return settings
+	}
+
+	limit := 5
+	msg, _ := SignAdminCommand("svc.admin", key, AdminCommand{Command: "set", MaxConcurrency: &limit})
+	if settings := send(msg); settings.Error != "" || settings.MaxConcurrency != 5 {
+		t.Fatalf("set: %+v", settings)
+	}
+	if settings := send(msg); settings.Error != "replayed message" {
+		t.Fatalf("replay: %+v", settings)
+	}
+
+	msg, _ = SignAdminCommand("svc.admin", []byte("wrong"), AdminCommand{Command: "get"})
+	if settings := send(msg); settings.Error != "invalid signature" {
+		t.Fatalf("wrong key: %+v", settings)
+	}
+
+	msg, _ = SignAdminCommand("svc.admin", key, AdminCommand{Command: "get"})
+	msg.Data = []byte(`{"command":"set","allowedHosts":["evil.example"]}`)
+	if settings := send(msg); settings.Error != "invalid signature" {
+		t.Fatalf("tampered: %+v", settings)
+	}
+
+	// a message signed for another server's admin subject
+	msg, _ = SignAdminCommand("other.admin", key, AdminCommand{Command: "get"})
+	msg.Subject = "svc.admin"
+	if settings := send(msg); settings.Error != "invalid signature" {
+		t.Fatalf("other subject: %+v", settings)
+	}
+
+	old := strconv.FormatInt(time.Now().Add(-2*AdminWindow).UnixNano(), 10)
+	msg = nats.NewMsg("svc.admin")
+	msg.Data = []byte(`{"command":"get"}`)
+	msg.Header.Set(HeaderNATSTimestamp, old)
+	msg.Header.Set(HeaderNATSNonce, "n1")
+	msg.Header.Set(HeaderNATSSignature, hex.EncodeToString(adminMAC(key, "svc.admin", old, "n1", msg.Data)))
+	if settings := send(msg); settings.Error != "stale timestamp" {
+		t.Fatalf("stale: %+v", settings)
+	}
+}
+
+func TestAdminEmptyKey(t *testing.T) {
+	s := NewServer(runNATS(t), "svc", WithAdmin("svc.admin", nil))
+	if err := s.Start(); err == nil {
+		s.Close()
+		t.Fatal("admin endpoint started without a key")
+	}
+}
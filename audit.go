@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"maps"
+	"net/http"
+	"slices"
+)
+
+// RedactedValue replaces the values of redacted headers in audit hooks.
+const RedactedValue = "REDACTED"
+
+// WithAuditHook calls hook with every decoded request before it is
+// forwarded, e.g. to keep an audit trail. The hook sees a copy whose headers
+// listed in redact are replaced by RedactedValue; the body is shared and
+// must not be modified. Use BodyHash rather than logging bodies. Requests
+// rejected by rate limits are not passed to the hook.
+func WithAuditHook(hook func(*NATSHTTPRequest), redact ...string) ServerOption {
+	return func(s *Server) {
+		s.auditHook = hook
+		s.auditRedact = make([]string, len(redact))
+		for i, key := range redact {
+			s.auditRedact[i] = http.CanonicalHeaderKey(key)
+		}
+	}
+}
+
+// BodyHash returns the hex encoded SHA-256 of the request body, without
+// copying it. Streamed and object store bodies are not part of the request
+// and hash like an empty body.
+func (r *NATSHTTPRequest) BodyHash() string {
+	sum := sha256.Sum256(r.Body)
+	return hex.EncodeToString(sum[:])
+}
+
+// audit passes a redacted copy of natsReq to the audit hook.
+func (s *Server) audit(natsReq *NATSHTTPRequest) {
+	audited := *natsReq
+	audited.Header = redactHeaders(natsReq.Header, s.auditRedact)
+	s.auditHook(&audited)
+}
+
+// redactHeaders returns a copy of header with the values of the canonical
+// keys in redact replaced by RedactedValue.
+func redactHeaders(header map[string]string, redact []string) map[string]string {
+	header = maps.Clone(header)
+	for key := range header {
+		if slices.Contains(redact, http.CanonicalHeaderKey(key)) {
+			header[key] = RedactedValue
+		}
+	}
+	return header
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAuditHook(t *testing.T) {
+	nc := runNATS(t)
+	var mu sync.Mutex
+	var audited []*NATSHTTPRequest
+	var upstreamAuth string
+	tr := serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		upstreamAuth = r.Header.Get("Authorization")
+		mu.Unlock()
+	}), WithAuditHook(func(r *NATSHTTPRequest) {
+		mu.Lock()
+		audited = append(audited, r)
+		mu.Unlock()
+	}, "authorization"))
+
+	req, _ := http.NewRequest("POST", "http://svc/orders?id=7", strings.NewReader("order"))
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Request-Id", "abc")
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(audited) != 1 {
+		t.Fatalf("hook called %d times", len(audited))
+	}
+	got := audited[0]
+	sum := sha256.Sum256([]byte("order"))
+	if got.Method != "POST" || got.URL != "http://svc/orders?id=7" || got.BodyHash() != hex.EncodeToString(sum[:]) {
+		t.Fatalf("audited %s %s with body hash %s", got.Method, got.URL, got.BodyHash())
+	}
+	if got.Header["Authorization"] != RedactedValue || got.Header["X-Request-Id"] != "abc" {
+		t.Fatalf("audited headers %v", got.Header)
+	}
+	// only the audited copy is redacted
+	if upstreamAuth != "Bearer secret" {
+		t.Fatalf("upstream got Authorization %q", upstreamAuth)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// HeaderBatch marks a message carrying a JSON array of requests instead of
+// a single one. The server answers with a JSON array of envelopes in the
+// same order, or with a single error envelope when the batch as a whole
+// failed.
+const HeaderBatch = "Nats-Http-Batch"
+
+// BatchError is returned by DoBatch when some of the requests failed. Errs
+// is aligned with the requests and nil for the ones that succeeded.
+type BatchError struct {
+	Errs []error
+}
+
+func (e *BatchError) Error() string {
+	failed := 0
+	for _, err := range e.Errs {
+		if err != nil {
+			failed++
+		}
+	}
+	return fmt.Sprintf("nats-http: %d of %d batched requests failed", failed, len(e.Errs))
+}
+
+func (e *BatchError) Unwrap() []error {
+	var errs []error
+	for _, err := range e.Errs {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// DoBatch sends reqs to a server in a single NATS message and returns their
+// responses in the same order. Bodies are always buffered; streaming, single
+// flight, caching and cancel propagation are not used, and the request
+// contexts are ignored in favour of ctx.
+//
+// If some requests failed, e.g. with a ServerError, their responses are nil
+// and DoBatch returns the others together with a *BatchError. Any other
+// error means no response is usable. The whole batch, responses included,
+// has to fit into one NATS message.
+func (t *NATSHTTPTransport) DoBatch(ctx context.Context, reqs []*http.Request) ([]*http.Response, error) {
+	if t.configErr != nil {
+		return nil, t.configErr
+	}
+	natsReqs := make([]*NATSHTTPRequest, len(reqs))
+	requestedGzip := make([]bool, len(reqs))
+	for i, req := range reqs {
+		natsReq, gzip, err := t.newNATSRequest(req, false)
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if natsReq.BodyRef != nil {
+			defer deleteObject(t.nc, natsReq.BodyRef)
+		}
+		// there is one NATS message for all of them, so promoted headers
+		// travel with the request
+		for key, value := range natsReq.promoted {
+			natsReq.Header[key] = value
+		}
+		natsReqs[i], requestedGzip[i] = natsReq, gzip
+	}
+	data, err := json.Marshal(natsReqs)
+	if err != nil {
+		return nil, err
+	}
+	msg := nats.NewMsg(t.subjectReq)
+	msg.Header.Set(HeaderBatch, "1")
+	msg.Data = data
+
+	start := t.clock.Now()
+	reply, err := t.request(ctx, msg)
+	if err != nil {
+		return nil, requestError(t.nc, err)
+	}
+	latency := t.clock.Now().Sub(start)
+	if !bytes.HasPrefix(bytes.TrimSpace(reply.Data), []byte("[")) {
+		// a single envelope is the error for the whole batch
+		_, err := t.decodeReply(reply)
+		if err == nil {
+			err = &DecodeError{Err: fmt.Errorf("batch reply is not an array")}
+		}
+		return nil, err
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(reply.Data, &items); err != nil {
+		return nil, &DecodeError{Err: err}
+	}
+	if len(items) != len(reqs) {
+		return nil, &DecodeError{Err: fmt.Errorf("batch reply has %d items, want %d", len(items), len(reqs))}
+	}
+	resps := make([]*http.Response, len(reqs))
+	var errs []error
+	for i, item := range items {
+		natsResp, err := t.decodeReply(&nats.Msg{Data: item})
+		if err != nil {
+			if errs == nil {
+				errs = make([]error, len(reqs))
+			}
+			errs[i] = err
+			continue
+		}
+		resps[i] = t.newResponse(reqs[i].Context(), msg.Subject, natsResp, nil, requestedGzip[i], latency)
+		setRequest(resps[i], reqs[i])
+	}
+	if errs != nil {
+		return resps, &BatchError{Errs: errs}
+	}
+	return resps, nil
+}
+
+// WithBatchConcurrency lets the server run up to n requests of a batch at
+// the same time. By default they run one after the other. The requests
+// still count against WithMaxConcurrency individually.
+func WithBatchConcurrency(n int) ServerOption {
+	return func(s *Server) {
+		s.cfg.BatchConcurrency = n
+	}
+}
+
+// handleBatch serves every request of a batch and replies with the
+// collected envelopes. Each request is handled like a single one, except
+// that its reply is captured instead of published, see publishReply.
+func (s *Server) handleBatch(msg *nats.Msg) {
+	var natsReqs []NATSHTTPRequest
+	if err := json.Unmarshal(msg.Data, &natsReqs); err != nil {
+		if s.decodeErrors == ErrorReply {
+			s.replyErrorCode(msg, http.StatusBadRequest, ErrorCodeInvalidRequest, "invalid request: "+err.Error())
+		}
+		return
+	}
+	receivedAt := s.clock.Now()
+	replies := make([]json.RawMessage, len(natsReqs))
+	sem := make(chan struct{}, max(s.cfg.BatchConcurrency, 1))
+	var wg sync.WaitGroup
+	for i := range natsReqs {
+		natsReq := &natsReqs[i]
+		natsReq.receivedAt = receivedAt
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			replies[i] = s.serveCaptured(msg, natsReq)
+		}()
+	}
+	wg.Wait()
+
+	data, _ := json.Marshal(replies)
+	if maxPayload := int(s.nc.MaxPayload()); maxPayload > 0 && len(data) > maxPayload {
+		s.replyError(msg, http.StatusBadGateway, "batch response exceeds max payload")
+		return
+	}
+	if err := s.publishReply(msg.Reply, 0, data); err != nil {
+		s.replyFailed(msg.Reply, err)
+	}
+}
+
+// serveCaptured serves one request of a batch and returns its envelope.
+func (s *Server) serveCaptured(batch *nats.Msg, natsReq *NATSHTTPRequest) json.RawMessage {
+	item := &nats.Msg{Subject: batch.Subject, Reply: s.nc.NewInbox(), Header: batch.Header, Sub: batch.Sub}
+	var captured []byte
+	s.captures.Store(item.Reply, &captured)
+	defer s.captures.Delete(item.Reply)
+
+	if natsReq.BodyStream || natsReq.Stream || natsReq.Informational {
+		s.replyError(item, http.StatusBadRequest, "streaming is not supported in batches")
+		return captured
+	}
+	// each request of the batch takes its own token
+	if s.rateLimited(item) || s.identityLimited(item, natsReq) {
+		return captured
+	}
+	if s.limiter != nil {
+		prio := s.priorityFunc(natsReq)
+		s.limiter.acquire(prio)
+		defer s.limiter.release()
+	}
+	s.serve(item, natsReq)
+	return captured
+}
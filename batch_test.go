@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestBatch(t *testing.T) {
+	nc := runNATS(t)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hi "+r.URL.Path)
+	})
+	tr := serveHandler(t, nc, "svc", h, WithBatchConcurrency(2))
+	var reqs []*http.Request
+	for _, path := range []string{"/a", "/b", "/c"} {
+		req, _ := http.NewRequest("GET", "http://svc"+path, nil)
+		reqs = append(reqs, req)
+	}
+	resps, err := tr.DoBatch(context.Background(), reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, resp := range resps {
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "hi "+reqs[i].URL.Path {
+			t.Errorf("response %d is %q", i, body)
+		}
+	}
+}
+
+func TestBatchReplyFailure(t *testing.T) {
+	nc := runNATS(t)
+	snc, err := nats.Connect(nc.ConnectedUrl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	entered, release := make(chan struct{}), make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	})
+	s := NewServer(snc, "svc", WithHandler(h), WithLogger(slog.New(slog.DiscardHandler)))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	snc.Flush()
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequest("GET", "http://svc/", nil)
+	go tr.DoBatch(ctx, []*http.Request{req})
+	<-entered
+	// the batch reply can't be published anymore, which must not take
+	// the server down
+	snc.Close()
+	close(release)
+	for start := time.Now(); s.Stats().FailedReplies == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("failed reply not counted")
+		}
+	}
+}
+
+func TestBatchRateLimit(t *testing.T) {
+	nc := runNATS(t)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hi")
+	})
+	tr := serveHandler(t, nc, "svc", h, WithRateLimit("svc", 1, 3), WithServerClock(newFakeClock()))
+	var reqs []*http.Request
+	for range 5 {
+		req, _ := http.NewRequest("GET", "http://svc/", nil)
+		reqs = append(reqs, req)
+	}
+	// a batch can't get more requests through than the bucket holds
+	resps, err := tr.DoBatch(context.Background(), reqs)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("got %v, want a BatchError", err)
+	}
+	for i, err := range batchErr.Errs {
+		var se *ServerError
+		switch {
+		case i < 3 && (err != nil || resps[i] == nil):
+			t.Errorf("request %d: %v", i, err)
+		case i >= 3 && (!errors.As(err, &se) || se.StatusCode != http.StatusTooManyRequests):
+			t.Errorf("request %d: got %v, want a 429", i, err)
+		}
+	}
+}
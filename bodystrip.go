@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+)
+
+// WithBodyStripping drops the body of requests with one of methods before
+// they go upstream, GET, HEAD and DELETE when none are given. A body on
+// those is legal but unusual, and some upstreams reject it. By default
+// bodies are forwarded as they come, for fidelity. A streamed body is
+// never uploaded and an object store body is deleted unread.
+func WithBodyStripping(methods ...string) ServerOption {
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead, http.MethodDelete}
+	}
+	return func(s *Server) {
+		s.stripBodies = methods
+	}
+}
+
+// stripsBody reports whether the body of a request with method is dropped.
+// Methods are case-sensitive, as for WithAllowedMethods.
+func (s *Server) stripsBody(method string) bool {
+	if method == "" {
+		method = http.MethodGet
+	}
+	return slices.Contains(s.stripBodies, method)
+}
+
+// stripBody leaves httpReq without a body.
+func stripBody(httpReq *http.Request) {
+	httpReq.Body = http.NoBody
+	httpReq.ContentLength = 0
+	httpReq.GetBody = nil
+	httpReq.Header.Del("Content-Length")
+	httpReq.Header.Del("Transfer-Encoding")
+}
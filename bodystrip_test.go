@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func TestBodyStripping(t *testing.T) {
+	nc := runNATS(t, func(o *server.Options) {
+		o.JetStream = true
+		o.StoreDir = t.TempDir()
+	})
+	js, _ := nc.JetStream()
+	store, err := js.CreateObjectStore(&nats.ObjectStoreConfig{Bucket: "bodies"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}), WithBodyStripping(), WithServerObjectStore("bodies"))
+
+	for method, want := range map[string]string{"GET": "", "DELETE": "", "POST": "body", "get": "body"} {
+		req, _ := http.NewRequest(method, "http://svc/", strings.NewReader("body"))
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body, _ := io.ReadAll(resp.Body); string(body) != want {
+			t.Errorf("%s: upstream got %q, want %q", method, body, want)
+		}
+	}
+
+	// an object store body of a stripped request is deleted unread, so one
+	// that is already gone doesn't fail the request
+	if _, err := store.PutBytes(objectNamePrefix+"stored", []byte("body")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"stored", "missing"} {
+		data, _ := json.Marshal(NATSHTTPRequest{Method: "GET", URL: "http://svc/", BodyRef: &ObjectRef{Bucket: "bodies", Name: objectNamePrefix + name}})
+		msg, err := nc.Request("svc", data, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		natsResp, err := tr.decodeReply(msg)
+		if err != nil || natsResp.StatusCode != http.StatusOK || len(natsResp.Body) != 0 {
+			t.Fatalf("%s: got %v, %v", name, natsResp, err)
+		}
+	}
+	if list, _ := store.List(); len(list) != 0 {
+		t.Fatalf("%d objects left after stripped requests", len(list))
+	}
+
+	big := bytes.Repeat([]byte("x"), 1<<16)
+	tr = NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithObjectStoreBodies("bodies", 1<<10))
+	req, _ := http.NewRequest("GET", "http://svc/", bytes.NewReader(big))
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(resp.Body); len(body) != 0 {
+		t.Fatalf("upstream got %d bytes", len(body))
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// WithBroadcastLimit makes Broadcast return as soon as n replies have been
+// collected instead of waiting for the deadline.
+func WithBroadcastLimit(n int) Option {
+	return func(t *NATSHTTPTransport) {
+		t.broadcastLimit = n
+	}
+}
+
+// Broadcast sends req to every server subscribed to the request subject,
+// scatter-gather style, and returns the responses of all of them.
+//
+// Replies are collected until ctx is done, or for the transport timeout if
+// ctx has no deadline, or until the WithBroadcastLimit count is reached. The
+// responses come in arrival order and are always fully buffered; streaming
+// is not used. Replies that fail to decode or are error envelopes are left
+// out. If no usable reply arrived Broadcast returns the first such error,
+// ErrNoResponders when nobody is subscribed, or the context error.
+// Servers in a queue group are only reached once per group.
+func (t *NATSHTTPTransport) Broadcast(ctx context.Context, req *http.Request) ([]*http.Response, error) {
+	if t.configErr != nil {
+		return nil, t.configErr
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = withTimeout(ctx, t.clock, t.Timeout())
+		defer cancel()
+	}
+	natsReq, requestedGzip, err := t.newNATSRequest(req, false)
+	if err != nil {
+		return nil, err
+	}
+	if natsReq.BodyRef != nil {
+		// every server reads the body, so none of them may delete it
+		natsReq.BodyRef.Keep = true
+		defer deleteObject(t.nc, natsReq.BodyRef)
+	}
+	data, err := json.Marshal(natsReq)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := t.nc.SubscribeSync(t.newInbox())
+	if err != nil {
+		return nil, requestError(t.nc, err)
+	}
+	defer sub.Unsubscribe()
+
+	start := t.clock.Now()
+	request := t.newMsg(natsReq, data)
+	request.Reply = sub.Subject
+	if err := t.nc.PublishMsg(request); err != nil {
+		return nil, err
+	}
+	var resps []*http.Response
+	var firstErr error
+	for t.broadcastLimit <= 0 || len(resps) < t.broadcastLimit {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			if firstErr == nil && !errors.Is(context.Cause(ctx), context.DeadlineExceeded) {
+				firstErr = requestError(t.nc, err)
+			}
+			break
+		}
+		if len(msg.Data) == 0 && msg.Header.Get("Status") == "503" {
+			return nil, ErrNoResponders
+		}
+		natsResp, err := t.decodeReply(msg)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		resp := t.newResponse(req.Context(), request.Subject, natsResp, nil, requestedGzip, t.clock.Now().Sub(start))
+		setRequest(resp, req)
+		resps = append(resps, resp)
+	}
+	if len(resps) == 0 {
+		if firstErr == nil {
+			firstErr = context.Cause(ctx)
+		}
+		return nil, firstErr
+	}
+	return resps, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestBroadcast(t *testing.T) {
+	nc := runNATS(t)
+	named := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, name) })
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		serveHandler(t, nc, "svc", named(name))
+	}
+	// a queue group is reached once
+	serveHandler(t, nc, "svc", named("group"), WithQueueGroup("group"))
+	serveHandler(t, nc, "svc", named("group"), WithQueueGroup("group"))
+	// error envelopes are left out
+	nc.Subscribe("svc", func(msg *nats.Msg) { msg.Respond([]byte(`{"error":"boom"}`)) })
+	nc.Subscribe("broken", func(msg *nats.Msg) { msg.Respond([]byte(`{"error":"boom"}`)) })
+
+	broadcast := func(tr *NATSHTTPTransport, subject string, timeout time.Duration) ([]string, error) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		req, _ := http.NewRequest("GET", "http://"+subject+"/", nil)
+		resps, err := tr.Broadcast(ctx, req)
+		var names []string
+		for _, resp := range resps {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			names = append(names, string(body))
+		}
+		slices.Sort(names)
+		return names, err
+	}
+
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second)
+	names, err := broadcast(tr, "svc", 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c", "group"}; !slices.Equal(names, want) {
+		t.Fatalf("gathered %v, want %v", names, want)
+	}
+
+	// the limit ends the gathering long before the deadline
+	limited := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithBroadcastLimit(2))
+	start := time.Now()
+	names, err = broadcast(limited, "svc", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); len(names) != 2 || d > time.Second {
+		t.Fatalf("gathered %v in %s, want 2 replies right away", names, d)
+	}
+
+	var se *ServerError
+	if _, err := broadcast(NewNATSHTTPTransport(nc, "broken", "", 5*time.Second), "broken", 300*time.Millisecond); !errors.As(err, &se) || se.Message != "boom" {
+		t.Fatalf("only error envelopes: got %v", err)
+	}
+	if _, err := broadcast(NewNATSHTTPTransport(nc, "nobody", "", 5*time.Second), "nobody", 300*time.Millisecond); !errors.Is(err, ErrNoResponders) {
+		t.Fatalf("nobody subscribed: got %v", err)
+	}
+}
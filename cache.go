@@ -0,0 +1,148 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache holds responses for the transport's private client cache. Keys are
+// method and URL. Implementations must be safe for concurrent use.
+type Cache interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, resp *CachedResponse)
+	Delete(key string)
+}
+
+// CachedResponse is a stored response and the time it stops being fresh.
+type CachedResponse struct {
+	Response NATSHTTPResponse
+	Expires  time.Time
+}
+
+// WithCache enables a private client cache for GET requests.
+//
+// Only 200 responses that are fresh according to Cache-Control max-age or
+// Expires are stored. Responses marked no-store or no-cache, responses with
+// a Vary header and streamed responses are not stored. Stale entries are
+// refetched, not revalidated.
+//
+// Per request, Cache-Control on the request controls the cache:
+//   - no-cache (or max-age=0) skips the lookup but stores the fresh response
+//   - no-store skips both the lookup and storing the response
+func WithCache(c Cache) Option {
+	return func(t *NATSHTTPTransport) {
+		t.cache = c
+	}
+}
+
+// cacheDirectives parses a Cache-Control header into a set of directives
+// and their values.
+func cacheDirectives(h string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(h, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name != "" {
+			directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return directives
+}
+
+// cacheRequestPolicy reports whether req may be answered from the cache and
+// whether its response may be stored.
+func cacheRequestPolicy(req *http.Request) (lookup, store bool) {
+	if req.Method != http.MethodGet {
+		return false, false
+	}
+	cc := cacheDirectives(req.Header.Get("Cache-Control"))
+	if _, ok := cc["no-store"]; ok {
+		return false, false
+	}
+	_, noCache := cc["no-cache"]
+	if noCache || cc["max-age"] == "0" || req.Header.Get("Pragma") == "no-cache" {
+		return false, true
+	}
+	return true, true
+}
+
+// cacheExpiry returns until when resp may be served from the cache, or the
+// zero time if it must not be stored.
+func cacheExpiry(resp *NATSHTTPResponse, now time.Time) time.Time {
+	if resp.StatusCode != http.StatusOK || resp.Header["Vary"] != "" {
+		return time.Time{}
+	}
+	cc := cacheDirectives(resp.Header["Cache-Control"])
+	if _, ok := cc["no-store"]; ok {
+		return time.Time{}
+	}
+	if _, ok := cc["no-cache"]; ok {
+		return time.Time{}
+	}
+	if v, ok := cc["max-age"]; ok {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs <= 0 {
+			return time.Time{}
+		}
+		return now.Add(time.Duration(secs) * time.Second)
+	}
+	if exp, err := http.ParseTime(resp.Header["Expires"]); err == nil && exp.After(now) {
+		return exp
+	}
+	return time.Time{}
+}
+
+// MemoryCache is an in-memory Cache holding up to a fixed number of entries,
+// evicting the oldest first.
+type MemoryCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	// order holds the *memoryEntry values, oldest first
+	order *list.List
+}
+
+type memoryEntry struct {
+	key  string
+	resp *CachedResponse
+}
+
+func NewMemoryCache(maxEntries int) *MemoryCache {
+	return &MemoryCache{maxEntries: maxEntries, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func (c *MemoryCache) Get(key string) (*CachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		return e.Value.(*memoryEntry).resp, true
+	}
+	return nil, false
+}
+
+func (c *MemoryCache) Set(key string, resp *CachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*memoryEntry).resp = resp
+	} else {
+		c.entries[key] = c.order.PushBack(&memoryEntry{key: key, resp: resp})
+	}
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Front()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*memoryEntry).key)
+	}
+}
+
+func (c *MemoryCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.order.Remove(e)
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMemoryCacheDelete(t *testing.T) {
+	c := NewMemoryCache(2)
+	resp := &CachedResponse{}
+	c.Set("a", resp)
+	c.Delete("a")
+	c.Set("b", resp)
+	c.Set("a", resp)
+	c.Set("c", resp)
+	// b is the oldest entry, a was stored again after it
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := c.Get(key); ok != want {
+			t.Errorf("%s cached: %v", key, ok)
+		}
+	}
+
+	for i := range 1000 {
+		key := fmt.Sprint(i)
+		c.Set(key, resp)
+		c.Delete(key)
+	}
+	c.Delete("a")
+	c.Delete("c")
+	if n := c.order.Len(); n != 0 {
+		t.Fatalf("%d keys left in the eviction order", n)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Clock is the time source of a transport or server. Replacing it lets
+// tests drive timeouts, cache expiry, rate limits and timings without
+// sleeping. Waits on NATS subscriptions, like stream chunk timeouts, still
+// use real time.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	// AfterFunc calls f in its own goroutine once d has passed. The
+	// returned Timer's channel is not used.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is the Clock counterpart of time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                            { return time.Now() }
+func (realClock) NewTimer(d time.Duration) Timer            { return realTimer{time.NewTimer(d)} }
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return realTimer{time.AfterFunc(d, f)} }
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// WithClock replaces the transport's time source, the real clock by
+// default.
+func WithClock(c Clock) Option {
+	return func(t *NATSHTTPTransport) {
+		t.clock = c
+	}
+}
+
+// WithServerClock replaces the server's time source, the real clock by
+// default.
+func WithServerClock(c Clock) ServerOption {
+	return func(s *Server) {
+		s.clock = c
+	}
+}
+
+// withTimeout is context.WithTimeout measured on clock. When the time is
+// up the context's cause is context.DeadlineExceeded.
+func withTimeout(ctx context.Context, clock Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := clock.(realClock); ok {
+		return context.WithTimeout(ctx, d)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	timer := clock.NewTimer(d)
+	go func() {
+		select {
+		case <-timer.C():
+			cancel(context.DeadlineExceeded)
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}()
+	return ctx, func() { cancel(context.Canceled) }
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// fakeClock only moves when advanced.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	c     chan time.Time
+	f     func()
+	when  time.Time
+	armed bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	return c.add(&fakeTimer{c: make(chan time.Time, 1)}, d)
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.add(&fakeTimer{f: f}, d)
+}
+
+func (c *fakeClock) add(t *fakeTimer, d time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t.clock, t.when, t.armed = c, c.now.Add(d), true
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// waiting returns the number of armed timers.
+func (c *fakeClock) waiting() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, t := range c.timers {
+		if t.armed {
+			n++
+		}
+	}
+	return n
+}
+
+// waitFor blocks until n timers are armed.
+func (c *fakeClock) waitFor(tb testing.TB, n int) {
+	tb.Helper()
+	for start := time.Now(); c.waiting() < n; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			tb.Fatalf("%d timers armed, want %d", c.waiting(), n)
+		}
+	}
+}
+
+// advance moves the clock by d and fires the timers that are due.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	for _, t := range c.timers {
+		if t.armed && !t.when.After(c.now) {
+			t.armed = false
+			due = append(due, t)
+		}
+	}
+	now := c.now
+	c.mu.Unlock()
+	for _, t := range due {
+		if t.f != nil {
+			go t.f()
+		} else {
+			t.c <- now
+		}
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	armed := t.armed
+	t.armed = false
+	return armed
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	armed := t.armed
+	t.when, t.armed = t.clock.now.Add(d), true
+	return armed
+}
+
+func TestFakeClockTimeout(t *testing.T) {
+	nc := runNATS(t)
+	nc.Subscribe("svc", func(*nats.Msg) {})
+	clock := newFakeClock()
+	tr := NewNATSHTTPTransport(nc, "svc", "", time.Hour, WithClock(clock))
+	errc := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "http://svc/", nil)
+		_, err := tr.RoundTrip(req)
+		errc <- err
+	}()
+	clock.waitFor(t, 1)
+	clock.advance(59 * time.Minute)
+	select {
+	case err := <-errc:
+		t.Fatalf("timed out early: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.advance(time.Minute)
+	if err := <-errc; !errors.Is(err, nats.ErrTimeout) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestFakeClockRetryAfter(t *testing.T) {
+	nc := runNATS(t)
+	clock := newFakeClock()
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tr := serveHandler(t, nc, "svc", h, WithServerClock(clock), WithRateLimit("svc", 0.1, 1))
+	do := func() error {
+		req, _ := http.NewRequest("GET", "http://svc/", nil)
+		_, err := tr.RoundTrip(req)
+		return err
+	}
+	if err := do(); err != nil {
+		t.Fatal(err)
+	}
+	// one token every 10s
+	for _, c := range []struct {
+		advance    time.Duration
+		retryAfter time.Duration
+	}{
+		{0, 10 * time.Second},
+		{4 * time.Second, 6 * time.Second},
+		{5 * time.Second, time.Second},
+	} {
+		clock.advance(c.advance)
+		var se *ServerError
+		if err := do(); !errors.As(err, &se) || se.StatusCode != http.StatusTooManyRequests || se.RetryAfter != c.retryAfter {
+			t.Fatalf("after %v: got %v, want Retry-After %v", c.advance, err, c.retryAfter)
+		}
+	}
+	clock.advance(time.Second)
+	if err := do(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFakeClockCacheExpiry(t *testing.T) {
+	nc := runNATS(t)
+	clock := newFakeClock()
+	var hits atomic.Int32
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+	})
+	serveHandler(t, nc, "svc", h)
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithClock(clock), WithCache(NewMemoryCache(8)))
+	for _, c := range []struct {
+		advance time.Duration
+		hits    int32
+	}{{0, 1}, {59 * time.Second, 1}, {time.Second, 2}} {
+		clock.advance(c.advance)
+		req, _ := http.NewRequest("GET", "http://svc/", nil)
+		if _, err := tr.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+		if n := hits.Load(); n != c.hits {
+			t.Fatalf("after %v: %d upstream requests, want %d", c.advance, n, c.hits)
+		}
+	}
+}
+
+func TestRefreshingAuthClock(t *testing.T) {
+	clock := newFakeClock()
+	fetches := 0
+	auth := RefreshingAuth(clock, func() (string, string, time.Time, error) {
+		fetches++
+		return "Authorization", "Bearer " + string(rune('a'+fetches-1)), clock.Now().Add(time.Minute), nil
+	})
+	for _, c := range []struct {
+		advance time.Duration
+		value   string
+	}{{0, "Bearer a"}, {59 * time.Second, "Bearer a"}, {time.Second, "Bearer b"}} {
+		clock.advance(c.advance)
+		if _, value, err := auth(); err != nil || value != c.value {
+			t.Fatalf("after %v: got %q, %v", c.advance, value, err)
+		}
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Config holds the main server settings in one place, for configuration
+// loaded from files or flags. The options for these settings, like
+// WithMaxConcurrency, set the same fields: NewServer is NewServerFromConfig
+// with only Subject and Options. Zero fields mean the same as leaving out
+// the corresponding option, and get their defaults. Options covers
+// everything else and is applied after the fields.
+//
+// Config reads from and writes to JSON, with durations as strings like
+// "30s". Fields that aren't data, and the AdminKey secret, are left out.
+type Config struct {
+	Subject string `json:"subject"`
+
+	// AllowedHosts replaces the default allowList. It can't be combined
+	// with Handler, which has no upstream hosts.
+	AllowedHosts   []string `json:"allowedHosts,omitempty"`
+	AllowedMethods []string `json:"allowedMethods,omitempty"`
+	// Handler serves requests in-process, see WithHandler.
+	Handler           http.Handler      `json:"-"`
+	UpstreamTransport http.RoundTripper `json:"-"`
+	UpstreamTimeout   time.Duration     `json:"-"`
+
+	MaxConcurrency   int `json:"maxConcurrency,omitempty"`
+	Workers          int `json:"workers,omitempty"`
+	BatchConcurrency int `json:"batchConcurrency,omitempty"`
+	MaxHops          int `json:"maxHops,omitempty"`
+
+	Streaming       *StreamConfig `json:"streaming,omitempty"`
+	StreamThreshold int64         `json:"streamThreshold,omitempty"`
+	HopCodecs       []string      `json:"hopCodecs,omitempty"`
+	// CompressionThreshold of zero keeps DefaultCompressionThreshold, -1
+	// compresses every body.
+	CompressionThreshold int `json:"compressionThreshold,omitempty"`
+
+	TruncateOversized bool `json:"truncateOversized,omitempty"`
+	VerboseErrors     bool `json:"verboseErrors,omitempty"`
+
+	AdminSubject string `json:"adminSubject,omitempty"`
+	AdminKey     []byte `json:"-"`
+
+	Logger  *slog.Logger   `json:"-"`
+	Options []ServerOption `json:"-"`
+}
+
+func (c Config) MarshalJSON() ([]byte, error) {
+	type plain Config
+	return json.Marshal(struct {
+		plain
+		UpstreamTimeout string `json:"upstreamTimeout,omitempty"`
+	}{plain(c), formatDuration(c.UpstreamTimeout)})
+}
+
+func (c *Config) UnmarshalJSON(data []byte) error {
+	type plain Config
+	aux := struct {
+		*plain
+		UpstreamTimeout string `json:"upstreamTimeout,omitempty"`
+	}{plain: (*plain)(c)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	var err error
+	c.UpstreamTimeout, err = parseDuration(aux.UpstreamTimeout)
+	return err
+}
+
+// MarshalConfig returns the server's effective settings as an indented
+// Config, e.g. to log them at startup, with the defaults filled in. Only
+// what Config covers is included; the admin key is left out.
+func (s *Server) MarshalConfig() ([]byte, error) {
+	s.mu.RLock()
+	c := s.cfg
+	s.mu.RUnlock()
+	if c.Handler != nil {
+		c.AllowedHosts = nil
+	}
+	if s.limiter != nil {
+		c.MaxConcurrency = s.limiter.getLimit()
+	}
+	return json.MarshalIndent(c, "", "  ")
+}
+
+// TransportConfig holds the transport settings, as MarshalConfig reports
+// them and NewTransportFromConfig takes them, so a transport can be logged
+// and reproduced elsewhere. Zero fields mean the same as leaving out the
+// corresponding option. Settings that are code, like hooks, a Cache other
+// than a MemoryCache or a Clock, aren't data: they go into Options, which
+// is applied after the fields and left out of the JSON.
+//
+// TransportConfig reads from and writes to JSON, with durations as strings
+// like "30s" and priorities by name.
+type TransportConfig struct {
+	Subject         string        `json:"subject"`
+	ResponseSubject string        `json:"responseSubject,omitempty"`
+	Timeout         time.Duration `json:"-"`
+	InboxPrefix     string        `json:"inboxPrefix,omitempty"`
+
+	DisableCompression   bool `json:"disableCompression,omitempty"`
+	DebugHeaders         bool `json:"debugHeaders,omitempty"`
+	SingleFlight         bool `json:"singleFlight,omitempty"`
+	CancelPropagation    bool `json:"cancelPropagation,omitempty"`
+	ObservabilityHeaders bool `json:"observabilityHeaders,omitempty"`
+
+	ContextKeys    []ContextKey  `json:"contextKeys,omitempty"`
+	Streaming      *StreamConfig `json:"streaming,omitempty"`
+	BroadcastLimit int           `json:"broadcastLimit,omitempty"`
+	PromotedPrefix string        `json:"promotedPrefix,omitempty"`
+
+	HopCodecs           []string `json:"hopCodecs,omitempty"`
+	HopDecodeFallback   bool     `json:"hopDecodeFallback,omitempty"`
+	MaxDecompressedSize int64    `json:"maxDecompressedSize,omitempty"`
+
+	// ObjectStoreBucket enables WithObjectStoreBodies with
+	// ObjectStoreThreshold.
+	ObjectStoreBucket    string `json:"objectStoreBucket,omitempty"`
+	ObjectStoreThreshold int64  `json:"objectStoreThreshold,omitempty"`
+	// MemoryCacheEntries enables WithCache with a MemoryCache of that
+	// size.
+	MemoryCacheEntries int `json:"memoryCacheEntries,omitempty"`
+
+	StickyHeader       string   `json:"stickyHeader,omitempty"`
+	StickySubjects     []string `json:"stickySubjects,omitempty"`
+	LargeBodySubject   string   `json:"largeBodySubject,omitempty"`
+	LargeBodyThreshold int64    `json:"largeBodyThreshold,omitempty"`
+	PrioritySubject    string   `json:"prioritySubject,omitempty"`
+	PriorityMin        Priority `json:"-"`
+
+	// TraceLogging enables WithTraceLogging. Redact lists the headers
+	// redacted on top of SensitiveHeaders.
+	TraceLogging *TraceLoggingConfig `json:"traceLogging,omitempty"`
+
+	// AdaptiveMultiplier enables WithAdaptiveTimeout, kept between
+	// AdaptiveMin and AdaptiveMax.
+	AdaptiveMultiplier float64       `json:"adaptiveMultiplier,omitempty"`
+	AdaptiveMin        time.Duration `json:"-"`
+	AdaptiveMax        time.Duration `json:"-"`
+	// MaxHedges enables WithHedging after HedgeDelay.
+	HedgeDelay time.Duration `json:"-"`
+	MaxHedges  int           `json:"maxHedges,omitempty"`
+
+	KeepaliveMax     time.Duration `json:"-"`
+	MaxTotalDuration time.Duration `json:"-"`
+	RTTInterval      time.Duration `json:"-"`
+
+	Options []Option `json:"-"`
+}
+
+// TraceLoggingConfig holds the arguments of WithTraceLogging.
+type TraceLoggingConfig struct {
+	MaxBodyBytes int      `json:"maxBodyBytes"`
+	Redact       []string `json:"redact,omitempty"`
+}
+
+// transportDurations are the fields of TransportConfig JSON doesn't write
+// as they are.
+type transportDurations struct {
+	Timeout          string `json:"timeout,omitempty"`
+	PriorityMin      string `json:"priorityMin,omitempty"`
+	AdaptiveMin      string `json:"adaptiveMin,omitempty"`
+	AdaptiveMax      string `json:"adaptiveMax,omitempty"`
+	HedgeDelay       string `json:"hedgeDelay,omitempty"`
+	KeepaliveMax     string `json:"keepaliveMax,omitempty"`
+	MaxTotalDuration string `json:"maxTotalDuration,omitempty"`
+	RTTInterval      string `json:"rttInterval,omitempty"`
+}
+
+func (c TransportConfig) MarshalJSON() ([]byte, error) {
+	type plain TransportConfig
+	aux := transportDurations{
+		Timeout:          formatDuration(c.Timeout),
+		AdaptiveMin:      formatDuration(c.AdaptiveMin),
+		AdaptiveMax:      formatDuration(c.AdaptiveMax),
+		HedgeDelay:       formatDuration(c.HedgeDelay),
+		KeepaliveMax:     formatDuration(c.KeepaliveMax),
+		MaxTotalDuration: formatDuration(c.MaxTotalDuration),
+		RTTInterval:      formatDuration(c.RTTInterval),
+	}
+	if c.PrioritySubject != "" {
+		aux.PriorityMin = c.PriorityMin.String()
+	}
+	return json.Marshal(struct {
+		plain
+		transportDurations
+	}{plain(c), aux})
+}
+
+func (c *TransportConfig) UnmarshalJSON(data []byte) error {
+	type plain TransportConfig
+	var aux transportDurations
+	if err := json.Unmarshal(data, &struct {
+		*plain
+		*transportDurations
+	}{(*plain)(c), &aux}); err != nil {
+		return err
+	}
+	c.PriorityMin = parsePriority(aux.PriorityMin)
+	var errs []error
+	for _, d := range []struct {
+		field *time.Duration
+		value string
+	}{
+		{&c.Timeout, aux.Timeout},
+		{&c.AdaptiveMin, aux.AdaptiveMin},
+		{&c.AdaptiveMax, aux.AdaptiveMax},
+		{&c.HedgeDelay, aux.HedgeDelay},
+		{&c.KeepaliveMax, aux.KeepaliveMax},
+		{&c.MaxTotalDuration, aux.MaxTotalDuration},
+		{&c.RTTInterval, aux.RTTInterval},
+	} {
+		var err error
+		*d.field, err = parseDuration(d.value)
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// MarshalConfig returns the transport's settings as an indented
+// TransportConfig, e.g. to log them at startup. Hooks and other code are
+// left out.
+func (t *NATSHTTPTransport) MarshalConfig() ([]byte, error) {
+	c := TransportConfig{
+		Subject:              t.subjectReq,
+		ResponseSubject:      t.subjectResp,
+		Timeout:              t.timeout,
+		InboxPrefix:          t.inboxPrefix,
+		DisableCompression:   t.disableCompression,
+		DebugHeaders:         t.debugHeaders,
+		SingleFlight:         t.singleFlight != nil,
+		CancelPropagation:    t.cancelPropagation,
+		ObservabilityHeaders: t.observabilityHeaders,
+		ContextKeys:          t.contextKeys,
+		Streaming:            t.streaming,
+		BroadcastLimit:       t.broadcastLimit,
+		PromotedPrefix:       t.promotedPrefix,
+		HopCodecs:            t.hopCodecs,
+		HopDecodeFallback:    t.hopDecodeFallback,
+		StickyHeader:         t.stickyHeader,
+		StickySubjects:       t.stickySubjects,
+		LargeBodySubject:     t.largeBodySubject,
+		LargeBodyThreshold:   t.largeBodyThreshold,
+		PrioritySubject:      t.prioritySubject,
+		PriorityMin:          t.priorityMin,
+		KeepaliveMax:         t.keepaliveMax,
+		MaxTotalDuration:     t.maxTotal,
+		RTTInterval:          t.rtt.interval,
+	}
+	if t.maxDecompressedSize != DefaultMaxDecompressedSize {
+		c.MaxDecompressedSize = t.maxDecompressedSize
+	}
+	if t.objectStore != nil {
+		c.ObjectStoreBucket, c.ObjectStoreThreshold = t.objectStore.bucket, t.objectStore.threshold
+	}
+	if cache, ok := t.cache.(*MemoryCache); ok {
+		c.MemoryCacheEntries = cache.maxEntries
+	}
+	if tr := t.trace; tr != nil {
+		c.TraceLogging = &TraceLoggingConfig{MaxBodyBytes: tr.maxBody, Redact: tr.redact[len(SensitiveHeaders):]}
+	}
+	if a := t.adaptive; a != nil {
+		c.AdaptiveMultiplier, c.AdaptiveMin, c.AdaptiveMax = a.multiplier, a.min, a.max
+	}
+	if h := t.hedging; h != nil {
+		c.HedgeDelay, c.MaxHedges = h.delay, h.max
+	}
+	return json.MarshalIndent(c, "", "  ")
+}
+
+// NewTransportFromConfig creates a transport from cfg. It fails if an
+// option was given an invalid argument, e.g. an invalid inbox prefix.
+func NewTransportFromConfig(nc *nats.Conn, cfg TransportConfig) (*NATSHTTPTransport, error) {
+	t := NewNATSHTTPTransport(nc, cfg.Subject, cfg.ResponseSubject, cfg.Timeout, cfg.options()...)
+	if t.configErr != nil {
+		return nil, t.configErr
+	}
+	return t, nil
+}
+
+// options translates the set fields into their options.
+func (c *TransportConfig) options() []Option {
+	var opts []Option
+	add := func(set bool, opt func() Option) {
+		if set {
+			opts = append(opts, opt())
+		}
+	}
+	add(c.InboxPrefix != "", func() Option { return WithInboxPrefix(c.InboxPrefix) })
+	add(c.DisableCompression, WithDisableCompression)
+	add(c.DebugHeaders, WithDebugHeaders)
+	add(c.SingleFlight, WithSingleFlight)
+	add(c.CancelPropagation, WithCancelPropagation)
+	add(c.ObservabilityHeaders, WithObservabilityHeaders)
+	add(c.ContextKeys != nil, func() Option { return WithContextKeys(c.ContextKeys...) })
+	add(c.Streaming != nil, func() Option { return WithStreaming(*c.Streaming) })
+	add(c.BroadcastLimit != 0, func() Option { return WithBroadcastLimit(c.BroadcastLimit) })
+	add(c.PromotedPrefix != "", func() Option { return WithPromotedHeaders(c.PromotedPrefix) })
+	add(c.HopCodecs != nil, func() Option { return WithHopCodecs(c.HopCodecs...) })
+	add(c.HopDecodeFallback, WithHopDecodeFallback)
+	add(c.MaxDecompressedSize != 0, func() Option { return WithMaxDecompressedSize(c.MaxDecompressedSize) })
+	add(c.ObjectStoreBucket != "", func() Option { return WithObjectStoreBodies(c.ObjectStoreBucket, c.ObjectStoreThreshold) })
+	add(c.MemoryCacheEntries != 0, func() Option { return WithCache(NewMemoryCache(c.MemoryCacheEntries)) })
+	add(c.StickyHeader != "", func() Option { return WithStickyRouting(c.StickyHeader, c.StickySubjects...) })
+	add(c.LargeBodySubject != "", func() Option { return WithLargeBodySubject(c.LargeBodyThreshold, c.LargeBodySubject) })
+	add(c.PrioritySubject != "", func() Option { return WithPrioritySubject(c.PriorityMin, c.PrioritySubject) })
+	add(c.TraceLogging != nil, func() Option { return WithTraceLogging(c.TraceLogging.MaxBodyBytes, c.TraceLogging.Redact...) })
+	add(c.AdaptiveMultiplier != 0, func() Option { return WithAdaptiveTimeout(c.AdaptiveMultiplier, c.AdaptiveMin, c.AdaptiveMax) })
+	add(c.MaxHedges != 0, func() Option { return WithHedging(c.HedgeDelay, c.MaxHedges) })
+	add(c.KeepaliveMax != 0, func() Option { return WithKeepalive(c.KeepaliveMax) })
+	add(c.MaxTotalDuration != 0, func() Option { return WithMaxTotalDuration(c.MaxTotalDuration) })
+	add(c.RTTInterval != 0, func() Option { return WithRTTInterval(c.RTTInterval) })
+	return append(opts, c.Options...)
+}
+
+// formatDuration is d.String(), but empty for zero.
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+// parseDuration is time.ParseDuration, but zero for empty.
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// Validate reports every problem with c at once.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(c.Subject != "", "subject is required")
+	for _, limit := range []struct {
+		name string
+		n    int
+	}{
+		{"max concurrency", c.MaxConcurrency},
+		{"workers", c.Workers},
+		{"batch concurrency", c.BatchConcurrency},
+		{"max hops", c.MaxHops},
+	} {
+		check(limit.n >= 0, "%s must not be negative, got %d", limit.name, limit.n)
+	}
+	check(c.UpstreamTimeout >= 0, "upstream timeout must not be negative, got %s", c.UpstreamTimeout)
+	check(c.CompressionThreshold >= -1, "compression threshold must be -1 or more, got %d", c.CompressionThreshold)
+	check(c.StreamThreshold >= 0, "stream threshold must not be negative, got %d", c.StreamThreshold)
+	check(c.StreamThreshold == 0 || c.Streaming != nil, "stream threshold needs streaming")
+	if c.Streaming != nil {
+		check(c.Streaming.ChunkSize >= 0 && c.Streaming.Window >= 0 && c.Streaming.Timeout >= 0,
+			"streaming settings must not be negative")
+	}
+	for _, codec := range c.HopCodecs {
+		check(codec == HopCodecGzip || codec == HopCodecZstd, "unknown hop codec %q", codec)
+	}
+	check(c.Handler == nil || c.AllowedHosts == nil, "allowed hosts don't apply to a handler")
+	check(c.Handler == nil || c.UpstreamTransport == nil, "handler and upstream transport are exclusive")
+	check((c.AdminSubject == "") == (len(c.AdminKey) == 0), "admin subject and key go together")
+	return errors.Join(errs...)
+}
+
+// NewServerFromConfig creates a server from cfg, failing if cfg is invalid
+// once its Options are applied.
+func NewServerFromConfig(nc *nats.Conn, cfg Config) (*Server, error) {
+	s := newServer(nc, cfg)
+	if s.configErr != nil {
+		return nil, s.configErr
+	}
+	return s, nil
+}
+
+// setDefaults fills in the defaults of the zero fields.
+func (c *Config) setDefaults() {
+	if c.AllowedHosts == nil {
+		c.AllowedHosts = allowList
+	}
+	if c.MaxHops == 0 {
+		c.MaxHops = DefaultMaxHops
+	}
+	if c.CompressionThreshold == 0 {
+		c.CompressionThreshold = DefaultCompressionThreshold
+	}
+	if c.Streaming != nil {
+		streaming := c.Streaming.withDefaults()
+		c.Streaming = &streaming
+	}
+	if c.Logger == nil {
+		c.Logger = slog.Default()
+	}
+}
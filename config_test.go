@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	handler := http.NotFoundHandler()
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+		want []string
+	}{
+		{"valid", Config{Subject: "svc", MaxConcurrency: 4, Streaming: &StreamConfig{}, StreamThreshold: 1 << 20}, nil},
+		{"no subject", Config{}, []string{"subject is required"}},
+		{"negative limits", Config{Subject: "svc", Workers: -1, MaxHops: -2, UpstreamTimeout: -time.Second}, []string{
+			"workers must not be negative", "max hops must not be negative", "upstream timeout must not be negative",
+		}},
+		{"threshold without streaming", Config{Subject: "svc", StreamThreshold: 10}, []string{"stream threshold needs streaming"}},
+		{"unknown codec", Config{Subject: "svc", HopCodecs: []string{"brotli"}}, []string{`unknown hop codec "brotli"`}},
+		{"handler with hosts", Config{Subject: "svc", Handler: handler, AllowedHosts: []string{"example.com"}}, []string{"allowed hosts don't apply"}},
+		{"admin without key", Config{Subject: "svc", AdminSubject: "admin"}, []string{"admin subject and key go together"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cfg.Validate()
+			if tc.want == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("config accepted")
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("%q does not report %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewServerFromConfig(t *testing.T) {
+	nc := runNATS(t)
+	if _, err := NewServerFromConfig(nc, Config{Subject: "svc", Workers: -1}); err == nil {
+		t.Fatal("invalid config accepted")
+	}
+	s, err := NewServerFromConfig(nc, Config{Subject: "svc", Handler: http.NotFoundHandler(), MaxHops: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.cfg.MaxHops != 3 || s.cfg.Handler == nil {
+		t.Fatalf("config not applied: max hops %d", s.cfg.MaxHops)
+	}
+}
+
+func TestOptionsFillConfig(t *testing.T) {
+	nc := runNATS(t)
+	// options are validated like the fields they set
+	if err := NewServer(nc, "svc", WithWorkers(-1)).Start(); err == nil || !strings.Contains(err.Error(), "workers must not be negative") {
+		t.Fatalf("got %v", err)
+	}
+	if err := NewServer(nc, "svc", WithHandler(http.NotFoundHandler()), WithAllowedHosts("example.com")).Start(); err == nil {
+		t.Fatal("allowed hosts accepted for a handler")
+	}
+
+	fromOptions := NewServer(nc, "svc", WithMaxConcurrency(4), WithMaxHops(3), WithAllowedMethods("GET"),
+		WithUpstreamTimeout(time.Second), WithServerStreaming(StreamConfig{}), WithCompressionThreshold(0), WithVerboseErrors())
+	fromConfig, err := NewServerFromConfig(nc, Config{Subject: "svc", MaxConcurrency: 4, MaxHops: 3, AllowedMethods: []string{"GET"},
+		UpstreamTimeout: time.Second, Streaming: &StreamConfig{}, CompressionThreshold: -1, VerboseErrors: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := fromOptions.MarshalConfig()
+	b, _ := fromConfig.MarshalConfig()
+	if string(a) != string(b) {
+		t.Fatalf("options give\n%s\nconfig gives\n%s", a, b)
+	}
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	nc := runNATS(t)
+	s, err := NewServerFromConfig(nc, Config{Subject: "svc", AllowedHosts: []string{"example.com"}, UpstreamTimeout: 3 * time.Second,
+		AllowedMethods: []string{"GET", "POST"}, MaxConcurrency: 4, Workers: 2, BatchConcurrency: 3, MaxHops: 5,
+		Streaming: &StreamConfig{ChunkSize: 1024, Timeout: time.Second}, StreamThreshold: 4096, HopCodecs: []string{"gzip"},
+		CompressionThreshold: 512, TruncateOversized: true, VerboseErrors: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := s.MarshalConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(a, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := NewServerFromConfig(nc, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := loaded.MarshalConfig(); string(a) != string(b) {
+		t.Fatalf("marshalled\n%s\nloaded back as\n%s", a, b)
+	}
+}
+
+func TestTransportConfigRoundTrip(t *testing.T) {
+	nc := runNATS(t)
+	// the effective stream config has its defaults filled in
+	stream := StreamConfig{ChunkSize: 1024, Timeout: time.Second}.withDefaults()
+	want := TransportConfig{
+		Subject: "svc", ResponseSubject: "svc.resp", Timeout: 2 * time.Second, InboxPrefix: "_INBOX.app",
+		DisableCompression: true, DebugHeaders: true, SingleFlight: true, CancelPropagation: true, ObservabilityHeaders: true,
+		ContextKeys: []ContextKey{"tenant"}, Streaming: &stream,
+		BroadcastLimit: 3, PromotedPrefix: "X-App-", HopCodecs: []string{"gzip"}, HopDecodeFallback: true,
+		MaxDecompressedSize: 1 << 20, ObjectStoreBucket: "bodies", ObjectStoreThreshold: 1 << 16, MemoryCacheEntries: 64,
+		StickyHeader: "X-User", StickySubjects: []string{"svc.a", "svc.b"},
+		LargeBodySubject: "svc.large", LargeBodyThreshold: 1 << 21, PrioritySubject: "svc.prio", PriorityMin: PriorityHigh,
+		TraceLogging:       &TraceLoggingConfig{MaxBodyBytes: 256, Redact: []string{"X-Api-Key"}},
+		AdaptiveMultiplier: 3, AdaptiveMin: 100 * time.Millisecond, AdaptiveMax: 5 * time.Second,
+		HedgeDelay: 50 * time.Millisecond, MaxHedges: 2,
+		KeepaliveMax: time.Minute, MaxTotalDuration: 10 * time.Second, RTTInterval: 30 * time.Second,
+	}
+	tr, err := NewTransportFromConfig(nc, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := tr.MarshalConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got TransportConfig
+	if err := json.Unmarshal(a, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("loaded\n%+v\nwant\n%+v", got, want)
+	}
+	loaded, err := NewTransportFromConfig(nc, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := loaded.MarshalConfig(); string(a) != string(b) {
+		t.Fatalf("marshalled\n%s\nloaded back as\n%s", a, b)
+	}
+
+	if _, err := NewTransportFromConfig(nc, TransportConfig{Subject: "svc", InboxPrefix: "bad prefix"}); err == nil {
+		t.Fatal("invalid inbox prefix accepted")
+	}
+}
+
+func TestTransportConfigBehaviour(t *testing.T) {
+	nc := runNATS(t)
+	serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tr, err := NewTransportFromConfig(nc, TransportConfig{Subject: "svc", Timeout: time.Second, DebugHeaders: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := tr.MarshalConfig()
+	var cfg TransportConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := NewTransportFromConfig(nc, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "http://svc/", nil)
+	resp, err := (&http.Client{Transport: loaded}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("X-NATS-Subject"); got != "svc" {
+		t.Fatalf("debug headers not loaded: subject %q", got)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// hopByHopHeaders are not forwarded by CopyResponse, RFC 9110 section 7.6.1.
+var hopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// CopyResponse performs req over NATS and writes the response to w as it
+// arrives, for proxies that have a ResponseWriter at hand. With streaming
+// enabled every chunk is written and flushed on arrival, so the body is
+// never held in full. Trailers are sent as such.
+//
+// Errors before anything was written leave w untouched for the caller to
+// answer. Once the head is written a failure can only cut the body short,
+// and the error is returned for logging.
+func (t *NATSHTTPTransport) CopyResponse(ctx context.Context, w http.ResponseWriter, req *http.Request) error {
+	resp, err := t.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	header := w.Header()
+	for key, values := range resp.Header {
+		header[key] = values
+	}
+	for _, key := range hopByHopHeaders {
+		header.Del(key)
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if ferr := rc.Flush(); ferr != nil && !errors.Is(ferr, http.ErrNotSupported) {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for key, values := range resp.Trailer {
+		header[http.TrailerPrefix+key] = values
+	}
+	return nil
+}
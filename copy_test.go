@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flushRecorder reports the body written so far on every flush.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	mu      sync.Mutex
+	flushes chan string
+}
+
+func (r *flushRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ResponseRecorder.Write(p)
+}
+
+func (r *flushRecorder) Flush() {
+	r.mu.Lock()
+	body := r.Body.String()
+	r.mu.Unlock()
+	r.flushes <- body
+}
+
+func TestCopyResponseFlushesIncrementally(t *testing.T) {
+	nc := runNATS(t)
+	next := make(chan struct{})
+	u := serveUpstream(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		w.Header().Set("X-Part", "yes")
+		for _, part := range []string{"first,", "second"} {
+			w.Write([]byte(part))
+			w.(http.Flusher).Flush()
+			select {
+			case <-next:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}), WithServerStreaming(StreamConfig{}))
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithStreaming(StreamConfig{}))
+
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder(), flushes: make(chan string, 10)}
+	done := make(chan error, 1)
+	go func() {
+		done <- tr.CopyResponse(context.Background(), w, upstreamRequest("GET", u, "/", nil))
+	}()
+	// The first part has to reach w while the upstream holds back the
+	// second.
+	select {
+	case body := <-w.flushes:
+		if body != "first," {
+			t.Fatalf("first flush had %q", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing flushed before the upstream finished")
+	}
+	close(next)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Body.String(); got != "first,second" {
+		t.Fatalf("got body %q", got)
+	}
+	if w.Code != http.StatusOK || w.Header().Get("X-Part") != "yes" || w.Header().Get("Connection") != "" {
+		t.Fatalf("got %d %v", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// CORSConfig describes which cross-origin requests the server admits.
+type CORSConfig struct {
+	// AllowedOrigins lists the origins allowed to make requests, compared
+	// case-insensitively. "*" allows any origin.
+	AllowedOrigins []string
+	// AllowedMethods answers preflights, GET, HEAD and POST by default.
+	AllowedMethods []string
+	// AllowedHeaders lists the request headers allowed in preflights. When
+	// empty, the headers the browser asked for are allowed.
+	AllowedHeaders []string
+	// ExposedHeaders lists response headers the browser may read.
+	ExposedHeaders []string
+	// AllowCredentials allows cookies and auth headers. It needs the
+	// origins listed explicitly: combined with "*" Start fails, as any site
+	// could make credentialed requests.
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight answer.
+	MaxAge time.Duration
+}
+
+// WithCORS makes the server answer CORS preflights, OPTIONS requests with
+// an Origin and Access-Control-Request-Method, itself instead of forwarding
+// them, and add CORS headers to forwarded responses for allowed origins.
+// Preflights from other origins get a 204 without CORS headers, which the
+// browser treats as a refusal.
+func WithCORS(cfg CORSConfig) ServerOption {
+	return func(s *Server) {
+		if cfg.AllowCredentials && slices.Contains(cfg.AllowedOrigins, "*") {
+			s.configErr = errors.Join(s.configErr, errors.New(`nats-http: CORS credentials need explicit origins, not "*"`))
+		}
+		if len(cfg.AllowedMethods) == 0 {
+			cfg.AllowedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+		}
+		s.cors = &cfg
+	}
+}
+
+func (c *CORSConfig) originAllowed(origin string) bool {
+	return slices.ContainsFunc(c.AllowedOrigins, func(o string) bool {
+		return o == "*" || strings.EqualFold(o, origin)
+	})
+}
+
+// setOriginHeaders adds the headers shared by preflights and actual
+// responses. It reports false if origin is not allowed.
+func (c *CORSConfig) setOriginHeaders(header map[string]string, origin string) bool {
+	if origin == "" || !c.originAllowed(origin) {
+		return false
+	}
+	if slices.Contains(c.AllowedOrigins, "*") {
+		header["Access-Control-Allow-Origin"] = "*"
+	} else {
+		header["Access-Control-Allow-Origin"] = origin
+		header["Vary"] = joinHeader(header["Vary"], "Origin")
+	}
+	if c.AllowCredentials {
+		header["Access-Control-Allow-Credentials"] = "true"
+	}
+	return true
+}
+
+// isPreflight reports whether r is a CORS preflight.
+func isPreflight(r *NATSHTTPRequest) bool {
+	return r.Method == http.MethodOptions && r.Header["Origin"] != "" && r.Header["Access-Control-Request-Method"] != ""
+}
+
+// replyPreflight answers a preflight without contacting the upstream.
+func (s *Server) replyPreflight(msg *nats.Msg, r *NATSHTTPRequest) {
+	c := s.cors
+	header := make(map[string]string)
+	if c.setOriginHeaders(header, r.Header["Origin"]) {
+		header["Access-Control-Allow-Methods"] = strings.Join(c.AllowedMethods, ", ")
+		if len(c.AllowedHeaders) > 0 {
+			header["Access-Control-Allow-Headers"] = strings.Join(c.AllowedHeaders, ", ")
+		} else if h := r.Header["Access-Control-Request-Headers"]; h != "" {
+			header["Access-Control-Allow-Headers"] = h
+		}
+		if c.MaxAge > 0 {
+			header["Access-Control-Max-Age"] = strconv.Itoa(int(c.MaxAge.Seconds()))
+		}
+	}
+	data, _ := json.Marshal(NATSHTTPResponse{StatusCode: http.StatusNoContent, Header: header})
+	s.publishReply(msg.Reply, http.StatusNoContent, data)
+}
+
+// addCORSHeaders adds CORS headers to a forwarded response.
+func (s *Server) addCORSHeaders(header map[string]string, r *NATSHTTPRequest) {
+	if s.cors.setOriginHeaders(header, r.Header["Origin"]) && len(s.cors.ExposedHeaders) > 0 {
+		header["Access-Control-Expose-Headers"] = strings.Join(s.cors.ExposedHeaders, ", ")
+	}
+}
+
+func joinHeader(list, value string) string {
+	if list == "" {
+		return value
+	}
+	return list + ", " + value
+}
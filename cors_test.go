@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	nc := runNATS(t)
+	var hits atomic.Int32
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits.Add(1) })
+	tr := serveHandler(t, nc, "svc", h, WithCORS(CORSConfig{
+		AllowedOrigins: []string{"https://a.example"},
+		AllowedMethods: []string{"GET", "PUT"},
+		ExposedHeaders: []string{"X-Foo"},
+		MaxAge:         time.Minute,
+	}))
+	do := func(method, origin string, header ...string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, "http://svc/", nil)
+		req.Header.Set("Origin", origin)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := do("OPTIONS", "https://a.example", "Access-Control-Request-Method", "PUT", "Access-Control-Request-Headers", "X-Bar")
+	if resp.StatusCode != http.StatusNoContent || hits.Load() != 0 {
+		t.Fatalf("preflight got %d, upstream hit %d times", resp.StatusCode, hits.Load())
+	}
+	for key, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://a.example",
+		"Access-Control-Allow-Methods": "GET, PUT",
+		"Access-Control-Allow-Headers": "X-Bar",
+		"Access-Control-Max-Age":       "60",
+	} {
+		if got := resp.Header.Get(key); got != want {
+			t.Errorf("preflight %s = %q, want %q", key, got, want)
+		}
+	}
+
+	// other origins get no CORS headers, which browsers take as a refusal
+	resp = do("OPTIONS", "https://evil.example", "Access-Control-Request-Method", "PUT")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "" || hits.Load() != 0 {
+		t.Fatalf("foreign preflight got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	resp = do("GET", "https://a.example")
+	if hits.Load() != 1 || resp.Header.Get("Access-Control-Allow-Origin") != "https://a.example" || resp.Header.Get("Access-Control-Expose-Headers") != "X-Foo" {
+		t.Fatalf("forwarded response %v", resp.Header)
+	}
+	resp = do("GET", "https://evil.example")
+	if hits.Load() != 2 || resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("forwarded response %v", resp.Header)
+	}
+}
+
+func TestCORSCredentials(t *testing.T) {
+	nc := runNATS(t)
+	s := NewServer(nc, "svc", WithCORS(CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}))
+	if err := s.Start(); err == nil {
+		s.Close()
+		t.Fatal("credentials allowed for any origin")
+	}
+
+	tr := serveHandler(t, nc, "creds", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+		WithCORS(CORSConfig{AllowedOrigins: []string{"https://a.example"}, AllowCredentials: true}))
+	for origin, allowed := range map[string]bool{"https://a.example": true, "https://evil.example": false} {
+		req, _ := http.NewRequest("GET", "http://svc/", nil)
+		req.Header.Set("Origin", origin)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Credentials") == "true"; got != allowed {
+			t.Errorf("%s: credentials allowed %v, want %v", origin, got, allowed)
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Origin"); allowed && got != origin {
+			t.Errorf("%s: Access-Control-Allow-Origin is %q", origin, got)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// ContextKey is the key type for request context values that travel across
+// the NATS hop. Only keys registered with WithContextKeys on the transport
+// are sent, only keys registered with WithServerContextKeys on the server are
+// restored, and only string values are supported since arbitrary values
+// can't be serialized. Values of any other type are silently skipped.
+//
+//	ctx := context.WithValue(ctx, ContextKey("tenant"), "acme")
+type ContextKey string
+
+// WithContextKeys sends the named string values from each request's context
+// along with the request.
+func WithContextKeys(keys ...ContextKey) Option {
+	return func(t *NATSHTTPTransport) {
+		t.contextKeys = append(t.contextKeys, keys...)
+	}
+}
+
+// WithServerContextKeys restores the named values into the context of the
+// upstream request, where a custom upstream RoundTripper can pick them up.
+func WithServerContextKeys(keys ...ContextKey) ServerOption {
+	return func(s *Server) {
+		s.contextKeys = append(s.contextKeys, keys...)
+	}
+}
+
+func contextValues(ctx context.Context, keys []ContextKey) map[string]string {
+	var values map[string]string
+	for _, key := range keys {
+		v, ok := ctx.Value(key).(string)
+		if !ok {
+			continue
+		}
+		if values == nil {
+			values = make(map[string]string, len(keys))
+		}
+		values[string(key)] = v
+	}
+	return values
+}
+
+// withContextValues returns req with the registered values from natsReq added
+// to its context.
+func (s *Server) withContextValues(req *http.Request, natsReq *NATSHTTPRequest) *http.Request {
+	if len(s.contextKeys) == 0 || len(natsReq.Context) == 0 {
+		return req
+	}
+	ctx := req.Context()
+	for _, key := range s.contextKeys {
+		if v, ok := natsReq.Context[string(key)]; ok {
+			ctx = context.WithValue(ctx, key, v)
+		}
+	}
+	return req.WithContext(ctx)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestContextKeys(t *testing.T) {
+	nc := runNATS(t)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, key := range []ContextKey{"tenant", "user", "count", "unsent"} {
+			fmt.Fprintf(w, "%s=%v ", key, r.Context().Value(key))
+		}
+	})
+	serveHandler(t, nc, "svc", h, WithServerContextKeys("tenant", "count", "unsent"))
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithContextKeys("tenant", "user", "count"))
+
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, ContextKey("tenant"), "acme")
+	ctx = context.WithValue(ctx, ContextKey("user"), "alice")
+	ctx = context.WithValue(ctx, ContextKey("count"), 3)
+	ctx = context.WithValue(ctx, ContextKey("unsent"), "x")
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://svc/", nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	// user is sent but not restored, count is not a string and unsent is
+	// not registered with the transport
+	if want := "tenant=acme user=<nil> count=<nil> unsent=<nil> "; string(body) != want {
+		t.Fatalf("got %q, want %q", body, want)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Dead letter error classes.
+const (
+	DeadLetterTimeout   = "timeout"
+	DeadLetterCanceled  = "canceled"
+	DeadLetterUpstream  = "upstream"
+	DeadLetterOversized = "oversized"
+)
+
+// DeadLetter is published for a request the server failed to proxy.
+type DeadLetter struct {
+	Request *NATSHTTPRequest `json:"request"`
+	// Class is one of the DeadLetter* error classes.
+	Class string    `json:"class"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// WithDeadLetter publishes a DeadLetter to subject for every request that
+// failed for good: the upstream could not be reached or did not answer in
+// time, or its response did not fit into a NATS message. Responses with
+// error statuses are not failures. The captured request has the
+// Authorization and Cookie headers, headers the route adds and those
+// redacted for WithAuditHook replaced by RedactedValue, and no body unless
+// WithDeadLetterBodies is set.
+func WithDeadLetter(subject string) ServerOption {
+	return func(s *Server) {
+		s.deadLetter = subject
+	}
+}
+
+// WithDeadLetterBodies includes request bodies in dead letters. Streamed
+// and object store bodies are never part of them.
+func WithDeadLetterBodies() ServerOption {
+	return func(s *Server) {
+		s.deadLetterBodies = true
+	}
+}
+
+// publishDeadLetter reports a failed request to the dead letter subject, if
+// one is configured.
+func (s *Server) publishDeadLetter(msg *nats.Msg, natsReq *NATSHTTPRequest, class string, err error) {
+	if s.deadLetter == "" {
+		return
+	}
+	redact := append([]string{"Authorization", "Cookie"}, s.auditRedact...)
+	if route := s.route(msg); route != nil {
+		for key := range route.Headers {
+			redact = append(redact, http.CanonicalHeaderKey(key))
+		}
+	}
+	failed := *natsReq
+	failed.Header = redactHeaders(natsReq.Header, redact)
+	if !s.deadLetterBodies {
+		failed.Body = nil
+	}
+	data, jerr := json.Marshal(DeadLetter{Request: &failed, Class: class, Error: err.Error(), Time: s.clock.Now()})
+	if jerr != nil {
+		s.logger.Error("encoding dead letter", "error", jerr)
+		return
+	}
+	if perr := s.nc.Publish(s.deadLetter, data); perr != nil {
+		s.logger.Error("publishing dead letter", "subject", s.deadLetter, "error", perr)
+	}
+}
+
+// upstreamErrorClass classifies an error from the upstream request.
+func upstreamErrorClass(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return DeadLetterCanceled
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return DeadLetterTimeout
+	}
+	return DeadLetterUpstream
+}
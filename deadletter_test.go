@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeadLetter(t *testing.T) {
+	for _, bodies := range []bool{false, true} {
+		nc := runNATS(t)
+		dead, err := nc.SubscribeSync("dead")
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := []ServerOption{
+			WithDeadLetter("dead"),
+			WithRoutes(Route{Subject: "svc", Headers: map[string]string{"X-Api-Key": "secret"}}),
+		}
+		if bodies {
+			opts = append(opts, WithDeadLetterBodies())
+		}
+		// The upstream drops every connection without answering.
+		u := serveUpstream(t, nc, "svc", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			panic(http.ErrAbortHandler)
+		}), opts...)
+		tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second)
+
+		req := upstreamRequest("POST", u, "/", strings.NewReader("payload"))
+		req.Header.Set("Authorization", "Bearer client")
+		req.Header.Set("Cookie", "session=1")
+		req.Header.Set("X-Api-Key", "client")
+		req.Header.Set("X-Trace", "abc")
+		if _, err := tr.RoundTrip(req); err == nil {
+			t.Fatal("request to a failing upstream succeeded")
+		}
+		msg, err := dead.NextMsg(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var letter DeadLetter
+		if err := json.Unmarshal(msg.Data, &letter); err != nil {
+			t.Fatal(err)
+		}
+		if letter.Class != DeadLetterUpstream || letter.Error == "" || letter.Time.IsZero() {
+			t.Fatalf("got %+v", letter)
+		}
+		for _, key := range []string{"Authorization", "Cookie", "X-Api-Key"} {
+			if v := letter.Request.Header[key]; v != RedactedValue {
+				t.Errorf("%s: got %q", key, v)
+			}
+		}
+		if v := letter.Request.Header["X-Trace"]; v != "abc" {
+			t.Errorf("X-Trace: got %q", v)
+		}
+		if got := string(letter.Request.Body); bodies && got != "payload" || !bodies && got != "" {
+			t.Errorf("bodies %v: got body %q", bodies, got)
+		}
+	}
+}
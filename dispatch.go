@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+type subjectTokensKey struct{}
+
+// SubjectTokens returns the tokens of the subject a request arrived on that
+// the subscribed subject matched with wildcards: everything from the first
+// wildcard token on. A server on "http.>" receiving "http.users.v1" yields
+// ["users" "v1"], one on "http.*.api" receiving "http.users.api" yields
+// ["users" "api"]. Servers on literal subjects yield nil.
+func SubjectTokens(ctx context.Context) []string {
+	tokens, _ := ctx.Value(subjectTokensKey{}).([]string)
+	return tokens
+}
+
+// WithDispatcher serves every request with the handler pick returns for
+// its SubjectTokens, so with a wildcard subject like "http.>" new routes
+// only need a subject naming them. Upstreams are handlers too, e.g.
+// httputil.NewSingleHostReverseProxy. When pick returns nil the request is
+// answered with 404. Like WithHandler, it replaces proxying to the host in
+// the request and the host allowlist, and is applied after the headers of
+// the Route for the wildcard subject.
+func WithDispatcher(pick func(tokens []string) http.Handler) ServerOption {
+	return WithHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := pick(SubjectTokens(r.Context()))
+		if h == nil {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+}
+
+// subjectTokens returns the tokens of msg's subject matched by the
+// wildcards of the subscription it arrived on.
+func subjectTokens(msg *nats.Msg) []string {
+	if msg.Sub == nil {
+		return nil
+	}
+	for i, token := range strings.Split(msg.Sub.Subject, ".") {
+		if token == "*" || token == ">" {
+			tokens := strings.Split(msg.Subject, ".")
+			if i > len(tokens) {
+				return nil
+			}
+			return tokens[i:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDispatcher(t *testing.T) {
+	nc := runNATS(t)
+	upstreams := map[string]http.Handler{}
+	for _, name := range []string{"users", "orders"} {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name+" "+r.URL.Path+" "+r.Header.Get("X-Route"))
+		}))
+		defer upstream.Close()
+		u, _ := url.Parse(upstream.URL)
+		upstreams[name] = httputil.NewSingleHostReverseProxy(u)
+	}
+	var seen []string
+	serveHandler(t, nc, "http.>", nil,
+		WithDispatcher(func(tokens []string) http.Handler {
+			seen = tokens
+			return upstreams[tokens[0]]
+		}),
+		WithRoutes(Route{Subject: "http.>", Headers: map[string]string{"X-Route": "wildcard"}}))
+
+	for _, c := range []struct {
+		subject, want, tokens string
+	}{
+		{"http.users", "users /list wildcard", "users"},
+		{"http.orders.v1", "orders /list wildcard", "orders v1"},
+	} {
+		tr := NewNATSHTTPTransport(nc, c.subject, "", 5*time.Second)
+		req, _ := http.NewRequest("GET", "http://svc/list", nil)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != c.want || strings.Join(seen, " ") != c.tokens {
+			t.Fatalf("%s: got %q with tokens %q", c.subject, body, seen)
+		}
+	}
+
+	tr := NewNATSHTTPTransport(nc, "http.unknown", "", 5*time.Second)
+	req, _ := http.NewRequest("GET", "http://svc/list", nil)
+	if resp, err := tr.RoundTrip(req); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("got %v, %v", resp, err)
+	}
+}
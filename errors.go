@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ErrMissingStatus is returned for replies that carry neither an error nor a
+// status code. Rather than guessing 200, the transport refuses them so a zero
+// status never reaches the caller.
+var ErrMissingStatus = errors.New("nats-http: reply has no status code")
+
+// ErrConnectionClosed is returned when the NATS connection was closed
+// before or while a request was in flight. It matches
+// nats.ErrConnectionClosed as well.
+var ErrConnectionClosed = fmt.Errorf("nats-http: %w", nats.ErrConnectionClosed)
+
+// ErrNoResponders is returned right away when no server is subscribed to
+// the request subject, instead of waiting for the timeout. It matches
+// nats.ErrNoResponders as well.
+var ErrNoResponders = fmt.Errorf("nats-http: %w", nats.ErrNoResponders)
+
+// requestError turns the error of a failed request into ErrConnectionClosed
+// if the connection is gone, whatever the NATS client reported for it, and
+// into ErrNoResponders if nobody listened.
+func requestError(nc *nats.Conn, err error) error {
+	switch {
+	case errors.Is(err, nats.ErrConnectionClosed) || nc.IsClosed():
+		return ErrConnectionClosed
+	case errors.Is(err, nats.ErrNoResponders):
+		return ErrNoResponders
+	}
+	return err
+}
+
+// PanicError is returned by RoundTrip when it recovered from a panic. Stack
+// holds the goroutine stack at the time of the panic.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("nats-http: panic in RoundTrip: %v\n%s", e.Value, e.Stack)
+}
+
+// ErrInvalidRequest matches, via errors.Is, a ServerError for a request the
+// server could not decode.
+var ErrInvalidRequest = errors.New("nats-http: server could not decode request")
+
+// ErrorCodeInvalidRequest is the envelope error code of ErrInvalidRequest.
+const ErrorCodeInvalidRequest = "invalid_request"
+
+// legacyInvalidRequest is the whole error envelope older servers sent for
+// requests they could not decode: {"error": "invalid request"}.
+const legacyInvalidRequest = "invalid request"
+
+// DecodeError is returned by the transport when it could not decode the
+// server's reply, as opposed to a ServerError matching ErrInvalidRequest,
+// where the server could not decode the request.
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return "nats-http: decoding reply: " + e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// ServerError is returned by the transport when the server answered with an
+// error envelope instead of a proxied response. Older servers send envelopes
+// with just the error, so StatusCode and Code may be zero.
+type ServerError struct {
+	StatusCode int
+	Message    string
+	// Code is the envelope's ErrorCode, if any.
+	Code string
+	// RetryAfter is set when the server asked the client to back off, e.g.
+	// on a 429 from a rate limit.
+	RetryAfter time.Duration
+	// Instance is the ID of the server that answered, if it runs
+	// WithInstanceID.
+	Instance string
+}
+
+func (e *ServerError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("nats-http server: %s", e.Message)
+	}
+	return fmt.Sprintf("nats-http server: %d: %s", e.StatusCode, e.Message)
+}
+
+func (e *ServerError) Is(target error) bool {
+	if target != ErrInvalidRequest {
+		return false
+	}
+	// older servers answer undecodable requests with only this message
+	return e.Code == ErrorCodeInvalidRequest || e.Code == "" && e.StatusCode == 0 && e.Message == legacyInvalidRequest
+}
+
+func newServerError(resp *NATSHTTPResponse) *ServerError {
+	e := &ServerError{StatusCode: resp.StatusCode, Message: resp.Error, Code: resp.ErrorCode, Instance: resp.Instance}
+	if secs, err := strconv.Atoi(resp.Header["Retry-After"]); err == nil {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return e
+}
+
+// WithVerboseErrors includes the upstream error, e.g. the *url.Error from
+// the HTTP client, in the envelope when a request to the upstream fails. The
+// client surfaces it in ServerError.Message. Off by default, since the
+// detail can reveal internal hosts and addresses.
+func WithVerboseErrors() ServerOption {
+	return func(s *Server) {
+		s.cfg.VerboseErrors = true
+	}
+}
+
+// WithErrorMapper decides the status and message of the error envelope sent
+// when the request to the upstream fails, e.g. to answer a DNS failure
+// differently from a refused connection. A status of 0 leaves the error to
+// DefaultErrorMapper. With WithVerboseErrors the error is appended to the
+// message as before.
+func WithErrorMapper(mapper func(err error) (status int, msg string)) ServerOption {
+	return func(s *Server) {
+		s.errorMapper = mapper
+	}
+}
+
+// DefaultErrorMapper is how servers answer failed upstream requests: 504
+// for timeouts and 502 otherwise, with a message naming the kind of failure
+// but not the upstream.
+func DefaultErrorMapper(err error) (status int, msg string) {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	switch {
+	case errors.As(err, &dnsErr) && !dnsErr.IsTimeout:
+		return http.StatusBadGateway, "upstream host not found"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout, "upstream timed out"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return http.StatusBadGateway, "upstream refused connection"
+	case errors.As(err, &certErr), errors.As(err, &recordErr),
+		errors.As(err, &unknownAuthority), errors.As(err, &hostnameErr):
+		return http.StatusBadGateway, "upstream TLS handshake failed"
+	}
+	return http.StatusBadGateway, "failed to make request"
+}
+
+// replyUpstreamError answers a failed upstream request.
+func (s *Server) replyUpstreamError(msg *nats.Msg, err error) {
+	var status int
+	var text string
+	if s.errorMapper != nil {
+		status, text = s.errorMapper(err)
+	}
+	if status == 0 {
+		status, text = DefaultErrorMapper(err)
+	}
+	if s.cfg.VerboseErrors {
+		text += ": " + err.Error()
+	}
+	s.replyError(msg, status, text)
+}
+
+// ErrorStrategy decides what the server does about requests it cannot
+// decode.
+type ErrorStrategy int
+
+const (
+	// ErrorReply answers with a 400 error envelope. The default.
+	ErrorReply ErrorStrategy = iota
+	// ErrorDrop ignores the request, for fire-and-forget publishers that
+	// never read replies.
+	ErrorDrop
+)
+
+// WithDecodeErrors sets how the server handles requests it cannot decode.
+func WithDecodeErrors(strategy ErrorStrategy) ServerOption {
+	return func(s *Server) {
+		s.decodeErrors = strategy
+	}
+}
+
+// replyError publishes an error envelope to the requester.
+func (s *Server) replyError(msg *nats.Msg, status int, text string) {
+	s.replyEnvelope(msg, NATSHTTPResponse{StatusCode: status, Error: text})
+}
+
+// replyErrorCode publishes an error envelope with an error code.
+func (s *Server) replyErrorCode(msg *nats.Msg, status int, code, text string) {
+	s.replyEnvelope(msg, NATSHTTPResponse{StatusCode: status, Error: text, ErrorCode: code})
+}
+
+// replyErrorHeader publishes an error envelope carrying extra headers.
+func (s *Server) replyErrorHeader(msg *nats.Msg, status int, text string, header map[string]string) {
+	s.replyEnvelope(msg, NATSHTTPResponse{StatusCode: status, Header: header, Error: text})
+}
+
+func (s *Server) replyEnvelope(msg *nats.Msg, resp NATSHTTPResponse) {
+	if msg.Reply == "" {
+		return
+	}
+	resp.Instance = s.instanceID
+	data, _ := json.Marshal(resp)
+	if err := s.publishReply(msg.Reply, resp.StatusCode, data); err != nil {
+		s.replyFailed(msg.Reply, err)
+	}
+}
+
+// replyFailed logs and counts a reply that could not be published.
+func (s *Server) replyFailed(reply string, err error) {
+	s.stats.failedReplies.Add(1)
+	s.logger.Error("failed to publish reply", "subject", reply, "error", err)
+}
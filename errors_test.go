@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestDecodeReplyStatus(t *testing.T) {
+	tr := NewNATSHTTPTransport(nil, "svc", "", time.Second)
+	for _, c := range []struct {
+		data   string
+		status int
+		err    error
+	}{
+		{`{"statusCode":200,"header":{},"body":null}`, 200, nil},
+		{`{"statusCode":404,"header":{},"body":null}`, 404, nil},
+		{`{"header":{},"body":null}`, 0, ErrMissingStatus},
+		{`{"statusCode":0,"header":{"Content-Type":"text/plain"},"body":"aGk="}`, 0, ErrMissingStatus},
+	} {
+		resp, err := tr.decodeReply(&nats.Msg{Data: []byte(c.data)})
+		if !errors.Is(err, c.err) || err == nil && resp.StatusCode != c.status {
+			t.Errorf("%s: got %v, %v", c.data, resp, err)
+		}
+	}
+
+	// an error envelope without a status is a server error, not a response
+	_, err := tr.decodeReply(&nats.Msg{Data: []byte(`{"error":"boom"}`)})
+	var se *ServerError
+	if !errors.As(err, &se) || se.Message != "boom" || se.StatusCode != 0 {
+		t.Fatalf("got %v", err)
+	}
+	_, err = tr.decodeReply(&nats.Msg{Data: []byte(`{"statusCode":502,"error":"failed to make request"}`)})
+	if !errors.As(err, &se) || se.StatusCode != 502 {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestRoundTripPanicIsError(t *testing.T) {
+	tr := NewNATSHTTPTransport(nil, "svc", "", time.Second)
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	resp, err := tr.RoundTrip(req)
+	var pe *PanicError
+	if resp != nil || !errors.As(err, &pe) {
+		t.Fatalf("got %v, %v", resp, err)
+	}
+	if !strings.Contains(string(pe.Stack), "RoundTrip") {
+		t.Fatalf("stack doesn't show where it panicked:\n%s", pe.Stack)
+	}
+
+	// http.Client gets an error as well
+	_, err = (&http.Client{Transport: tr}).Get("http://example.com/")
+	if !errors.As(err, &pe) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestVerboseErrors(t *testing.T) {
+	nc := runNATS(t)
+	upstream := roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("dial tcp 10.1.2.3:8080: no route to host")
+	})
+	for subject, verbose := range map[string]bool{"terse": false, "verbose": true} {
+		opts := []ServerOption{WithAllowedHosts("example.com"), WithUpstreamTransport(upstream)}
+		if verbose {
+			opts = append(opts, WithVerboseErrors())
+		}
+		s := NewServer(nc, subject, opts...)
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		nc.Flush()
+
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("Host", "example.com")
+		_, err := NewNATSHTTPTransport(nc, subject, "", 5*time.Second).RoundTrip(req)
+		var se *ServerError
+		if !errors.As(err, &se) || se.StatusCode != http.StatusBadGateway || !strings.HasPrefix(se.Message, "failed to make request") {
+			t.Fatalf("%s: got %v", subject, err)
+		}
+		if detailed := strings.Contains(se.Message, "10.1.2.3:8080: no route to host"); detailed != verbose {
+			t.Fatalf("%s: message %q", subject, se.Message)
+		}
+	}
+}
+
+func TestConnectionClosed(t *testing.T) {
+	nc := runNATS(t)
+	entered, release := make(chan struct{}), make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	})
+	serveHandler(t, nc, "svc", h)
+	t.Cleanup(func() { close(release) })
+	cnc, err := nats.Connect(nc.ConnectedUrl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := NewNATSHTTPTransport(cnc, "svc", "", 5*time.Second)
+
+	// during the request
+	errc := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "http://svc/", nil)
+		_, err := tr.RoundTrip(req)
+		errc <- err
+	}()
+	<-entered
+	cnc.Close()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrConnectionClosed) || !errors.Is(err, nats.ErrConnectionClosed) {
+			t.Fatalf("during: got %v", err)
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatal("request didn't notice the closed connection")
+	}
+
+	// before the request
+	req, _ := http.NewRequest("GET", "http://svc/", nil)
+	if _, err := tr.RoundTrip(req); !errors.Is(err, ErrConnectionClosed) {
+		t.Fatalf("before: got %v", err)
+	}
+}
+
+func TestNoResponders(t *testing.T) {
+	nc := runNATS(t)
+	for _, opts := range [][]Option{nil, {WithInboxPrefix("_TENANT.inbox")}} {
+		tr := NewNATSHTTPTransport(nc, "nobody", "", 5*time.Second, opts...)
+		req, _ := http.NewRequest("GET", "http://svc/", nil)
+		start := time.Now()
+		_, err := tr.RoundTrip(req)
+		if !errors.Is(err, ErrNoResponders) || !errors.Is(err, nats.ErrNoResponders) {
+			t.Fatalf("got %v", err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("took %v to fail", d)
+		}
+	}
+}
+
+func TestErrorMapper(t *testing.T) {
+	nc := runNATS(t)
+	cases := map[string]struct {
+		err     error
+		status  int
+		message string
+	}{
+		"dns":     {&net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}, http.StatusBadGateway, "upstream host not found"},
+		"timeout": {context.DeadlineExceeded, http.StatusGatewayTimeout, "upstream timed out"},
+		"refused": {&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, http.StatusBadGateway, "upstream refused connection"},
+		"tls":     {&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}, http.StatusBadGateway, "upstream TLS handshake failed"},
+		"other":   {errors.New("unexpected EOF"), http.StatusBadGateway, "failed to make request"},
+	}
+	roundTrip := func(subject string) error {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("Host", "example.com")
+		_, err := NewNATSHTTPTransport(nc, subject, "", 5*time.Second).RoundTrip(req)
+		return err
+	}
+	start := func(subject string, opts ...ServerOption) {
+		s := NewServer(nc, subject, append([]ServerOption{WithAllowedHosts("example.com")}, opts...)...)
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		nc.Flush()
+	}
+	// the mapper overrides DNS failures and leaves the rest to the defaults
+	mapper := func(err error) (int, string) {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			return http.StatusServiceUnavailable, "no such service"
+		}
+		return 0, ""
+	}
+	for name, c := range cases {
+		upstream := WithUpstreamTransport(roundTripFunc(func(*http.Request) (*http.Response, error) {
+			return nil, c.err
+		}))
+		start("default."+name, upstream)
+		start("mapped."+name, upstream, WithErrorMapper(mapper))
+
+		var se *ServerError
+		if err := roundTrip("default." + name); !errors.As(err, &se) || se.StatusCode != c.status || se.Message != c.message {
+			t.Errorf("%s: got %v, want %d %q", name, err, c.status, c.message)
+		}
+		if name == "dns" {
+			c.status, c.message = http.StatusServiceUnavailable, "no such service"
+		}
+		if err := roundTrip("mapped." + name); !errors.As(err, &se) || se.StatusCode != c.status || se.Message != c.message {
+			t.Errorf("%s mapped: got %v, want %d %q", name, err, c.status, c.message)
+		}
+	}
+
+	// a real refused connection is recognised through the errors wrapping it
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	s := NewServer(nc, "closed", WithAllowedHosts(l.Addr().String()))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	nc.Flush()
+	req, _ := http.NewRequest("GET", "http://"+l.Addr().String()+"/", nil)
+	req.Header.Set("Host", l.Addr().String())
+	_, err = NewNATSHTTPTransport(nc, "closed", "", 5*time.Second).RoundTrip(req)
+	if se := (*ServerError)(nil); !errors.As(err, &se) || se.Message != "upstream refused connection" {
+		t.Fatalf("closed port: got %v", err)
+	}
+}
+
+func TestLegacyErrorEnvelope(t *testing.T) {
+	nc := runNATS(t)
+	// what older servers answer requests they can't decode with
+	nc.Subscribe("svc", func(msg *nats.Msg) {
+		msg.Respond([]byte(`{"error": "invalid request"}`))
+	})
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second)
+	req, _ := http.NewRequest("GET", "http://svc/", nil)
+	resp, err := tr.RoundTrip(req)
+	var se *ServerError
+	if resp != nil || !errors.As(err, &se) || se.Message != "invalid request" || !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("got %v, %v", resp, err)
+	}
+
+	// through an http.Client too, rather than a zero response
+	_, err = (&http.Client{Transport: tr}).Get("http://svc/")
+	if !errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("client got %v", err)
+	}
+
+	// other legacy errors are server errors, but not invalid requests
+	nc.Subscribe("other", func(msg *nats.Msg) {
+		msg.Respond([]byte(`{"error": "upstream down"}`))
+	})
+	tr = NewNATSHTTPTransport(nc, "other", "", 5*time.Second)
+	req, _ = http.NewRequest("GET", "http://svc/", nil)
+	if _, err := tr.RoundTrip(req); !errors.As(err, &se) || se.Message != "upstream down" || errors.Is(err, ErrInvalidRequest) {
+		t.Fatalf("got %v", err)
+	}
+}
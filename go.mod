@@ -1,13 +1,24 @@
 module github.com/perbu/http-over-nats
 
-go 1.23.4
+go 1.26.0
 
-require github.com/nats-io/nats.go v1.38.0
+require (
+	github.com/klauspost/compress v1.20.0
+	github.com/nats-io/nats.go v1.51.0
+	github.com/nats-io/nuid v1.0.1
+)
+
+// nats-server is only imported by the tests, which run against an embedded
+// server. It sets the floor for go, nats.go and compress above.
+require github.com/nats-io/nats-server/v2 v2.15.0
 
 require (
-	github.com/klauspost/compress v1.17.9 // indirect
-	github.com/nats-io/nkeys v0.4.9 // indirect
-	github.com/nats-io/nuid v1.0.1 // indirect
-	golang.org/x/crypto v0.31.0 // indirect
-	golang.org/x/sys v0.28.0 // indirect
+	github.com/antithesishq/antithesis-sdk-go v0.8.0-default-no-op // indirect
+	github.com/google/go-tpm v0.9.8 // indirect
+	github.com/minio/highwayhash v1.0.4 // indirect
+	github.com/nats-io/jwt/v2 v2.8.2 // indirect
+	github.com/nats-io/nkeys v0.4.16 // indirect
+	golang.org/x/crypto v0.57.0 // indirect
+	golang.org/x/sys v0.48.0 // indirect
+	golang.org/x/time v0.16.0 // indirect
 )
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUnaryGRPC(t *testing.T) {
+	// a length-prefixed gRPC message with bytes that aren't valid UTF-8
+	request := []byte{0, 0, 0, 0, 4, 0x0a, 0x02, 0xff, 0xfe}
+	reply := []byte{0, 0, 0, 0, 3, 0x12, 0x01, 0x80}
+	grpc := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Content-Type") != "application/grpc" || !bytes.Equal(body, request) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Write(reply)
+		w.Header().Set("Grpc-Status", "3")
+		w.Header().Set("Grpc-Message", "invalid argument")
+	})
+
+	nc := runNATS(t)
+	serveHandler(t, nc, "handler", grpc)
+	u := serveUpstream(t, nc, "upstream", grpc)
+	for _, subject := range []string{"handler", "upstream"} {
+		t.Run(subject, func(t *testing.T) {
+			tr := NewNATSHTTPTransport(nc, subject, "", 5*time.Second)
+			req := upstreamRequest("POST", u, "/echo.Echo/Say", bytes.NewReader(request))
+			req.Header.Set("Content-Type", "application/grpc")
+			req.Header.Set("Te", "trailers")
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/grpc" || !bytes.Equal(body, reply) {
+				t.Fatalf("got %d %v %x", resp.StatusCode, resp.Header, body)
+			}
+			if resp.Trailer.Get("Grpc-Status") != "3" || resp.Trailer.Get("Grpc-Message") != "invalid argument" {
+				t.Fatalf("got trailer %v", resp.Trailer)
+			}
+			if resp.Header.Get("Grpc-Status") != "" {
+				t.Fatalf("trailer sent as a header: %v", resp.Header)
+			}
+		})
+	}
+}
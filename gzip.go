@@ -0,0 +1,84 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// WithClientCompression makes the server gzip uncompressed 200 responses
+// for requests whose Accept-Encoding allows gzip, setting Content-Encoding
+// so the final client decompresses them. This is independent of NATS-hop
+// compression, and the transport's own transparent gzip handling makes use
+// of it too. Streamed responses and bodies that don't shrink are sent as
+// they are.
+func WithClientCompression() ServerOption {
+	return func(s *Server) {
+		s.clientCompression = true
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.TrimSpace(coding)
+		if !strings.EqualFold(coding, "gzip") && coding != "*" {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "q") {
+				if q, err := strconv.ParseFloat(value, 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compressForClient gzips body and adjusts header when that is allowed and
+// pays off.
+func compressForClient(req *NATSHTTPRequest, status int, header map[string]string, body []byte) []byte {
+	if status != http.StatusOK || len(body) == 0 || header["Content-Encoding"] != "" ||
+		req.Method == http.MethodHead || !acceptsGzip(req.Header["Accept-Encoding"]) {
+		return body
+	}
+	compressed, err := hopCompress(HopCodecGzip, body)
+	if err != nil || len(compressed) >= len(body) {
+		return body
+	}
+	header["Content-Encoding"] = "gzip"
+	header["Content-Length"] = strconv.Itoa(len(compressed))
+	header["Vary"] = joinHeader(header["Vary"], "Accept-Encoding")
+	return compressed
+}
+
+// gzipReader lazily decompresses a response body on the first Read, the same
+// way net/http's transport does, so a broken gzip stream surfaces as a read
+// error rather than failing the round trip.
+type gzipReader struct {
+	body io.ReadCloser
+	zr   *gzip.Reader
+	zerr error
+}
+
+func (gz *gzipReader) Read(p []byte) (int, error) {
+	if gz.zr == nil {
+		if gz.zerr == nil {
+			gz.zr, gz.zerr = gzip.NewReader(gz.body)
+		}
+		if gz.zerr != nil {
+			return 0, gz.zerr
+		}
+	}
+	return gz.zr.Read(p)
+}
+
+func (gz *gzipReader) Close() error {
+	return gz.body.Close()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestClientCompression(t *testing.T) {
+	nc := runNATS(t)
+	text := strings.Repeat("compress me, ", 200)
+	tr := serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, text)
+	}), WithClientCompression())
+
+	// a client asking for gzip gets a gzipped body it can decompress
+	req, _ := http.NewRequest("GET", "http://svc/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" || resp.Header.Get("Vary") != "Accept-Encoding" || len(compressed) >= len(text) {
+		t.Fatalf("got %d bytes with header %v", len(compressed), resp.Header)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := io.ReadAll(zr); err != nil || string(plain) != text {
+		t.Fatalf("decompressed %d bytes: %v", len(plain), err)
+	}
+
+	// the transport asks for gzip on behalf of clients that don't and
+	// decompresses it for them
+	req, _ = http.NewRequest("GET", "http://svc/", nil)
+	resp, err = tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != text || !resp.Uncompressed || resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("got %d bytes, uncompressed %v, header %v", len(body), resp.Uncompressed, resp.Header)
+	}
+
+	// clients refusing gzip get the body as it is
+	req, _ = http.NewRequest("GET", "http://svc/", nil)
+	req.Header.Set("Accept-Encoding", "gzip;q=0, identity")
+	resp, err = tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != text || resp.Uncompressed || resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("got %d bytes, uncompressed %v, header %v", len(body), resp.Uncompressed, resp.Header)
+	}
+}
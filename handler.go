@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// WithHandler makes the server answer requests with h in-process instead of
+// proxying them to an upstream over the network. The host allowlist does not
+// apply since nothing leaves the process.
+func WithHandler(h http.Handler) ServerOption {
+	return func(s *Server) {
+		s.cfg.Handler = h
+	}
+}
+
+// ListenAndServe serves handler on subject until nc is closed, which is the
+// NATS counterpart of http.ListenAndServe. Like it, it always returns a
+// non-nil error: nats.ErrConnectionClosed after a regular shutdown. Use
+// nc.Drain to stop gracefully; messages already received are handled before
+// the connection closes.
+func ListenAndServe(nc *nats.Conn, subject string, handler http.Handler, opts ...ServerOption) error {
+	closed := nc.StatusChanged(nats.CLOSED)
+	s := NewServer(nc, subject, append([]ServerOption{WithHandler(handler)}, opts...)...)
+	if err := s.Start(); err != nil {
+		return err
+	}
+	s.logger.Info("serving http over nats", "subject", subject)
+	<-closed
+	s.logger.Info("nats connection closed", "subject", subject)
+	return nats.ErrConnectionClosed
+}
+
+// handlerTransport is an http.RoundTripper that calls an http.Handler.
+type handlerTransport struct {
+	h http.Handler
+}
+
+var _ RoundTripper = handlerTransport{}
+
+func (ht handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := &responseRecorder{header: http.Header{}}
+	if req.Body == nil {
+		req.Body = http.NoBody
+	}
+	ht.h.ServeHTTP(rec, req)
+	return rec.result(req), nil
+}
+
+// responseRecorder is a small httptest.ResponseRecorder.
+type responseRecorder struct {
+	header      http.Header
+	status      int
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func (rr *responseRecorder) Header() http.Header {
+	return rr.header
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.wroteHeader {
+		return
+	}
+	rr.status = status
+	rr.wroteHeader = true
+}
+
+func (rr *responseRecorder) Write(p []byte) (int, error) {
+	rr.WriteHeader(http.StatusOK)
+	return rr.body.Write(p)
+}
+
+func (rr *responseRecorder) result(req *http.Request) *http.Response {
+	if !rr.wroteHeader {
+		rr.WriteHeader(http.StatusOK)
+	}
+	header := rr.header.Clone()
+	// like http.ResponseWriter, trailers are declared in the Trailer header
+	// or set with the http.TrailerPrefix
+	var trailer http.Header
+	for _, declared := range header.Values("Trailer") {
+		for _, key := range strings.Split(declared, ",") {
+			key = http.CanonicalHeaderKey(strings.TrimSpace(key))
+			if values, ok := header[key]; ok {
+				if trailer == nil {
+					trailer = http.Header{}
+				}
+				trailer[key] = values
+				delete(header, key)
+			}
+		}
+	}
+	header.Del("Trailer")
+	for key, values := range header {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			if trailer == nil {
+				trailer = http.Header{}
+			}
+			trailer[http.CanonicalHeaderKey(strings.TrimPrefix(key, http.TrailerPrefix))] = values
+			delete(header, key)
+		}
+	}
+	header.Set("Content-Length", strconv.Itoa(rr.body.Len()))
+	return &http.Response{
+		Status:        strconv.Itoa(rr.status) + " " + http.StatusText(rr.status),
+		StatusCode:    rr.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(rr.body.Bytes())),
+		ContentLength: int64(rr.body.Len()),
+		Trailer:       trailer,
+		Request:       req,
+	}
+}
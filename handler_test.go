@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func ExampleListenAndServe() {
+	ns, _ := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	go ns.Start()
+	defer ns.Shutdown()
+	ns.ReadyForConnections(5 * time.Second)
+
+	serverConn, _ := nats.Connect(ns.ClientURL())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello, %s", r.URL.Query().Get("name"))
+	})
+	done := make(chan error)
+	go func() { done <- ListenAndServe(serverConn, "greeter", mux) }()
+
+	clientConn, _ := nats.Connect(ns.ClientURL())
+	defer clientConn.Close()
+	client := &http.Client{Transport: NewNATSHTTPTransport(clientConn, "greeter", "", 5*time.Second)}
+	var resp *http.Response
+	var err error
+	for range 50 { // until the subscription is up
+		if resp, err = client.Get("http://greeter/hello?name=nats"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	fmt.Println(resp.StatusCode, string(body))
+
+	serverConn.Drain()
+	fmt.Println(<-done)
+	// Output:
+	// 200 hello, nats
+	// nats: connection closed
+}
+
+func TestListenAndServeDrain(t *testing.T) {
+	nc := runNATS(t)
+	snc, err := nats.Connect(nc.ConnectedUrl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snc.Close()
+	entered, release := make(chan struct{}), make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+		io.WriteString(w, "finished")
+	})
+	done := make(chan error, 1)
+	go func() { done <- ListenAndServe(snc, "drain", h) }()
+
+	tr := NewNATSHTTPTransport(nc, "drain", "", 5*time.Second)
+	type result struct {
+		body string
+		err  error
+	}
+	res := make(chan result, 1)
+	go func() {
+		for {
+			req, _ := http.NewRequest("GET", "http://drain/", nil)
+			resp, err := tr.RoundTrip(req)
+			if errors.Is(err, nats.ErrNoResponders) {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			if err != nil {
+				res <- result{err: err}
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			res <- result{body: string(body)}
+			return
+		}
+	}()
+
+	<-entered
+	snc.Drain()
+	select {
+	case err := <-done:
+		t.Fatalf("returned before the request in flight was answered: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if r := <-res; r.err != nil || r.body != "finished" {
+		t.Fatalf("got %q, %v", r.body, r.err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, nats.ErrConnectionClosed) {
+			t.Fatalf("got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe didn't return after drain")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// WithHedging sends another copy of an idempotent request (GET, HEAD,
+// OPTIONS, TRACE, PUT and DELETE) whenever no reply arrived within delay,
+// up to maxHedges extra copies, and takes the first reply. Each copy waits
+// on its own inbox and the others are abandoned once one is answered.
+// Servers don't know about hedging, so they may perform the request more
+// than once; only use it where that is harmless. Streamed and informational
+// requests are not hedged.
+func WithHedging(delay time.Duration, maxHedges int) Option {
+	return func(t *NATSHTTPTransport) {
+		t.hedging = &hedging{delay: delay, max: maxHedges}
+	}
+}
+
+type hedging struct {
+	delay time.Duration
+	max   int
+}
+
+func hedgeable(method string) bool {
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// hedgedRequest is request, sending copies of msg as WithHedging says. It
+// fails when every copy sent has failed.
+func (t *NATSHTTPTransport) hedgedRequest(ctx context.Context, newMsg func() *nats.Msg) (*nats.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		msg *nats.Msg
+		err error
+	}
+	results := make(chan result, t.hedging.max+1)
+	send := func() {
+		go func() {
+			msg, err := t.request(ctx, newMsg())
+			results <- result{msg, err}
+		}()
+	}
+	send()
+	sent, failed := 1, 0
+	timer := t.clock.NewTimer(t.hedging.delay)
+	defer timer.Stop()
+	for {
+		select {
+		case r := <-results:
+			if r.err == nil {
+				return r.msg, nil
+			}
+			if failed++; failed == sent {
+				return nil, r.err
+			}
+		case <-timer.C():
+			if sent <= t.hedging.max {
+				send()
+				sent++
+				timer.Reset(t.hedging.delay)
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHedging(t *testing.T) {
+	nc := runNATS(t)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	defer close(release)
+	// the first request of each pair is stuck, the second answers
+	serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1)%2 == 1 {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			io.WriteString(w, "slow")
+			return
+		}
+		io.WriteString(w, "hedge")
+	}), WithMaxConcurrency(4))
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithHedging(50*time.Millisecond, 1))
+
+	req, _ := http.NewRequest("GET", "http://svc/", nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hedge" || calls.Load() != 2 {
+		t.Fatalf("got %q after %d calls, want the hedge's reply", body, calls.Load())
+	}
+	// the abandoned copy still runs on the server
+	release <- struct{}{}
+
+	// requests that aren't idempotent wait for their only copy
+	calls.Store(0)
+	req, _ = http.NewRequest("POST", "http://svc/", nil)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := tr.RoundTrip(req)
+		errc <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("POST sent %d times", n)
+	}
+	release <- struct{}{}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
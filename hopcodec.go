@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// NATS-hop compression shrinks response bodies between server and client
+// only; it has nothing to do with Content-Encoding towards the final client.
+// The client lists the codecs it can decode in AcceptEncodings, the server
+// picks the first of its own codecs the client also knows, compresses the
+// body with it and names it in the response's Encoding field. Without a
+// common codec the body goes uncompressed, and so do bodies below the
+// compression threshold, those compression would not make smaller, and
+// streamed bodies.
+const (
+	HopCodecGzip = "gzip"
+	HopCodecZstd = "zstd"
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+)
+
+// WithHopCodecs advertises the codecs the transport accepts for NATS-hop
+// compressed responses, in order of preference.
+func WithHopCodecs(codecs ...string) Option {
+	return func(t *NATSHTTPTransport) {
+		t.hopCodecs = codecs
+	}
+}
+
+// WithServerHopCompression compresses response bodies on the NATS hop with
+// the first of codecs the client accepts.
+func WithServerHopCompression(codecs ...string) ServerOption {
+	return func(s *Server) {
+		s.cfg.HopCodecs = codecs
+	}
+}
+
+// DefaultCompressionThreshold is the body size below which NATS-hop
+// compression is skipped unless WithCompressionThreshold says otherwise.
+const DefaultCompressionThreshold = 1024
+
+// WithCompressionThreshold sends bodies smaller than n bytes uncompressed
+// even with WithServerHopCompression, as compressing them costs more CPU
+// than it saves bandwidth. A threshold of zero or less compresses every
+// non-empty body.
+func WithCompressionThreshold(n int) ServerOption {
+	return func(s *Server) {
+		// in Config, zero is the default and -1 compresses everything
+		if n <= 0 {
+			n = -1
+		}
+		s.cfg.CompressionThreshold = n
+	}
+}
+
+// negotiateHopCodec returns the first server codec the client accepts, or
+// "" when there is none.
+func negotiateHopCodec(server, client []string) string {
+	for _, codec := range server {
+		if slices.Contains(client, codec) {
+			return codec
+		}
+	}
+	return ""
+}
+
+func hopCompress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case HopCodecGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case HopCodecZstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("nats-http: unknown hop codec %q", codec)
+	}
+}
+
+// DecompressionError is returned when a NATS-hop compressed body can't be
+// decompressed, e.g. because it is corrupt or not compressed at all.
+type DecompressionError struct {
+	Codec string
+	Err   error
+}
+
+func (e *DecompressionError) Error() string {
+	return fmt.Sprintf("nats-http: decompressing %s body: %v", e.Codec, e.Err)
+}
+
+func (e *DecompressionError) Unwrap() error {
+	return e.Err
+}
+
+// WithHopDecodeFallback makes the transport use a body as it is when it
+// can't be decompressed with the codec it is labelled with, instead of
+// failing with a DecompressionError. Useful while a fleet with mixed
+// versions mislabels plain bodies.
+func WithHopDecodeFallback() Option {
+	return func(t *NATSHTTPTransport) {
+		t.hopDecodeFallback = true
+	}
+}
+
+// DefaultMaxDecompressedSize bounds what a NATS-hop compressed body may
+// expand to unless WithMaxDecompressedSize says otherwise.
+const DefaultMaxDecompressedSize = 64 << 20
+
+// ErrDecompressedTooLarge is wrapped in the DecompressionError for a body
+// that expands past the limit, e.g. a decompression bomb.
+var ErrDecompressedTooLarge = errors.New("decompressed body exceeds the maximum size")
+
+// WithMaxDecompressedSize limits NATS-hop compressed response bodies to n
+// bytes once decompressed. Larger ones fail with a DecompressionError, also
+// with WithHopDecodeFallback.
+func WithMaxDecompressedSize(n int64) Option {
+	return func(t *NATSHTTPTransport) {
+		t.maxDecompressedSize = n
+	}
+}
+
+// hopDecompress never panics; whatever goes wrong, including a misbehaving
+// decoder, comes back as a *DecompressionError. It reads at most limit
+// bytes, failing with ErrDecompressedTooLarge past that.
+func hopDecompress(codec string, data []byte, limit int64) (out []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			out, err = nil, &DecompressionError{Codec: codec, Err: fmt.Errorf("panic: %v", r)}
+		}
+	}()
+	var r io.Reader
+	switch codec {
+	case HopCodecGzip:
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	case HopCodecZstd:
+		var zr *zstd.Decoder
+		if zr, err = zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1)); err == nil {
+			defer zr.Close()
+			r = zr
+		}
+	default:
+		err = fmt.Errorf("unknown codec")
+	}
+	if err == nil {
+		if out, err = io.ReadAll(io.LimitReader(r, limit+1)); err == nil && int64(len(out)) > limit {
+			err = ErrDecompressedTooLarge
+		}
+	}
+	if err != nil {
+		return nil, &DecompressionError{Codec: codec, Err: err}
+	}
+	return out, nil
+}
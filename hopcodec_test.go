@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestHopDecompressLimit(t *testing.T) {
+	bomb := make([]byte, 1<<20)
+	for _, codec := range []string{HopCodecGzip, HopCodecZstd} {
+		t.Run(codec, func(t *testing.T) {
+			compressed, err := hopCompress(codec, bomb)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply := func() *nats.Msg {
+				data, _ := json.Marshal(NATSHTTPResponse{StatusCode: 200, Body: compressed, Encoding: codec})
+				return &nats.Msg{Data: data}
+			}
+
+			tr := NewNATSHTTPTransport(nil, "svc", "", time.Second)
+			resp, err := tr.decodeReply(reply())
+			if err != nil || !bytes.Equal(resp.Body, bomb) {
+				t.Fatalf("within the default limit: %v", err)
+			}
+
+			for _, opts := range [][]Option{
+				{WithMaxDecompressedSize(64 << 10)},
+				{WithMaxDecompressedSize(64 << 10), WithHopDecodeFallback()},
+			} {
+				tr := NewNATSHTTPTransport(nil, "svc", "", time.Second, opts...)
+				_, err := tr.decodeReply(reply())
+				var de *DecompressionError
+				if !errors.As(err, &de) || !errors.Is(err, ErrDecompressedTooLarge) {
+					t.Fatalf("got %v", err)
+				}
+			}
+
+			if out, err := hopDecompress(codec, compressed, int64(len(bomb))); err != nil || len(out) != len(bomb) {
+				t.Fatalf("exactly at the limit: %d bytes, %v", len(out), err)
+			}
+		})
+	}
+}
+
+func TestHopDecodeMislabelled(t *testing.T) {
+	nc := runNATS(t)
+	// a responder from a fleet that labels plain bodies gzip
+	plain := []byte("not compressed at all")
+	nc.Subscribe("svc", func(msg *nats.Msg) {
+		data, _ := json.Marshal(NATSHTTPResponse{StatusCode: 200, Body: plain, Encoding: HopCodecGzip})
+		msg.Respond(data)
+	})
+
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithHopCodecs(HopCodecGzip))
+	req, _ := http.NewRequest("GET", "http://svc/", nil)
+	_, err := tr.RoundTrip(req)
+	var de *DecompressionError
+	if !errors.As(err, &de) || de.Codec != HopCodecGzip {
+		t.Fatalf("got %v, want a DecompressionError", err)
+	}
+
+	tr = NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithHopCodecs(HopCodecGzip), WithHopDecodeFallback())
+	req, _ = http.NewRequest("GET", "http://svc/", nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(body, plain) {
+		t.Fatalf("fallback got %q, want %q", body, plain)
+	}
+}
+
+// BenchmarkHopCompressionThreshold compares compressing every body with
+// skipping those below DefaultCompressionThreshold.
+func BenchmarkHopCompressionThreshold(b *testing.B) {
+	for _, size := range []int{100, 512, 4 << 10, 64 << 10} {
+		body := bytes.Repeat([]byte(`{"id":12345,"name":"widget"},`), size/29+1)[:size]
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(body)
+		})
+		for _, threshold := range []int{0, DefaultCompressionThreshold} {
+			b.Run(fmt.Sprintf("size=%d/threshold=%d", size, threshold), func(b *testing.B) {
+				nc := runNATS(b)
+				serveHandler(b, nc, "svc", h, WithServerHopCompression(HopCodecGzip), WithCompressionThreshold(threshold))
+				tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithHopCodecs(HopCodecGzip))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for range b.N {
+					req, _ := http.NewRequest("GET", "http://svc/", nil)
+					resp, err := tr.RoundTrip(req)
+					if err != nil {
+						b.Fatal(err)
+					}
+					resp.Body.Close()
+				}
+			})
+		}
+	}
+}
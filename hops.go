@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// DefaultMaxHops is how many servers a request may pass through when
+// servers forward to each other, unless WithMaxHops says otherwise.
+const DefaultMaxHops = 10
+
+type hopsKey struct{}
+
+// WithMaxHops limits how many servers a request may pass through. Servers
+// that forward over NATS, through a transport used as upstream transport or
+// by a handler, carry the count along in the request context and the
+// transport puts it into Hops. A server getting a request that already
+// passed n servers answers 508 Loop Detected, which stops a
+// misconfigured loop of servers after n hops. Zero keeps DefaultMaxHops.
+func WithMaxHops(n int) ServerOption {
+	return func(s *Server) {
+		s.cfg.MaxHops = n
+	}
+}
+
+// hopsFrom returns the number of servers the request with ctx passed
+// through.
+func hopsFrom(ctx context.Context) int {
+	hops, _ := ctx.Value(hopsKey{}).(int)
+	return hops
+}
+
+// checkHops rejects requests over the hop limit and otherwise counts this
+// server in req's context.
+func (s *Server) checkHops(req *http.Request, natsReq *NATSHTTPRequest) (*http.Request, bool) {
+	if natsReq.Hops >= s.cfg.MaxHops {
+		return nil, false
+	}
+	return req.WithContext(context.WithValue(req.Context(), hopsKey{}, natsReq.Hops+1)), true
+}
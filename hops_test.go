@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHopLimitStopsLoop(t *testing.T) {
+	nc := runNATS(t)
+	var calls atomic.Int32
+	// forward passes requests on to the server on subject and answers with
+	// whatever status comes back.
+	forward := func(subject string) http.Handler {
+		tr := NewNATSHTTPTransport(nc, subject, "", 5*time.Second)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			req, _ := http.NewRequestWithContext(r.Context(), r.Method, "http://svc/", nil)
+			resp, err := tr.RoundTrip(req)
+			var serr *ServerError
+			if errors.As(err, &serr) {
+				http.Error(w, serr.Message, serr.StatusCode)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			resp.Body.Close()
+			w.WriteHeader(resp.StatusCode)
+		})
+	}
+	serveHandler(t, nc, "loop.a", forward("loop.b"), WithMaxHops(4), WithMaxConcurrency(4))
+	tr := serveHandler(t, nc, "loop.b", forward("loop.a"), WithMaxHops(4), WithMaxConcurrency(4))
+
+	req, _ := http.NewRequest("GET", "http://svc/", nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusLoopDetected {
+		t.Fatalf("status %d, want 508", resp.StatusCode)
+	}
+	if n := calls.Load(); n != 4 {
+		t.Fatalf("request passed %d servers, want 4", n)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// WithInboxPrefix makes the transport receive replies on subjects below
+// prefix instead of the connection's inbox prefix (usually "_INBOX"). Use it
+// when account permissions only allow subscribing to a tenant specific
+// namespace. Setting nats.CustomInboxPrefix on the connection has the same
+// effect for every request made through that connection. If prefix is not
+// a valid literal subject, every request fails with the error.
+func WithInboxPrefix(prefix string) Option {
+	return func(t *NATSHTTPTransport) {
+		if err := validateInboxPrefix(prefix); err != nil {
+			t.configErr = errors.Join(t.configErr, fmt.Errorf("nats-http: %w", err))
+			return
+		}
+		t.inboxPrefix = prefix
+	}
+}
+
+func validateInboxPrefix(prefix string) error {
+	if prefix == "" {
+		return fmt.Errorf("inbox prefix is empty")
+	}
+	if strings.ContainsAny(prefix, " \t\r\n*>") {
+		return fmt.Errorf("inbox prefix %q contains whitespace or wildcards", prefix)
+	}
+	for _, token := range strings.Split(prefix, ".") {
+		if token == "" {
+			return fmt.Errorf("inbox prefix %q contains an empty token", prefix)
+		}
+	}
+	return nil
+}
+
+// newInbox returns a fresh reply subject under the configured prefix, or the
+// connection's own inbox prefix when there is none.
+func (t *NATSHTTPTransport) newInbox() string {
+	if t.inboxPrefix == "" {
+		return t.nc.NewInbox()
+	}
+	return t.inboxPrefix + "." + nuid.Next()
+}
+
+// request sends msg and waits for a single reply, using a private inbox
+// under the configured prefix when there is one. It gives up when ctx is
+// done or after the transport timeout, which is reported as nats.ErrTimeout.
+func (t *NATSHTTPTransport) request(ctx context.Context, msg *nats.Msg) (*nats.Msg, error) {
+	tctx, cancel := withTimeout(ctx, t.clock, t.Timeout())
+	defer cancel()
+	var reply *nats.Msg
+	var err error
+	if t.inboxPrefix == "" {
+		reply, err = t.nc.RequestMsgWithContext(tctx, msg)
+	} else {
+		reply, err = requestOnInbox(tctx, t.nc, t.newInbox(), msg)
+	}
+	if err != nil && ctx.Err() == nil && errors.Is(context.Cause(tctx), context.DeadlineExceeded) {
+		return nil, nats.ErrTimeout
+	}
+	return reply, err
+}
+
+func requestOnInbox(ctx context.Context, nc *nats.Conn, inbox string, req *nats.Msg) (*nats.Msg, error) {
+	sub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+	req.Reply = inbox
+	if err := nc.PublishMsg(req); err != nil {
+		return nil, err
+	}
+	msg, err := sub.NextMsgWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// the server answers with an empty 503 status message when nobody is
+	// subscribed, the same check nc.Request does for us
+	if len(msg.Data) == 0 && msg.Header.Get("Status") == "503" {
+		return nil, nats.ErrNoResponders
+	}
+	return msg, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestInboxPrefix(t *testing.T) {
+	nc := runNATS(t)
+	replies := make(chan string, 1)
+	nc.Subscribe("svc", func(msg *nats.Msg) {
+		replies <- msg.Reply
+		data, _ := json.Marshal(NATSHTTPResponse{StatusCode: http.StatusOK})
+		msg.Respond(data)
+	})
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithInboxPrefix("_TENANT.inbox"))
+	req, _ := http.NewRequest("GET", "http://svc/", nil)
+	if _, err := tr.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	if reply := <-replies; !strings.HasPrefix(reply, "_TENANT.inbox.") {
+		t.Fatalf("reply subject %q", reply)
+	}
+
+	// an invalid prefix fails the requests instead of the constructor
+	for _, prefix := range []string{"", "_TENANT.*", "_TENANT..inbox", "has space"} {
+		tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithInboxPrefix(prefix))
+		req, _ := http.NewRequest("GET", "http://svc/", nil)
+		if _, err := tr.RoundTrip(req); err == nil || !strings.Contains(err.Error(), "inbox prefix") {
+			t.Errorf("%q: RoundTrip got %v", prefix, err)
+		}
+		if _, err := tr.Broadcast(context.Background(), req); err == nil {
+			t.Errorf("%q: Broadcast succeeded", prefix)
+		}
+		if err := tr.Notify(context.Background(), req); err == nil {
+			t.Errorf("%q: Notify succeeded", prefix)
+		}
+	}
+	select {
+	case reply := <-replies:
+		t.Fatalf("a request with an invalid prefix was sent, replying to %q", reply)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
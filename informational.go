@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Informational responses such as 103 Early Hints are sent ahead of the
+// final response as separate messages marked Nats-Http-Kind: informational,
+// each an envelope with only a status code and headers. Clients ask for them
+// by setting Informational, which the transport does when the request
+// context carries an httptrace.ClientTrace with Got1xxResponse set. That
+// callback is the only way they are surfaced; without it the transport sends
+// a plain request and the server does not forward them.
+//
+// Only responses from an upstream HTTP server are forwarded, not 1xx
+// written by an in-process handler (WithHandler).
+
+// WithInformationalResponses makes the server forward 1xx responses from the
+// upstream to clients that ask for them.
+func WithInformationalResponses() ServerOption {
+	return func(s *Server) {
+		s.informational = true
+	}
+}
+
+// got1xx returns the Got1xxResponse callback from ctx, if any.
+func got1xx(ctx context.Context) func(int, textproto.MIMEHeader) error {
+	if trace := httptrace.ContextClientTrace(ctx); trace != nil {
+		return trace.Got1xxResponse
+	}
+	return nil
+}
+
+// nextFinalReply is nextReply that hands informational responses to
+// onInformational, skips keepalives and returns the first other message.
+// It gives up at until on clock, unless that is zero.
+func nextFinalReply(ctx context.Context, sub *nats.Subscription, clock Clock, timeout time.Duration, until time.Time, onInformational func(int, textproto.MIMEHeader) error) (*nats.Msg, error) {
+	for {
+		wait := timeout
+		if !until.IsZero() {
+			wait = min(wait, until.Sub(clock.Now()))
+			if wait <= 0 {
+				return nil, nats.ErrTimeout
+			}
+		}
+		msg, err := nextReply(ctx, sub, wait)
+		if err == nil && msg.Header.Get(HeaderStreamKind) == "keepalive" {
+			continue
+		}
+		if err != nil || msg.Header.Get(HeaderStreamKind) != "informational" {
+			return msg, err
+		}
+		if onInformational == nil {
+			continue
+		}
+		var info NATSHTTPResponse
+		if err := json.Unmarshal(msg.Data, &info); err != nil {
+			return nil, err
+		}
+		header := make(textproto.MIMEHeader, len(info.Header))
+		for key, value := range info.Header {
+			header.Set(key, value)
+		}
+		if err := onInformational(info.StatusCode, header); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// withInformational arranges for 1xx responses to the upstream request to
+// be published to reply.
+func (s *Server) withInformational(ctx context.Context, reply string) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, h textproto.MIMEHeader) error {
+			header := make(map[string]string, len(h))
+			for key, values := range h {
+				// early hints usually come as several Link headers, which
+				// can be folded into one
+				header[key] = strings.Join(values, ", ")
+			}
+			data, err := json.Marshal(NATSHTTPResponse{StatusCode: code, Header: header})
+			if err != nil {
+				return err
+			}
+			msg := nats.NewMsg(reply)
+			msg.Header.Set(HeaderStreamKind, "informational")
+			msg.Data = data
+			return s.nc.PublishMsg(msg)
+		},
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestEarlyHints(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Link", "</style.css>; rel=preload; as=style")
+		w.Header().Add("Link", "</app.js>; rel=preload; as=script")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		io.WriteString(w, "page")
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	nc := runNATS(t)
+	s := NewServer(nc, "svc", WithAllowedHosts(u.Host), WithInformationalResponses())
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	nc.Flush()
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second)
+
+	type hint struct {
+		code int
+		link string
+	}
+	var hints []hint
+	trace := &httptrace.ClientTrace{Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+		hints = append(hints, hint{code, header.Get("Link")})
+		return nil
+	}}
+	req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(t.Context(), trace), "GET", upstream.URL, nil)
+	req.Header.Set("Host", u.Host)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "page" {
+		t.Fatalf("got %d %q", resp.StatusCode, body)
+	}
+	want := hint{http.StatusEarlyHints, "</style.css>; rel=preload; as=style, </app.js>; rel=preload; as=script"}
+	if len(hints) != 1 || hints[0] != want {
+		t.Fatalf("got hints %v", hints)
+	}
+
+	// without the callback the request is plain and the hints are dropped
+	req, _ = http.NewRequest("GET", upstream.URL, nil)
+	req.Header.Set("Host", u.Host)
+	if resp, err = tr.RoundTrip(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %v, %v", resp, err)
+	}
+}
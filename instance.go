@@ -0,0 +1,12 @@
+package main
+
+// WithInstanceID stamps id into every reply of the server, proxied responses
+// and error envelopes alike, so a request answered by one member of a queue
+// group can be traced to it. Transports with WithDebugHeaders add it to the
+// response as X-NATS-Instance; for error envelopes it is in
+// ServerError.Instance. The hostname or pod name is the usual choice.
+func WithInstanceID(id string) ServerOption {
+	return func(s *Server) {
+		s.instanceID = id
+	}
+}
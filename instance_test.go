@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestInstanceID(t *testing.T) {
+	nc := runNATS(t)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hi")
+	})
+	serveHandler(t, nc, "svc", h, WithQueueGroup("fleet"), WithInstanceID("a"))
+	serveHandler(t, nc, "svc", h, WithQueueGroup("fleet"), WithInstanceID("b"))
+
+	debug := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithDebugHeaders())
+	seen := map[string]int{}
+	for range 50 {
+		req, _ := http.NewRequest("GET", "http://svc/", nil)
+		resp, err := debug.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		seen[resp.Header.Get(HeaderNATSInstance)]++
+	}
+	if len(seen) != 2 || seen["a"] == 0 || seen["b"] == 0 {
+		t.Fatalf("instances seen: %v", seen)
+	}
+
+	// without debug headers the ID stays out of the response
+	req, _ := http.NewRequest("GET", "http://svc/", nil)
+	resp, err := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if id := resp.Header.Get(HeaderNATSInstance); id != "" {
+		t.Fatalf("got %s %q without debug headers", HeaderNATSInstance, id)
+	}
+
+	// error envelopes carry it too
+	s := NewServer(nc, "proxy", WithAllowedHosts("example.com"), WithInstanceID("c"))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	nc.Flush()
+	req, _ = http.NewRequest("GET", "http://example.org/", nil)
+	req.Header.Set("Host", "example.org")
+	_, err = NewNATSHTTPTransport(nc, "proxy", "", 5*time.Second).RoundTrip(req)
+	var se *ServerError
+	if !errors.As(err, &se) || se.Instance != "c" {
+		t.Fatalf("got %v, want an error from instance c", err)
+	}
+}
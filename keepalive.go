@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Keepalives let a request run longer than the transport timeout as long as
+// the server is still working on it. A transport with WithKeepalive marks
+// its requests with Keepalive, and a server with WithServerKeepalive then
+// publishes a message marked Nats-Http-Kind: keepalive on the reply subject
+// every interval until the response is ready. Each one restarts the
+// transport's timeout, up to the transport's maximum.
+
+// WithKeepalive lets requests take up to max in total while the server
+// sends keepalives. The transport timeout then bounds the silence between
+// two messages from the server instead of the whole request, so it has to
+// be longer than the server's keepalive interval.
+func WithKeepalive(max time.Duration) Option {
+	return func(t *NATSHTTPTransport) {
+		t.keepaliveMax = max
+	}
+}
+
+// WithServerKeepalive makes the server send a keepalive every interval to
+// clients that ask for it, from receiving a request until the response is
+// ready to be sent.
+func WithServerKeepalive(interval time.Duration) ServerOption {
+	return func(s *Server) {
+		s.keepalive = interval
+	}
+}
+
+// startKeepalive publishes keepalives to reply until the returned function
+// is called, which may be called more than once. Once it returned no more
+// keepalives are sent, so replies that follow can't be mixed up with them.
+func (s *Server) startKeepalive(reply string) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		timer := s.clock.NewTimer(s.keepalive)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C():
+				msg := nats.NewMsg(reply)
+				msg.Header.Set(HeaderStreamKind, "keepalive")
+				s.nc.PublishMsg(msg)
+				timer.Reset(s.keepalive)
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestKeepalive(t *testing.T) {
+	nc := runNATS(t)
+	clock := newFakeClock()
+	release := make(chan struct{})
+	defer close(release)
+	serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+			io.WriteString(w, "done")
+		case <-r.Context().Done():
+		}
+	}), WithServerClock(clock), WithServerKeepalive(time.Second))
+	// the timeout is real time between two messages, the maximum is on
+	// the clock
+	tr := NewNATSHTTPTransport(nc, "svc", "", 300*time.Millisecond, WithClock(clock), WithKeepalive(10*time.Second))
+	do := func() (chan *http.Response, chan error) {
+		respc, errc := make(chan *http.Response, 1), make(chan error, 1)
+		go func() {
+			req, _ := http.NewRequest("GET", "http://svc/", nil)
+			resp, err := tr.RoundTrip(req)
+			respc <- resp
+			errc <- err
+		}()
+		return respc, errc
+	}
+	// keepalive has the server send n keepalives, one a second on the clock
+	// and each after half the timeout in real time
+	keepalive := func(n int) {
+		for range n {
+			clock.waitFor(t, 1)
+			time.Sleep(150 * time.Millisecond)
+			clock.advance(time.Second)
+		}
+	}
+
+	// well past the timeout, but kept alive
+	respc, errc := do()
+	keepalive(5)
+	release <- struct{}{}
+	resp, err := <-respc, <-errc
+	if err != nil {
+		t.Fatalf("failed despite keepalives: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "done" {
+		t.Fatalf("got %q", body)
+	}
+
+	// without keepalives the timeout applies, on the clock
+	tr = NewNATSHTTPTransport(nc, "svc", "", time.Second, WithClock(clock))
+	_, errc = do()
+	clock.waitFor(t, 1)
+	clock.advance(time.Second)
+	if err := <-errc; !errors.Is(err, nats.ErrTimeout) {
+		t.Fatalf("got %v without keepalives", err)
+	}
+	release <- struct{}{}
+
+	// and keepalives don't extend a request past the maximum
+	tr = NewNATSHTTPTransport(nc, "svc", "", 300*time.Millisecond, WithClock(clock), WithKeepalive(10*time.Second))
+	_, errc = do()
+	keepalive(9)
+	select {
+	case err := <-errc:
+		t.Fatalf("gave up before the maximum: %v", err)
+	default:
+	}
+	keepalive(2)
+	if err := <-errc; !errors.Is(err, nats.ErrTimeout) {
+		t.Fatalf("got %v past the maximum", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ErrNoLocalReply is returned by RoundTripLocal when the server sent no
+// reply, e.g. for a request it could not decode with
+// WithDecodeErrors(ErrorDrop).
+var ErrNoLocalReply = errors.New("nats-http: no reply")
+
+// localReply is the reply subject of requests made by RoundTripLocal.
+const localReply = "_LOCAL.reply"
+
+// RoundTripLocal performs req against handler in memory, through the same
+// encoding and decoding as RoundTrip without NATS. The request is turned
+// into the message t would publish, decoded and served by a server with
+// handler and opts, and the reply decoded into the response. It is meant
+// for tests of what survives the trip, which don't need a NATS server: t
+// may have a nil connection.
+//
+// Bodies are never streamed and the reply is always a JSON envelope, as
+// for batched requests; options for the connection, such as caching or
+// hedging, are not used. Server options that publish on the connection
+// themselves, like WithDeadLetter, fail the call.
+func (t *NATSHTTPTransport) RoundTripLocal(req *http.Request, handler http.Handler, opts ...ServerOption) (*http.Response, error) {
+	if t.configErr != nil {
+		return nil, t.configErr
+	}
+	natsReq, requestedGzip, err := t.newNATSRequest(req, false)
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := t.encodeRequest(natsReq)
+	if err != nil {
+		return nil, err
+	}
+	msg := t.newMsg(natsReq, data)
+	msg.Reply = localReply
+
+	s := NewServer(nil, msg.Subject, append([]ServerOption{WithHandler(handler)}, opts...)...)
+	if s.configErr != nil {
+		return nil, s.configErr
+	}
+	if options := s.publishingOptions(); options != nil {
+		return nil, fmt.Errorf("nats-http: %s need a NATS connection", strings.Join(options, ", "))
+	}
+	var captured []byte
+	s.captures.Store(localReply, &captured)
+	s.handle(msg)
+	s.inflight.Wait()
+	if captured == nil {
+		return nil, ErrNoLocalReply
+	}
+	natsResp, err := t.decodeReply(&nats.Msg{Data: captured})
+	if err != nil {
+		return nil, err
+	}
+	resp := t.newResponse(req.Context(), msg.Subject, natsResp, nil, requestedGzip, 0)
+	setRequest(resp, req)
+	return resp, nil
+}
+
+// publishingOptions names the options of s that publish on the connection
+// on their own.
+func (s *Server) publishingOptions() []string {
+	var options []string
+	for _, o := range []struct {
+		name string
+		set  bool
+	}{
+		{"WithDeadLetter", s.deadLetter != ""},
+		{"WithServerKeepalive", s.keepalive > 0},
+		{"WithInformationalResponses", s.informational},
+		{"WithServerStreaming", s.cfg.Streaming != nil},
+		{"WithServerObjectStore", s.objectStoreBucket != ""},
+	} {
+		if o.set {
+			options = append(options, o.name)
+		}
+	}
+	return options
+}
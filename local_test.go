@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// localCase is a random request and the response the handler gives it.
+type localCase struct {
+	Method       string
+	Path         string
+	Header       map[string]string
+	Body         []byte
+	Status       int
+	ReplyHeaders map[string][]string
+}
+
+// randToken returns a header name or path segment of up to n characters.
+func randToken(r *rand.Rand, n int) string {
+	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-"
+	b := make([]byte, 1+r.Intn(n))
+	for i := range b {
+		b[i] = chars[r.Intn(len(chars))]
+	}
+	return string(b)
+}
+
+// randValue returns a header value of printable ASCII.
+func randValue(r *rand.Rand) string {
+	b := make([]byte, r.Intn(30))
+	for i := range b {
+		b[i] = byte(0x20 + r.Intn(0x5f))
+	}
+	return string(bytes.TrimSpace(b))
+}
+
+func (localCase) Generate(r *rand.Rand, size int) reflect.Value {
+	methods := []string{"GET", "POST", "PUT", "PATCH", "DELETE", "PROPFIND"}
+	c := localCase{
+		Method:       methods[r.Intn(len(methods))],
+		Path:         "/" + randToken(r, 10),
+		Header:       map[string]string{},
+		Status:       200 + r.Intn(300),
+		ReplyHeaders: map[string][]string{},
+	}
+	if c.Status == http.StatusNoContent || c.Status == http.StatusNotModified {
+		c.Status = http.StatusOK
+	}
+	for i := r.Intn(6); i > 0; i-- {
+		c.Header[textproto.CanonicalMIMEHeaderKey("X-"+randToken(r, 8))] = randValue(r)
+	}
+	for i := r.Intn(6); i > 0; i-- {
+		values := make([]string, 1+r.Intn(3))
+		for j := range values {
+			values[j] = randValue(r)
+		}
+		c.ReplyHeaders[textproto.CanonicalMIMEHeaderKey("X-Reply-"+randToken(r, 8))] = values
+	}
+	if c.Method != "GET" && c.Method != "DELETE" {
+		c.Body = make([]byte, r.Intn(4096))
+		r.Read(c.Body)
+	}
+	return reflect.ValueOf(c)
+}
+
+func TestRoundTripLocal(t *testing.T) {
+	for name, tr := range map[string]*NATSHTTPTransport{
+		"json": NewNATSHTTPTransport(nil, "svc", "", 0),
+		"raw":  NewNATSHTTPTransport(nil, "svc", "", 0, WithBinaryPayloads(nil)),
+	} {
+		roundTrip := func(c localCase) bool {
+			// the handler checks the request and answers with c's response,
+			// echoing the body
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if r.Method != c.Method || r.URL.Path != c.Path || !bytes.Equal(body, c.Body) {
+					w.WriteHeader(599)
+					return
+				}
+				for key, value := range c.Header {
+					if r.Header.Get(key) != value {
+						w.WriteHeader(598)
+						return
+					}
+				}
+				for key, values := range c.ReplyHeaders {
+					w.Header()[key] = values
+				}
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.WriteHeader(c.Status)
+				w.Write(body)
+			})
+			var body io.Reader
+			if c.Body != nil {
+				body = bytes.NewReader(c.Body)
+			}
+			req, _ := http.NewRequest(c.Method, "http://svc"+c.Path, body)
+			req.Header.Set("Content-Type", "application/octet-stream")
+			for key, value := range c.Header {
+				req.Header.Set(key, value)
+			}
+			resp, err := tr.RoundTripLocal(req, h)
+			if err != nil {
+				t.Log(err)
+				return false
+			}
+			got, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != c.Status || !bytes.Equal(got, c.Body) {
+				t.Logf("got %d with %d bytes, want %d with %d", resp.StatusCode, len(got), c.Status, len(c.Body))
+				return false
+			}
+			for key, values := range c.ReplyHeaders {
+				if !reflect.DeepEqual(resp.Header[key], values) {
+					t.Logf("%s: got %q, want %q", key, resp.Header[key], values)
+					return false
+				}
+			}
+			return true
+		}
+		if err := quick.Check(roundTrip, &quick.Config{MaxCount: 300}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestRoundTripLocalPublishingOptions(t *testing.T) {
+	tr := NewNATSHTTPTransport(nil, "svc", "", 0)
+	req, _ := http.NewRequest("GET", "http://svc/", nil)
+	_, err := tr.RoundTripLocal(req, http.NotFoundHandler(), WithDeadLetter("dead"), WithInformationalResponses())
+	if err == nil || !strings.Contains(err.Error(), "WithDeadLetter, WithInformationalResponses need a NATS connection") {
+		t.Fatalf("got %v", err)
+	}
+}
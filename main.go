@@ -2,9 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"log/slog"
 	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/nats-io/nats.go"
@@ -12,11 +19,108 @@ import (
 
 var allowList = []string{"example.com", "example.org"}
 
+// NATSHTTPTransport is an http.RoundTripper that sends requests over NATS.
+// It is safe for concurrent use once constructed: options only run in
+// NewNATSHTTPTransport, and state that changes while requests are in flight
+// is guarded by its own lock or atomics.
 type NATSHTTPTransport struct {
 	nc          *nats.Conn
 	subjectReq  string
 	subjectResp string
 	timeout     time.Duration
+
+	disableCompression bool
+	debugHeaders       bool
+	singleFlight       *singleFlight
+	inboxPrefix        string
+	contextKeys        []ContextKey
+	streaming          *StreamConfig
+	hopCodecs          []string
+	broadcastLimit     int
+
+	observabilityHeaders bool
+	objectStore          *objectStoreBodies
+	promotedPrefix       string
+	cancelPropagation    bool
+	hopDecodeFallback    bool
+	maxDecompressedSize  int64
+	cache                Cache
+	stickyHeader         string
+	stickySubjects       []string
+	largeBodySubject     string
+	prioritySubject      string
+	priorityMin          Priority
+	largeBodyThreshold   int64
+	clock                Clock
+	stats                statsCollector
+	keepaliveMax         time.Duration
+	trace                *tracer
+	adaptive             *adaptiveTimeout
+	hedging              *hedging
+	binaryPayloads       func(contentType string) bool
+	rtt                  rttProbe
+	maxTotal             time.Duration
+	configErr            error // invalid option arguments, returned by every request
+}
+
+// Response headers added by WithDebugHeaders. They never come from the
+// upstream; any copies the server sends back are overwritten.
+const (
+	HeaderNATSSubject   = "X-NATS-Subject"
+	HeaderNATSTimeout   = "X-NATS-Timeout-Ms"
+	HeaderNATSLatencyMs = "X-NATS-Latency-Ms"
+	HeaderNATSInstance  = "X-NATS-Instance"
+)
+
+// RoundTripper is what everything that wraps or stands in for a transport
+// works with. It is http.RoundTripper itself, so wrappers compose with any
+// other transport, not just NATSHTTPTransport.
+type RoundTripper = http.RoundTripper
+
+var _ RoundTripper = (*NATSHTTPTransport)(nil)
+
+// Option configures optional behaviour of a NATSHTTPTransport.
+type Option func(*NATSHTTPTransport)
+
+// WithDebugHeaders makes the transport annotate every response with the
+// subject it was sent on, the configured timeout and the measured NATS round
+// trip time. Off by default.
+func WithDebugHeaders() Option {
+	return func(t *NATSHTTPTransport) {
+		t.debugHeaders = true
+	}
+}
+
+// WithSingleFlight coalesces concurrent identical GET and HEAD requests into
+// a single NATS round trip. Requests are keyed on method and URL only, so
+// callers sending different headers for the same URL share one response.
+func WithSingleFlight() Option {
+	return func(t *NATSHTTPTransport) {
+		t.singleFlight = &singleFlight{}
+	}
+}
+
+// WithCancelPropagation tells the server when the caller gives up on a
+// request, so it can abort the upstream call instead of finishing work
+// nobody waits for. Each request carries a private cancel subject; when the
+// request context is cancelled before the reply arrives the transport
+// publishes an empty message there and the server cancels the upstream
+// request's context. This is best effort: a cancel racing the reply, or
+// lost while NATS is disconnected, changes nothing. Coalesced requests are
+// never cancelled.
+func WithCancelPropagation() Option {
+	return func(t *NATSHTTPTransport) {
+		t.cancelPropagation = true
+	}
+}
+
+// WithDisableCompression stops the transport from asking for gzip on its own
+// and from transparently decompressing responses, like
+// http.Transport.DisableCompression.
+func WithDisableCompression() Option {
+	return func(t *NATSHTTPTransport) {
+		t.disableCompression = true
+	}
 }
 
 type NATSHTTPRequest struct {
@@ -24,139 +128,553 @@ type NATSHTTPRequest struct {
 	URL    string            `json:"url"`
 	Header map[string]string `json:"header"`
 	Body   []byte            `json:"body"`
+	// HasBody tells an explicitly empty body (including http.NoBody) apart
+	// from no body at all. Older clients don't set it, so the server treats
+	// any non-empty Body as present too.
+	HasBody bool `json:"hasBody,omitempty"`
+	// ContentLength is the length the client declared for the body, -1 if
+	// it was unknown. Zero means it wasn't sent and the length of Body is
+	// used.
+	ContentLength int64 `json:"contentLength,omitempty"`
+
+	// Scheme is the scheme of the request URL as the client saw it and TLS
+	// reports whether the request arrived at the client over TLS. TLS is only
+	// known when the transport is handed an inbound request, e.g. from
+	// httputil.ReverseProxy; for requests built with http.NewRequest it is
+	// always false and Scheme is the only hint.
+	Scheme string `json:"scheme,omitempty"`
+	TLS    bool   `json:"tls,omitempty"`
+
+	// Context holds the string context values registered with
+	// WithContextKeys.
+	Context map[string]string `json:"context,omitempty"`
+
+	// Stream says the client can take a streamed response, BodyStream that
+	// the body follows in chunks. See stream.go for the protocol.
+	Stream     bool `json:"stream,omitempty"`
+	BodyStream bool `json:"bodyStream,omitempty"`
+
+	// AcceptEncodings lists the NATS-hop codecs the client can decode.
+	AcceptEncodings []string `json:"acceptEncodings,omitempty"`
+
+	// BodyRef points at a body parked in a JetStream object store, see
+	// WithObjectStoreBodies. Body is empty when it is set.
+	BodyRef *ObjectRef `json:"bodyRef,omitempty"`
+
+	// Proto is the protocol version of the original request, e.g. HTTP/1.0.
+	// Empty means HTTP/1.1.
+	Proto      string `json:"proto,omitempty"`
+	ProtoMajor int    `json:"protoMajor,omitempty"`
+	ProtoMinor int    `json:"protoMinor,omitempty"`
+
+	// CancelSubject is where the client publishes when it gives up on the
+	// request, see WithCancelPropagation.
+	CancelSubject string `json:"cancelSubject,omitempty"`
+	// Informational asks for 1xx responses to be forwarded, see
+	// WithInformationalResponses.
+	Informational bool `json:"informational,omitempty"`
+	// Keepalive asks for keepalives, see WithKeepalive.
+	Keepalive bool `json:"keepalive,omitempty"`
+	// Hops is the number of servers the request passed through before, see
+	// WithMaxHops.
+	Hops int `json:"hops,omitempty"`
+	// AcceptRaw lets the server answer with raw messages, see
+	// WithBinaryPayloads.
+	AcceptRaw bool `json:"acceptRaw,omitempty"`
+
+	// promoted holds the headers sent as NATS headers instead, see
+	// WithPromotedHeaders.
+	promoted map[string]string
+	// bodyStream is the body to upload in chunks when BodyStream is set.
+	bodyStream io.Reader
+	// bodySize is the size of the request body, -1 if unknown.
+	bodySize int64
+	// rawEnvelope is the envelope header when the request is sent raw.
+	rawEnvelope string
+	// receivedAt is when the server got the request, decodedAt when it
+	// was decoded, on servers collecting spans.
+	receivedAt time.Time
+	decodedAt  time.Time
 }
 
 type NATSHTTPResponse struct {
 	StatusCode int               `json:"statusCode"`
 	Header     map[string]string `json:"header"`
 	Body       []byte            `json:"body"`
+	Error      string            `json:"error,omitempty"`
+	// HeaderValues holds all values of the headers that have more than
+	// one, typically Set-Cookie. Header has just their first value, which
+	// is all older clients see. Values whose first one differs from Header
+	// are stale and ignored.
+	HeaderValues map[string][]string `json:"headerValues,omitempty"`
+	// ErrorCode classifies Error where the client may want to tell cases
+	// apart, e.g. ErrorCodeInvalidRequest.
+	ErrorCode string `json:"errorCode,omitempty"`
+	// Stream means the body follows in chunk messages.
+	Stream bool `json:"stream,omitempty"`
+	// StreamAck is the subject the sender of a streamed body takes acks and
+	// aborts on.
+	StreamAck string `json:"streamAck,omitempty"`
+	// Encoding is the NATS-hop codec Body is compressed with, if any.
+	Encoding string `json:"encoding,omitempty"`
+	// Proto is the protocol version the upstream answered with. Empty
+	// means HTTP/1.1.
+	Proto      string `json:"proto,omitempty"`
+	ProtoMajor int    `json:"protoMajor,omitempty"`
+	ProtoMinor int    `json:"protoMinor,omitempty"`
+	// Timing is set by servers running WithTiming.
+	Timing *ServerTiming `json:"timing,omitempty"`
+	// Redirects is set by servers running WithRecordRedirects.
+	Redirects []RedirectHop `json:"redirects,omitempty"`
+	// Spans is set by servers running WithSpanCollection.
+	Spans []Span `json:"spans,omitempty"`
+	// Instance is set by servers running WithInstanceID.
+	Instance string `json:"instance,omitempty"`
+	// Trailer holds the trailers of a buffered response; streamed responses
+	// have none. With them and the opaque body, unary gRPC calls round-trip
+	// including grpc-status and grpc-message, given an upstream transport
+	// that speaks HTTP/2 to the gRPC server. Streaming gRPC calls don't work,
+	// as neither side sees the other's messages before its body is done.
+	Trailer map[string]string `json:"trailer,omitempty"`
 }
 
-func NewNATSHTTPTransport(nc *nats.Conn, subjectReq, subjectResp string, timeout time.Duration) *NATSHTTPTransport {
-	return &NATSHTTPTransport{
+func NewNATSHTTPTransport(nc *nats.Conn, subjectReq, subjectResp string, timeout time.Duration, opts ...Option) *NATSHTTPTransport {
+	t := &NATSHTTPTransport{
 		nc:          nc,
 		subjectReq:  subjectReq,
 		subjectResp: subjectResp,
 		timeout:     timeout,
+		clock:       realClock{},
+
+		maxDecompressedSize: DefaultMaxDecompressedSize,
 	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
 }
 
-func (t *NATSHTTPTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	// Serialize the HTTP request
-	headers := make(map[string]string)
-	for key, values := range req.Header {
-		headers[key] = values[0]
+// NewTransportURL connects to the NATS server at url and returns a transport
+// for subject on its own connection, with DefaultTimeout unless WithTimeout
+// says otherwise. The returned func waits for requests in flight to finish,
+// for at most the connection's drain timeout, then drains the connection and
+// returns once it is closed. Callers that need more control over the
+// connection create it themselves and use NewNATSHTTPTransport.
+func NewTransportURL(url, subject string, opts ...Option) (*NATSHTTPTransport, func() error, error) {
+	closed := make(chan struct{})
+	nc, err := nats.Connect(url, nats.ClosedHandler(func(*nats.Conn) { close(closed) }))
+	if err != nil {
+		return nil, nil, err
 	}
-
-	var body []byte
-	if req.Body != nil {
-		var err error
-		body, err = io.ReadAll(req.Body)
-		if err != nil {
-			return nil, err
+	t := NewNATSHTTPTransport(nc, subject, "", DefaultTimeout, opts...)
+	if t.configErr != nil {
+		nc.Close()
+		return nil, nil, t.configErr
+	}
+	closeConn := func() error {
+		// draining unsubscribes from the replies the requests in flight
+		// still wait for
+		deadline := time.Now().Add(nc.Opts.DrainTimeout)
+		for t.stats.inFlight.Load() > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
 		}
+		if err := nc.Drain(); err != nil {
+			if errors.Is(err, nats.ErrConnectionClosed) {
+				return nil
+			}
+			return err
+		}
+		<-closed
+		if err := nc.LastError(); errors.Is(err, nats.ErrDrainTimeout) {
+			return err
+		}
+		return nil
 	}
-	natsReq := NATSHTTPRequest{
-		Method: req.Method,
-		URL:    req.URL.String(),
-		Header: headers,
-		Body:   body,
+	return t, closeConn, nil
+}
+
+// RoundTrip implements http.RoundTripper. A panic inside it, for instance
+// from a nil connection, is returned as a *PanicError instead of unwinding
+// into the caller's goroutine.
+func (t *NATSHTTPTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			resp, err = nil, &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	t.stats.begin()
+	defer t.stats.end()
+	resp, err = t.roundTrip(req)
+	if resp != nil {
+		setRequest(resp, req)
 	}
+	return resp, err
+}
 
-	natsReqData, err := json.Marshal(natsReq)
+func (t *NATSHTTPTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	// the RoundTripper contract: always close the request body, never
+	// modify the request
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+	if t.configErr != nil {
+		return nil, t.configErr
+	}
+	if t.nc.IsClosed() {
+		return nil, ErrConnectionClosed
+	}
+	parent := req.Context()
+	ctx, deadline, cancel := t.withMaxTotal(parent)
+	defer cancel()
+	if ctx != parent {
+		req = req.WithContext(ctx)
+	}
+	// a coalesced reply is shared between callers, so it has to arrive in
+	// one piece
+	coalesce := t.singleFlight != nil && (req.Method == http.MethodGet || req.Method == http.MethodHead)
+	natsReq, requestedGzip, err := t.newNATSRequest(req, t.streaming != nil && !coalesce)
 	if err != nil {
 		return nil, err
 	}
+	if natsReq.BodyRef != nil {
+		// the server deletes the bodies it used, but not those of requests
+		// it refused or never got
+		defer deleteObject(t.nc, natsReq.BodyRef)
+	}
+	if t.cancelPropagation && !coalesce {
+		natsReq.CancelSubject = t.newInbox()
+	}
+	onInformational := got1xx(req.Context())
+	natsReq.Informational = onInformational != nil && !coalesce
+	natsReq.Keepalive = t.keepaliveMax > 0 && !coalesce
+	var cacheLookup, cacheStore bool
+	cacheKey := req.Method + " " + natsReq.URL
+	if t.cache != nil {
+		cacheLookup, cacheStore = cacheRequestPolicy(req)
+	}
+	if cacheLookup {
+		if cached, ok := t.cache.Get(cacheKey); ok && t.clock.Now().Before(cached.Expires) {
+			natsResp := cached.Response
+			return t.newResponse(parent, t.subjectFor(natsReq), &natsResp, nil, requestedGzip, 0), nil
+		}
+	}
+	natsReq.AcceptRaw = t.binaryPayloads != nil
+	natsReqData, err := t.encodeRequest(natsReq)
+	if err != nil {
+		return nil, err
+	}
+	if t.trace != nil {
+		traced := &nats.Msg{Header: nats.Header{}, Data: natsReqData}
+		if natsReq.rawEnvelope != "" {
+			setRaw(traced, natsReq.rawEnvelope)
+		}
+		t.trace.request(slog.Default(), "nats-http request", traced)
+	}
 
 	// Send the request over NATS
-	msg, err := t.nc.Request(t.subjectReq, natsReqData, t.timeout)
+	start := t.clock.Now()
+	requestCtx := ctx
+	if coalesce {
+		// one caller giving up must not fail the others; each still stops
+		// waiting when its own ctx ends
+		requestCtx = context.WithoutCancel(ctx)
+	}
+	request := func() (*nats.Msg, error) {
+		return t.request(requestCtx, t.newMsg(natsReq, natsReqData))
+	}
+	if t.hedging != nil && hedgeable(req.Method) {
+		request = func() (*nats.Msg, error) {
+			return t.hedgedRequest(requestCtx, func() *nats.Msg { return t.newMsg(natsReq, natsReqData) })
+		}
+	}
+	if natsReq.CancelSubject != "" {
+		stop := context.AfterFunc(ctx, func() {
+			t.nc.Publish(natsReq.CancelSubject, nil)
+		})
+		defer stop()
+	}
+	var msg *nats.Msg
+	var streamSub *nats.Subscription
+	switch {
+	case coalesce:
+		msg, err = t.singleFlight.do(ctx, req.Method+" "+natsReq.URL, request)
+	case natsReq.Stream || natsReq.Informational || natsReq.Keepalive:
+		msg, streamSub, err = t.streamRequest(ctx, t.newMsg(natsReq, natsReqData), natsReq.bodyStream, onInformational, deadline)
+	default:
+		msg, err = request()
+	}
+	latency := t.clock.Now().Sub(start)
+	if t.adaptive != nil && (err == nil || errors.Is(err, nats.ErrTimeout)) {
+		t.adaptive.observe(latency)
+	}
 	if err != nil {
-		return nil, err
+		if !deadline.IsZero() && parent.Err() == nil && (ctx.Err() != nil || !t.clock.Now().Before(deadline)) {
+			return nil, &TotalTimeoutError{Limit: t.maxTotal}
+		}
+		return nil, requestError(t.nc, err)
 	}
 
-	// Deserialize the response
-	var natsResp NATSHTTPResponse
-	if err := json.Unmarshal(msg.Data, &natsResp); err != nil {
+	if t.trace != nil {
+		t.trace.response(slog.Default(), "nats-http reply", msg)
+	}
+	natsResp, err := t.decodeReply(msg)
+	if streamSub != nil && (err != nil || !natsResp.Stream) {
+		streamSub.Unsubscribe()
+		streamSub = nil
+	}
+	if err != nil {
 		return nil, err
 	}
+	m := MessageStats{RequestBytes: len(natsReqData), ResponseBytes: len(msg.Data), Duration: latency}
+	if streamSub == nil {
+		m.BodyBytes = len(natsResp.Body)
+	}
+	t.stats.record(m)
+	if cacheStore && streamSub == nil {
+		if expires := cacheExpiry(natsResp, t.clock.Now()); !expires.IsZero() {
+			t.cache.Set(cacheKey, &CachedResponse{Response: *natsResp, Expires: expires})
+		}
+	}
+	return t.newResponse(parent, t.subjectFor(natsReq), natsResp, streamSub, requestedGzip, latency), nil
+}
 
-	// Construct the HTTP response
-	headersResp := http.Header{}
-	for key, value := range natsResp.Header {
-		headersResp.Set(key, value)
+// encodeRequest returns the payload of the message for natsReq, sending the
+// body raw when WithBinaryPayloads says so.
+func (t *NATSHTTPTransport) encodeRequest(natsReq *NATSHTTPRequest) ([]byte, error) {
+	if t.binaryPayloads != nil && len(natsReq.Body) > 0 && t.binaryPayloads(natsReq.Header["Content-Type"]) {
+		head := *natsReq
+		head.Body = nil
+		data, envelope, err := encodeRaw(&head, natsReq.Body)
+		natsReq.rawEnvelope = envelope
+		return data, err
+	}
+	return json.Marshal(natsReq)
+}
+
+// newMsg wraps a serialized request into a message for the request subject.
+func (t *NATSHTTPTransport) newMsg(natsReq *NATSHTTPRequest, data []byte) *nats.Msg {
+	msg := nats.NewMsg(t.subjectFor(natsReq))
+	msg.Data = data
+	if natsReq.rawEnvelope != "" {
+		setRaw(msg, natsReq.rawEnvelope)
+	}
+	if t.observabilityHeaders {
+		msg.Header.Set(HeaderObservabilityMethod, natsReq.Method)
 	}
+	for key, value := range natsReq.promoted {
+		msg.Header.Set(key, value)
+	}
+	return msg
+}
 
-	return &http.Response{
-		StatusCode: natsResp.StatusCode,
-		Header:     headersResp,
-		Body:       io.NopCloser(bytes.NewReader(natsResp.Body)),
-	}, nil
+// newNATSRequest serializes req. With stream set the request asks for a
+// streamed response and large bodies are left in natsReq.bodyStream to be
+// streamed.
+// It also reports whether gzip was requested on the caller's behalf.
+func (t *NATSHTTPTransport) newNATSRequest(req *http.Request, stream bool) (*NATSHTTPRequest, bool, error) {
+	return t.newNATSRequestVia(req, stream, t.objectStore)
 }
 
-func startServer(nc *nats.Conn, subjectReq string) {
-	_, err := nc.Subscribe(subjectReq, func(msg *nats.Msg) {
-		// Deserialize the incoming NATS request
-		var natsReq NATSHTTPRequest
-		if err := json.Unmarshal(msg.Data, &natsReq); err != nil {
-			nc.Publish(msg.Reply, []byte(`{"error": "invalid request"}`))
-			return
-		}
+// newNATSRequestVia is newNATSRequest parking large bodies in objectStore,
+// or never if it is nil.
+func (t *NATSHTTPTransport) newNATSRequestVia(req *http.Request, stream bool, objectStore *objectStoreBodies) (*NATSHTTPRequest, bool, error) {
+	// Serialize the HTTP request
+	headers := make(map[string]string)
+	for key, values := range req.Header {
+		headers[key] = values[0]
+	}
+	if p, ok := req.Context().Value(priorityKey{}).(Priority); ok && headers[HeaderNATSPriority] == "" {
+		headers[HeaderNATSPriority] = p.String()
+	}
 
-		// Make the HTTP request
-		httpReq, err := http.NewRequest(natsReq.Method, natsReq.URL, bytes.NewReader(natsReq.Body))
-		if err != nil {
-			return
-		}
-		for key, value := range natsReq.Header {
-			httpReq.Header.Set(key, value)
-		}
-		// check that host header is for a allowed domain
-		if _, ok := httpReq.Header["Host"]; !ok {
-			nc.Publish(msg.Reply, []byte(`{"error": "missing host header"}`))
-			return
+	// Like http.Transport, ask for gzip ourselves unless the caller has an
+	// opinion about the encoding, and undo it again on the way back.
+	requestedGzip := false
+	if !t.disableCompression &&
+		req.Header.Get("Accept-Encoding") == "" &&
+		req.Header.Get("Range") == "" &&
+		req.Method != http.MethodHead {
+		requestedGzip = true
+		headers["Accept-Encoding"] = "gzip"
+	}
+
+	// A client request with a body and a zero ContentLength has an unknown
+	// length, just like -1.
+	contentLength := req.ContentLength
+	if contentLength == 0 && req.Body != nil && req.Body != http.NoBody {
+		contentLength = -1
+	}
+	streamBody := stream && req.Body != nil && req.Body != http.NoBody &&
+		(contentLength < 0 || contentLength > int64(t.streaming.ChunkSize))
+
+	var body []byte
+	var bodyStream io.Reader
+	var bodyRef *ObjectRef
+	var err error
+	switch {
+	case objectStore != nil && objectStore.wants(req):
+		if body, bodyRef, err = objectStore.put(t.nc, req.Body); err != nil {
+			return nil, false, err
 		}
-		host := httpReq.Header.Get("Host")
-		allowed := false
-		for _, domain := range allowList {
-			if host == domain {
-				allowed = true
-				break
-			}
+		streamBody = stream && bodyRef == nil && len(body) > t.streaming.ChunkSize
+		if streamBody {
+			bodyStream = bytes.NewReader(body)
+			body = nil
 		}
-		if !allowed {
-			nc.Publish(msg.Reply, []byte(`{"error": "host not allowed"}`))
-			return
+	case req.Body != nil && !streamBody:
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, false, err
 		}
+	case streamBody:
+		bodyStream = req.Body
+	}
+	bodySize := int64(len(body))
+	if bodyStream != nil || bodyRef != nil {
+		bodySize = contentLength
+	}
+	return &NATSHTTPRequest{
+		Method:          req.Method,
+		URL:             req.URL.String(),
+		Header:          headers,
+		Body:            body,
+		HasBody:         req.Body != nil,
+		ContentLength:   contentLength,
+		Scheme:          req.URL.Scheme,
+		TLS:             req.TLS != nil,
+		Context:         contextValues(req.Context(), t.contextKeys),
+		Stream:          stream,
+		BodyStream:      streamBody,
+		AcceptEncodings: t.hopCodecs,
+		BodyRef:         bodyRef,
+		Proto:           req.Proto,
+		ProtoMajor:      req.ProtoMajor,
+		ProtoMinor:      req.ProtoMinor,
+		promoted:        promoteHeaders(headers, t.promotedPrefix),
+		bodyStream:      bodyStream,
+		bodySize:        bodySize,
+		Hops:            hopsFrom(req.Context()),
+	}, requestedGzip, nil
+}
 
-		client := &http.Client{}
-		resp, err := client.Do(httpReq)
-		if err != nil {
-			if err := nc.Publish(msg.Reply, []byte(`{"error": "failed to make request"}`)); err != nil {
-				panic(err)
-			}
+// decodeReply deserializes a reply and turns error envelopes into errors.
+func (t *NATSHTTPTransport) decodeReply(msg *nats.Msg) (*NATSHTTPResponse, error) {
+	var natsResp NATSHTTPResponse
+	if err := decodePayload(msg, &natsResp); err != nil {
+		return nil, &DecodeError{Err: err}
+	}
+	if natsResp.Error != "" {
+		return nil, newServerError(&natsResp)
+	}
+	if natsResp.StatusCode == 0 {
+		return nil, ErrMissingStatus
+	}
+	if natsResp.Encoding != "" {
+		body, err := hopDecompress(natsResp.Encoding, natsResp.Body, t.maxDecompressedSize)
+		switch {
+		case err == nil:
+			natsResp.Body = body
+		case !t.hopDecodeFallback, errors.Is(err, ErrDecompressedTooLarge):
+			return nil, err
 		}
-		defer resp.Body.Close()
+		natsResp.Encoding = ""
+	}
+	return &natsResp, nil
+}
 
-		body, _ := io.ReadAll(resp.Body)
-		respHeaders := make(map[string]string)
-		for key, values := range resp.Header {
-			respHeaders[key] = values[0]
+// newResponse builds the http.Response for a decoded reply from subject. The
+// body is read from streamSub when the reply is the head of a streamed
+// response, until ctx is done.
+func (t *NATSHTTPTransport) newResponse(ctx context.Context, subject string, natsResp *NATSHTTPResponse, streamSub *nats.Subscription, requestedGzip bool, latency time.Duration) *http.Response {
+	// Construct the HTTP response. Header values, Content-Type included, are
+	// passed through verbatim and the body is opaque bytes, so binary
+	// responses arrive byte for byte whatever their content type.
+	// natsResp may be shared, by the cache or coalesced requests, so the
+	// header gets its own slices the caller is free to modify.
+	headersResp := http.Header{}
+	for key, value := range natsResp.Header {
+		headersResp.Set(key, value)
+	}
+	for key, values := range natsResp.HeaderValues {
+		if len(values) > 0 && natsResp.Header[key] == values[0] {
+			headersResp[http.CanonicalHeaderKey(key)] = slices.Clone(values)
+		}
+	}
+	if t.debugHeaders {
+		headersResp.Set(HeaderNATSSubject, subject)
+		headersResp.Set(HeaderNATSTimeout, strconv.FormatInt(t.Timeout().Milliseconds(), 10))
+		headersResp.Set(HeaderNATSLatencyMs, formatMs(latency))
+		if natsResp.Timing != nil {
+			setTimingHeaders(headersResp, natsResp.Timing, latency)
 		}
+		if len(natsResp.Spans) > 0 {
+			headersResp.Set(HeaderNATSSpans, formatSpans(natsResp.Spans))
+		}
+		if natsResp.Instance != "" {
+			headersResp.Set(HeaderNATSInstance, natsResp.Instance)
+		}
+		if len(natsResp.Redirects) > 0 {
+			headersResp.Set(HeaderNATSRedirects, formatRedirects(natsResp.Redirects))
+		}
+	}
 
-		// Serialize and send the response
-		natsResp := NATSHTTPResponse{
-			StatusCode: resp.StatusCode,
-			Header:     respHeaders,
-			Body:       body,
+	proto, major, minor := protoOrDefault(natsResp.Proto, natsResp.ProtoMajor, natsResp.ProtoMinor)
+	resp := &http.Response{
+		Status:        strconv.Itoa(natsResp.StatusCode) + " " + http.StatusText(natsResp.StatusCode),
+		StatusCode:    natsResp.StatusCode,
+		Proto:         proto,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        headersResp,
+		Body:          io.NopCloser(bytes.NewReader(natsResp.Body)),
+		ContentLength: int64(len(natsResp.Body)),
+	}
+	if len(natsResp.Trailer) > 0 {
+		resp.Trailer = http.Header{}
+		for key, value := range natsResp.Trailer {
+			resp.Trailer.Set(key, value)
 		}
-		respData, _ := json.Marshal(natsResp)
-		if err := nc.Publish(msg.Reply, respData); err != nil {
-			panic(err)
+	}
+	if streamSub != nil {
+		cr := newChunkReader(ctx, t.nc, streamSub, t.streaming.Timeout)
+		cr.ackSubject = natsResp.StreamAck
+		resp.Body = cr
+		resp.ContentLength = -1
+		if n, err := strconv.ParseInt(headersResp.Get("Content-Length"), 10, 64); err == nil {
+			resp.ContentLength = n
 		}
-	})
-	if err != nil {
-		panic(err)
 	}
+	if requestedGzip && strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		resp.Body = &gzipReader{body: resp.Body}
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+	}
+	return resp
+}
+
+// setRequest ties resp to req. As with net/http, the response to a HEAD
+// request has no body but keeps the Content-Length the upstream announced.
+func setRequest(resp *http.Response, req *http.Request) {
+	resp.Request = req
+	if req.Method != http.MethodHead {
+		return
+	}
+	resp.Body.Close()
+	resp.Body = http.NoBody
+	resp.ContentLength = -1
+	if n, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		resp.ContentLength = n
+	}
+}
+
+// protoOrDefault falls back to HTTP/1.1 for peers that don't send a
+// protocol version.
+func protoOrDefault(proto string, major, minor int) (string, int, int) {
+	if proto == "" {
+		return "HTTP/1.1", 1, 1
+	}
+	return proto, major, minor
 }
 
 func main() {
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// runNATS starts an embedded NATS server, adjusted by configure, and
+// returns a connection to it, both closed when the test ends.
+func runNATS(t testing.TB, configure ...func(*server.Options)) *nats.Conn {
+	t.Helper()
+	opts := &server.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true}
+	for _, c := range configure {
+		c(opts)
+	}
+	ns, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+// serveHandler runs a server for h on subject and returns a transport for
+// it.
+func serveHandler(t testing.TB, nc *nats.Conn, subject string, h http.Handler, opts ...ServerOption) *NATSHTTPTransport {
+	t.Helper()
+	s := NewServer(nc, subject, append([]ServerOption{WithHandler(h)}, opts...)...)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return NewNATSHTTPTransport(nc, subject, "", 5*time.Second)
+}
+
+// serveUpstream runs h as an HTTP server with a server on subject proxying
+// to it, and returns the upstream's URL.
+func serveUpstream(t testing.TB, nc *nats.Conn, subject string, h http.Handler, opts ...ServerOption) *url.URL {
+	t.Helper()
+	upstream := httptest.NewServer(h)
+	t.Cleanup(upstream.Close)
+	u, _ := url.Parse(upstream.URL)
+	s := NewServer(nc, subject, append([]ServerOption{WithAllowedHosts(u.Host)}, opts...)...)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// upstreamRequest returns a request for path on the upstream at u.
+func upstreamRequest(method string, u *url.URL, path string, body io.Reader) *http.Request {
+	req, _ := http.NewRequest(method, u.String()+path, body)
+	req.Header.Set("Host", u.Host)
+	return req
+}
+
+func TestTransparentGzip(t *testing.T) {
+	nc := runNATS(t)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	io.WriteString(zw, "hello, gzip")
+	zw.Close()
+	tr := serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello, gzip" || !resp.Uncompressed || resp.Header.Get("Content-Encoding") != "" || resp.ContentLength != -1 {
+		t.Fatalf("got %q, uncompressed %v, header %v", body, resp.Uncompressed, resp.Header)
+	}
+
+	// a client that asks for gzip itself gets the bytes as they are
+	req, _ = http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err = tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	if !bytes.Equal(body, compressed.Bytes()) || resp.Uncompressed || resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("got %q, uncompressed %v, header %v", body, resp.Uncompressed, resp.Header)
+	}
+}
+
+func TestBinaryResponseFidelity(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i * 7)
+	}
+	img.Set(0, 0, color.RGBA{0xff, 0xfe, 0x00, 0x80})
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, img); err != nil {
+		t.Fatal(err)
+	}
+	const contentType = "image/png; name=\"tile.png\""
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write(pngData.Bytes())
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	nc := runNATS(t)
+	s := NewServer(nc, "png", WithAllowedHosts(u.Host), WithServerBinaryPayloads(nil))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	nc.Flush()
+
+	for name, opts := range map[string][]Option{
+		"json": nil,
+		"raw":  {WithBinaryPayloads(nil)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tr := NewNATSHTTPTransport(nc, "png", "", 5*time.Second, opts...)
+			req, _ := http.NewRequest("GET", upstream.URL+"/tile.png", nil)
+			req.Header.Set("Host", u.Host)
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if !bytes.Equal(body, pngData.Bytes()) {
+				t.Fatalf("body of %d bytes differs from the %d byte PNG", len(body), pngData.Len())
+			}
+			if got := resp.Header.Get("Content-Type"); got != contentType {
+				t.Fatalf("Content-Type %q", got)
+			}
+			if resp.ContentLength != int64(pngData.Len()) {
+				t.Fatalf("ContentLength %d", resp.ContentLength)
+			}
+			if _, err := png.Decode(bytes.NewReader(body)); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestConcurrentRoundTrip(t *testing.T) {
+	nc := runNATS(t)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(w, "%s %s", r.URL.Path, r.Header.Get("X-Id"))
+	})
+	serveHandler(t, nc, "svc", h, WithMaxConcurrency(8))
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second,
+		WithCache(NewMemoryCache(16)), WithAdaptiveTimeout(3, time.Second, 5*time.Second), WithStatsHook(func(MessageStats) {}))
+
+	var wg sync.WaitGroup
+	for g := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 20 {
+				path := fmt.Sprintf("/%d", (g+i)%32)
+				req, _ := http.NewRequest("GET", "http://svc"+path, nil)
+				// no-cache for half of them, so some go to the server and
+				// some are answered from the cache at the same time
+				id := fmt.Sprint(g)
+				if i%2 == 0 {
+					req.Header.Set("Cache-Control", "no-cache")
+				}
+				req.Header.Set("X-Id", id)
+				resp, err := tr.RoundTrip(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				body, _ := io.ReadAll(resp.Body)
+				if !bytes.HasPrefix(body, []byte(path+" ")) {
+					t.Errorf("%s got %q", path, body)
+				}
+				if resp.Request != req || len(req.Header) != 2-i%2 || req.Header.Get("X-Id") != id {
+					t.Errorf("request modified: %v", req.Header)
+				}
+				tr.Stats()
+			}
+		}()
+	}
+	wg.Wait()
+	if n := tr.Stats().Requests; n < 500 || n > 1000 {
+		t.Fatalf("%d requests recorded", n)
+	}
+}
+
+func TestCookieJar(t *testing.T) {
+	nc := runNATS(t)
+	tr := serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1"})
+			http.SetCookie(w, &http.Cookie{Name: "theme", Value: "dark"})
+			return
+		}
+		var names []string
+		for _, c := range r.Cookies() {
+			names = append(names, c.Name+"="+c.Value)
+		}
+		io.WriteString(w, strings.Join(names, ";"))
+	}))
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: tr, Jar: jar}
+
+	resp, err := client.Get("http://svc.example/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Request == nil {
+		t.Fatal("response has no request")
+	}
+	resp, err = client.Get("http://svc.example/check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "session=s1;theme=dark" {
+		t.Fatalf("handler got cookies %q", body)
+	}
+}
+
+func TestNewTransportURL(t *testing.T) {
+	nc := runNATS(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	}))
+	tr, closeConn, err := NewTransportURL(nc.ConnectedUrl(), "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		body string
+		err  error
+	}
+	inflight := make(chan result, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "http://svc/", nil)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			inflight <- result{err: err}
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		inflight <- result{body: string(body)}
+	}()
+	<-started
+	closed := make(chan error, 1)
+	go func() { closed <- closeConn() }()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	// Draining lets the request in flight finish before closing.
+	if r := <-inflight; r.err != nil || r.body != "done" {
+		t.Fatalf("request in flight: got %q, %v", r.body, r.err)
+	}
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "http://svc/", nil)
+	if _, err := tr.RoundTrip(req); !errors.Is(err, nats.ErrConnectionClosed) {
+		t.Fatalf("after close: got %v", err)
+	}
+	if err := closeConn(); err != nil {
+		t.Fatalf("second close: %v", err)
+	}
+}
+
+func TestResponseHeadersNotShared(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Add("Link", "</a>")
+		w.Header().Add("Link", "</b>")
+		time.Sleep(10 * time.Millisecond)
+	})
+	for name, c := range map[string]struct {
+		client []Option
+		server []ServerOption
+	}{
+		"singleflight": {client: []Option{WithSingleFlight()}},
+		"client cache": {client: []Option{WithCache(NewMemoryCache(10))}},
+		"server cache": {server: []ServerOption{WithServerCache(NewMemoryCache(10))}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			nc := runNATS(t)
+			u := serveUpstream(t, nc, "svc", h, c.server...)
+			tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, c.client...)
+			// fill the caches
+			resp, err := tr.RoundTrip(upstreamRequest("GET", u, "/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			var wg sync.WaitGroup
+			for i := range 50 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					resp, err := tr.RoundTrip(upstreamRequest("GET", u, "/", nil))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					resp.Body.Close()
+					links := resp.Header["Link"]
+					if len(links) != 2 || links[0] != "</a>" || links[1] != "</b>" {
+						t.Errorf("got Link %q", links)
+						return
+					}
+					// every caller owns its header, values included
+					links[0] = fmt.Sprintf("</mine/%d>", i)
+					resp.Header.Add("Link", "</c>")
+					resp.Header.Set("X-Caller", strconv.Itoa(i))
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestDebugHeaders(t *testing.T) {
+	nc := runNATS(t)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	serveHandler(t, nc, "svc", h)
+	serveHandler(t, nc, "svc.large", h)
+	get := func(tr *NATSHTTPTransport, body string) http.Header {
+		t.Helper()
+		req, _ := http.NewRequest("POST", "http://svc/", strings.NewReader(body))
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Header
+	}
+	// off by default
+	for _, key := range []string{HeaderNATSSubject, HeaderNATSTimeout, HeaderNATSLatencyMs} {
+		if v := get(NewNATSHTTPTransport(nc, "svc", "", 5*time.Second), "").Get(key); v != "" {
+			t.Fatalf("%s: %q without debug headers", key, v)
+		}
+	}
+
+	// the subject is the one the request was routed to
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithDebugHeaders(), WithLargeBodySubject(4, "svc.large"))
+	for body, subject := range map[string]string{"tiny": "svc", "larger": "svc.large"} {
+		header := get(tr, body)
+		if got := header.Get(HeaderNATSSubject); got != subject {
+			t.Errorf("%s: %s is %q, want %q", body, HeaderNATSSubject, got, subject)
+		}
+		if got := header.Get(HeaderNATSTimeout); got != "5000" {
+			t.Errorf("%s: %s is %q", body, HeaderNATSTimeout, got)
+		}
+		if ms, err := strconv.ParseFloat(header.Get(HeaderNATSLatencyMs), 64); err != nil || ms <= 0 {
+			t.Errorf("%s: %s is %q", body, HeaderNATSLatencyMs, header.Get(HeaderNATSLatencyMs))
+		}
+	}
+}
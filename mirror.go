@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+)
+
+type mirror struct {
+	base       *url.URL
+	sampleRate float64
+}
+
+// WithMirror sends a copy of a sampleRate fraction of the requests, 0 to 1,
+// to the upstream at upstreamBase as well, e.g. to try a new version with
+// real traffic. Scheme and host come from upstreamBase, its path is put in
+// front of the request's. The copy is sent in the background after the
+// request was forwarded; its response is discarded and failures are only
+// logged, so the mirror affects neither the response nor the latency.
+// The copy has the client's headers, without those the route adds or the
+// upstream's credential. Streamed and object store bodies are not mirrored.
+// Start fails if upstreamBase is not an absolute URL.
+func WithMirror(upstreamBase string, sampleRate float64) ServerOption {
+	return func(s *Server) {
+		base, err := url.Parse(upstreamBase)
+		if err != nil || base.Scheme == "" || base.Host == "" {
+			s.configErr = errors.Join(s.configErr, fmt.Errorf("nats-http: invalid mirror URL %q", upstreamBase))
+			return
+		}
+		s.mirror = &mirror{base: base, sampleRate: sampleRate}
+	}
+}
+
+// mirrorRequest sends a copy of req, whose body is natsReq.Body and whose
+// client headers are natsReq.Header, to the mirror in the background.
+func (s *Server) mirrorRequest(req *http.Request, natsReq *NATSHTTPRequest, authHeader string) {
+	if natsReq.BodyStream || natsReq.BodyRef != nil || rand.Float64() >= s.mirror.sampleRate {
+		return
+	}
+	u := *req.URL
+	u.Scheme, u.Host = s.mirror.base.Scheme, s.mirror.base.Host
+	u.Path = s.mirror.base.JoinPath(req.URL.Path).Path
+	u.RawPath = ""
+	// the mirror must not be cancelled together with the original request
+	mreq, err := http.NewRequestWithContext(context.WithoutCancel(req.Context()), req.Method, u.String(), bytes.NewReader(natsReq.Body))
+	if err != nil {
+		s.logger.Warn("failed to build mirror request", "error", err)
+		return
+	}
+	for key, value := range natsReq.Header {
+		mreq.Header.Set(key, value)
+	}
+	mreq.Header.Del("Host")
+	if s.authForwarding != AuthorizationForward {
+		mreq.Header.Del("Authorization")
+	}
+	if authHeader != "" {
+		mreq.Header.Del(authHeader)
+	}
+	client := s.httpClient()
+	if s.cfg.Handler != nil {
+		// the handler replaces the upstream, the mirror is a real one
+		client.Transport = nil
+	}
+	s.inflight.Add(1)
+	go func() {
+		defer s.inflight.Done()
+		resp, err := client.Do(mreq)
+		if err != nil {
+			s.logger.Warn("mirror request failed", "url", mreq.URL.String(), "error", err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
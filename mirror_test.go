@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	nc := runNATS(t)
+	mirrored := make(chan *http.Request, 1)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(strings.NewReader(string(body)))
+		mirrored <- r
+	}))
+	t.Cleanup(mirror.Close)
+	u := serveUpstream(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "backend" || r.Header.Get("X-Token") != "upstream" {
+			t.Errorf("upstream got %v", r.Header)
+		}
+	}),
+		WithMirror(mirror.URL+"/shadow", 1),
+		WithRoutes(Route{Subject: "svc", Headers: map[string]string{"X-Api-Key": "backend"}}),
+		WithUpstreamAuth(func() (string, string, error) { return "X-Token", "upstream", nil }),
+	)
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second)
+
+	req := upstreamRequest("POST", u, "/items?x=1", strings.NewReader("body"))
+	req.Header.Set("X-Client", "yes")
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var got *http.Request
+	select {
+	case got = <-mirrored:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not mirrored")
+	}
+	body, _ := io.ReadAll(got.Body)
+	if got.Method != "POST" || got.URL.Path != "/shadow/items" || got.URL.RawQuery != "x=1" || string(body) != "body" {
+		t.Fatalf("mirror got %s %s %q", got.Method, got.URL, body)
+	}
+	if got.Header.Get("X-Client") != "yes" {
+		t.Errorf("client header missing: %v", got.Header)
+	}
+	for _, key := range []string{"X-Api-Key", "X-Token"} {
+		if v := got.Header.Get(key); v != "" {
+			t.Errorf("mirror got %s: %q", key, v)
+		}
+	}
+}
+
+func TestMirrorInvalidURL(t *testing.T) {
+	nc := runNATS(t)
+	s := NewServer(nc, "svc", WithMirror("not a url", 1))
+	if err := s.Start(); err == nil || !strings.Contains(err.Error(), "invalid mirror URL") {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import "net/http"
+
+// Handle serves handler on subject from the same process, like
+// http.ServeMux.Handle but for NATS subjects. The subject gets a server of
+// its own configured by opts alone, so limits, CORS, middleware and the like
+// are independent of this server's; only the connection, the logger unless
+// opts set one, and the lifecycle are shared. Start subscribes it, or Handle
+// does right away on a started server, and Close closes it along with this
+// server.
+func (s *Server) Handle(subject string, handler http.Handler, opts ...ServerOption) error {
+	h := NewServer(s.nc, subject, append([]ServerOption{WithLogger(s.logger), WithHandler(handler)}, opts...)...)
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+	if s.started {
+		if err := h.Start(); err != nil {
+			return err
+		}
+	}
+	s.handlers = append(s.handlers, h)
+	return nil
+}
+
+// startHandlers starts the servers added by Handle.
+func (s *Server) startHandlers() error {
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+	s.started = true
+	for _, h := range s.handlers {
+		if err := h.Start(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeHandlers closes the servers added by Handle.
+func (s *Server) closeHandlers() error {
+	s.subsMu.Lock()
+	handlers := s.handlers
+	s.handlers, s.started = nil, false
+	s.subsMu.Unlock()
+	var firstErr error
+	for _, h := range handlers {
+		if err := h.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHandle(t *testing.T) {
+	nc := runNATS(t)
+	// tag is middleware marking responses with the service that answered.
+	tag := func(name string, next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Service", name)
+			next.ServeHTTP(w, r)
+		})
+	}
+	echoMethod := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Method)
+	})
+	s := NewServer(nc, "main", WithHandler(http.NotFoundHandler()))
+	if err := s.Handle("users", tag("users", echoMethod)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// Handle on a started server subscribes right away.
+	if err := s.Handle("orders", tag("orders", echoMethod), WithAllowedMethods("GET")); err != nil {
+		t.Fatal(err)
+	}
+	nc.Flush()
+
+	do := func(subject, method string) (*http.Response, string, error) {
+		tr := NewNATSHTTPTransport(nc, subject, "", 5*time.Second)
+		req, _ := http.NewRequest(method, "http://svc/", nil)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			return nil, "", err
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body), nil
+	}
+	for _, subject := range []string{"users", "orders"} {
+		resp, body, err := do(subject, "GET")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Header.Get("X-Service"); got != subject || body != "GET" {
+			t.Errorf("%s: answered by %q with %q", subject, got, body)
+		}
+	}
+	// The method restriction only applies to the subject it was given for.
+	if _, body, err := do("users", "POST"); err != nil || body != "POST" {
+		t.Errorf("POST users: got %q, %v", body, err)
+	}
+	if resp, _, err := do("orders", "POST"); err != nil {
+		t.Error(err)
+	} else if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST orders: status %d, want 405", resp.StatusCode)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, subject := range []string{"users", "orders"} {
+		if _, _, err := do(subject, "GET"); !errors.Is(err, ErrNoResponders) {
+			t.Errorf("%s after Close: got %v", subject, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Package natshttpprom exports the stats of an http-over-nats transport or
+// server as Prometheus metrics. It is its own module so the core stays free
+// of the Prometheus dependency.
+//
+// The core is a main package and can't be imported, so the collector takes
+// Observation, which has the fields of the core's MessageStats and converts
+// from it directly. Wiring a transport up and serving /metrics:
+//
+//	reg := prometheus.NewRegistry()
+//	var transport *NATSHTTPTransport
+//	collector, err := natshttpprom.New(reg, natshttpprom.Opts{
+//		Namespace: "nats_http_client",
+//		InFlight:  func() int64 { return transport.Stats().InFlight },
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	transport = NewNATSHTTPTransport(nc, "svc", "", 5*time.Second,
+//		WithStatsHook(func(m MessageStats) {
+//			collector.Observe(natshttpprom.Observation(m))
+//		}))
+//	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+//
+// A server is wired the same way with WithServerStatsHook and Server.Stats.
+package natshttpprom
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Observation describes one request. It mirrors MessageStats field for
+// field, so a MessageStats converts to it.
+type Observation struct {
+	RequestBytes  int
+	ResponseBytes int
+	BodyBytes     int
+	Duration      time.Duration
+}
+
+// Opts names the metrics and says where the in-flight gauge reads from.
+type Opts struct {
+	Namespace string
+	Subsystem string
+	// Buckets are the latency histogram buckets in seconds,
+	// prometheus.DefBuckets by default.
+	Buckets []float64
+	// InFlight reports the requests in flight, typically Stats().InFlight
+	// of the transport or server. Without it there is no in-flight gauge.
+	InFlight func() int64
+}
+
+// Collector holds the metrics fed by Observe.
+type Collector struct {
+	requests      prometheus.Counter
+	requestBytes  prometheus.Counter
+	responseBytes prometheus.Counter
+	bodyBytes     prometheus.Counter
+	latency       prometheus.Histogram
+}
+
+// New creates the metrics and registers them with reg.
+func New(reg prometheus.Registerer, opts Opts) (*Collector, error) {
+	counter := func(name, help string) prometheus.Counter {
+		return prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: opts.Namespace, Subsystem: opts.Subsystem, Name: name, Help: help,
+		})
+	}
+	c := &Collector{
+		requests:      counter("requests_total", "Requests that got a reply."),
+		requestBytes:  counter("request_bytes_total", "Payload bytes of request messages."),
+		responseBytes: counter("response_bytes_total", "Payload bytes of reply messages as sent."),
+		bodyBytes:     counter("body_bytes_total", "Uncompressed bytes of buffered response bodies."),
+		latency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: opts.Namespace, Subsystem: opts.Subsystem,
+			Name:    "request_duration_seconds",
+			Help:    "Time to handle a request.",
+			Buckets: opts.Buckets,
+		}),
+	}
+	collectors := []prometheus.Collector{c.requests, c.requestBytes, c.responseBytes, c.bodyBytes, c.latency}
+	if opts.InFlight != nil {
+		collectors = append(collectors, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: opts.Namespace, Subsystem: opts.Subsystem,
+			Name: "requests_in_flight",
+			Help: "Requests being handled.",
+		}, func() float64 { return float64(opts.InFlight()) }))
+	}
+	for _, collector := range collectors {
+		if err := reg.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Observe records one request.
+func (c *Collector) Observe(o Observation) {
+	c.requests.Inc()
+	c.requestBytes.Add(float64(o.RequestBytes))
+	c.responseBytes.Add(float64(o.ResponseBytes))
+	c.bodyBytes.Add(float64(o.BodyBytes))
+	c.latency.Observe(o.Duration.Seconds())
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// Notify sends req without waiting for a response, for fire-and-forget
+// traffic like webhooks. No reply inbox is involved: the request is
+// published and Notify returns once the NATS server has it. The server
+// still makes the upstream call but discards the response, logging failed
+// calls. There is no way to learn whether anybody received the request.
+// Bodies are never streamed nor parked in the object store, since nothing
+// tells the client when the object could be deleted, so they have to fit
+// into a NATS message.
+func (t *NATSHTTPTransport) Notify(ctx context.Context, req *http.Request) error {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+	if t.configErr != nil {
+		return t.configErr
+	}
+	if t.nc.IsClosed() {
+		return ErrConnectionClosed
+	}
+	natsReq, _, err := t.newNATSRequestVia(req, false, nil)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(natsReq)
+	if err != nil {
+		return err
+	}
+	if err := t.nc.PublishMsg(t.newMsg(natsReq, data)); err != nil {
+		return requestError(t.nc, err)
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout())
+		defer cancel()
+	}
+	return requestError(t.nc, t.nc.FlushWithContext(ctx))
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	nc := runNATS(t)
+	got := make(chan string, 1)
+	tr := serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Method + " " + r.URL.Path
+	}))
+	published, err := nc.SubscribeSync("svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subs := nc.NumSubscriptions()
+
+	req, _ := http.NewRequest("POST", "http://svc/hook", strings.NewReader("event"))
+	if err := tr.Notify(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case call := <-got:
+		if call != "POST /hook" {
+			t.Fatalf("upstream got %q", call)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification never reached the upstream")
+	}
+	// no inbox to answer to, and none subscribed
+	msg, err := published.NextMsg(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Reply != "" {
+		t.Fatalf("notification has reply subject %q", msg.Reply)
+	}
+	if n := nc.NumSubscriptions(); n != subs {
+		t.Fatalf("%d subscriptions after Notify, want %d", n, subs)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// Request bodies that are too big even for chunked streaming can be parked
+// in a JetStream object store. The client uploads the body to the bucket
+// under a random name and only sends a BodyRef; the server streams the
+// object to the upstream and deletes it once the upstream call is done. The
+// client deletes the object as well when the round trip is over, which
+// covers requests the server refused or never got. Broadcast bodies are read
+// by every server, so they are marked Keep and only the client deletes
+// them, once the replies are in. Notify never uses the object store, as
+// nothing tells the client when the body was read. The cleanups are best
+// effort, so give the bucket a TTL as a safety net.
+//
+// Object names start with objectNamePrefix, and servers refuse references
+// to any other name, so a request can't make a server read and delete
+// objects that aren't request bodies.
+
+// defaultObjectStoreThreshold is used when WithObjectStoreBodies is given a
+// threshold of zero or less.
+const defaultObjectStoreThreshold = 8 << 20
+
+const objectNamePrefix = "nats-http-body."
+
+// ObjectRef names a request body stored in a JetStream object store.
+type ObjectRef struct {
+	Bucket string `json:"bucket"`
+	Name   string `json:"name"`
+	// Keep tells servers to leave the object for the client to delete,
+	// because more than one of them reads it.
+	Keep bool `json:"keep,omitempty"`
+}
+
+// WithObjectStoreBodies sends request bodies larger than threshold bytes, 8MiB
+// when threshold is zero or less, through the JetStream object store bucket.
+// Bodies of unknown length are buffered up to the threshold to decide. Above
+// the threshold this takes precedence over chunked streaming. The bucket has
+// to exist.
+func WithObjectStoreBodies(bucket string, threshold int64) Option {
+	if threshold <= 0 {
+		threshold = defaultObjectStoreThreshold
+	}
+	return func(t *NATSHTTPTransport) {
+		t.objectStore = &objectStoreBodies{bucket: bucket, threshold: threshold}
+	}
+}
+
+// WithServerObjectStore lets the server accept request bodies parked in
+// bucket. References to any other bucket, or to objects not named like
+// request bodies, are refused.
+func WithServerObjectStore(bucket string) ServerOption {
+	return func(s *Server) {
+		s.objectStoreBucket = bucket
+	}
+}
+
+type objectStoreBodies struct {
+	bucket    string
+	threshold int64
+}
+
+func (o *objectStoreBodies) wants(req *http.Request) bool {
+	return req.Body != nil && req.Body != http.NoBody &&
+		(req.ContentLength < 0 || req.ContentLength > o.threshold)
+}
+
+// put stores body in the bucket when it turns out to be larger than the
+// threshold. Smaller bodies are returned as they are.
+func (o *objectStoreBodies) put(nc *nats.Conn, body io.Reader) ([]byte, *ObjectRef, error) {
+	head, err := io.ReadAll(io.LimitReader(body, o.threshold+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(len(head)) <= o.threshold {
+		return head, nil, nil
+	}
+	store, err := objectStore(nc, o.bucket)
+	if err != nil {
+		return nil, nil, err
+	}
+	ref := &ObjectRef{Bucket: o.bucket, Name: objectNamePrefix + nuid.Next()}
+	if _, err := store.Put(&nats.ObjectMeta{Name: ref.Name}, io.MultiReader(bytes.NewReader(head), body)); err != nil {
+		return nil, nil, err
+	}
+	return nil, ref, nil
+}
+
+func objectStore(nc *nats.Conn, bucket string) (nats.ObjectStore, error) {
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	return js.ObjectStore(bucket)
+}
+
+func deleteObject(nc *nats.Conn, ref *ObjectRef) error {
+	store, err := objectStore(nc, ref.Bucket)
+	if err != nil {
+		return err
+	}
+	return store.Delete(ref.Name)
+}
+
+// openObjectBody returns the stored request body and a cleanup func that
+// closes and, unless the client keeps it, deletes it.
+func (s *Server) openObjectBody(ctx context.Context, ref *ObjectRef) (io.ReadCloser, int64, func(), error) {
+	store, err := objectStore(s.nc, ref.Bucket)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	obj, err := store.Get(ref.Name, nats.Context(ctx))
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	size := int64(-1)
+	if info, err := obj.Info(); err == nil {
+		size = int64(info.Size)
+	}
+	cleanup := func() {
+		obj.Close()
+		if ref.Keep {
+			return
+		}
+		// the client may have been first
+		if err := store.Delete(ref.Name); err != nil && !errors.Is(err, nats.ErrObjectNotFound) {
+			s.logger.Warn("failed to delete object store body", "bucket", ref.Bucket, "name", ref.Name, "error", err)
+		}
+	}
+	return obj, size, cleanup, nil
+}
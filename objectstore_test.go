@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func TestObjectStoreBodies(t *testing.T) {
+	nc := runNATS(t, func(o *server.Options) {
+		o.JetStream = true
+		o.StoreDir = t.TempDir()
+	})
+	js, _ := nc.JetStream()
+	store, err := js.CreateObjectStore(&nats.ObjectStoreConfig{Bucket: "bodies"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leftover := func() int {
+		list, _ := store.List()
+		return len(list)
+	}
+	var got []byte
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = io.ReadAll(r.Body)
+	})
+	serveHandler(t, nc, "svc", h, WithServerObjectStore("bodies"))
+	serveHandler(t, nc, "other", h)
+	big := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithObjectStoreBodies("bodies", 64<<10))
+	resp, err := tr.RoundTrip(mustRequest(t, "POST", big))
+	if err != nil || resp.StatusCode != http.StatusOK || !bytes.Equal(got, big) {
+		t.Fatalf("got %d bytes, %v", len(got), err)
+	}
+	if n := leftover(); n != 0 {
+		t.Fatalf("%d objects left after a served request", n)
+	}
+
+	// a server without the bucket refuses with an error envelope
+	tr = NewNATSHTTPTransport(nc, "other", "", 5*time.Second, WithObjectStoreBodies("bodies", 64<<10))
+	_, err = tr.RoundTrip(mustRequest(t, "POST", big))
+	var se *ServerError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got %v", err)
+	}
+	if n := leftover(); n != 0 {
+		t.Fatalf("%d objects left after a refused request", n)
+	}
+
+	// references to objects that aren't request bodies are refused
+	if _, err := store.PutBytes("precious", []byte("keep me")); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(NATSHTTPRequest{Method: "POST", URL: "http://svc/", BodyRef: &ObjectRef{Bucket: "bodies", Name: "precious"}})
+	msg, err := nc.Request("svc", data, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.decodeReply(msg); !errors.As(err, &se) || se.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := store.GetBytes("precious"); err != nil {
+		t.Fatalf("object deleted: %v", err)
+	}
+}
+
+func mustRequest(t *testing.T, method string, body []byte) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, "http://svc/", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestObjectStoreBodiesWithoutRoundTrip(t *testing.T) {
+	nc := runNATS(t, func(o *server.Options) {
+		o.JetStream = true
+		o.StoreDir = t.TempDir()
+	})
+	js, _ := nc.JetStream()
+	store, err := js.CreateObjectStore(&nats.ObjectStoreConfig{Bucket: "bodies"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leftover := func() int {
+		list, _ := store.List()
+		return len(list)
+	}
+	received := make(chan []byte, 10)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- body
+	})
+	for range 3 {
+		serveHandler(t, nc, "svc", h, WithServerObjectStore("bodies"))
+	}
+	serveHandler(t, nc, "other", h)
+	big := bytes.Repeat([]byte("0123456789abcdef"), 1<<14)
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithObjectStoreBodies("bodies", 16<<10), WithBroadcastLimit(3))
+
+	// every server of a broadcast reads the body, and the client deletes it
+	resps, err := tr.Broadcast(context.Background(), mustRequest(t, "POST", big))
+	if err != nil || len(resps) != 3 {
+		t.Fatalf("got %d responses, %v", len(resps), err)
+	}
+	for range 3 {
+		if body := <-received; !bytes.Equal(body, big) {
+			t.Fatalf("server got %d bytes", len(body))
+		}
+	}
+	if n := leftover(); n != 0 {
+		t.Fatalf("%d objects left after a broadcast", n)
+	}
+
+	// batched bodies are deleted whether a server used them or not
+	if _, err := tr.DoBatch(context.Background(), []*http.Request{mustRequest(t, "POST", big), mustRequest(t, "POST", big)}); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+	<-received
+	refusing := NewNATSHTTPTransport(nc, "other", "", 5*time.Second, WithObjectStoreBodies("bodies", 16<<10))
+	var batchErr *BatchError
+	if _, err := refusing.DoBatch(context.Background(), []*http.Request{mustRequest(t, "POST", big)}); !errors.As(err, &batchErr) {
+		t.Fatalf("got %v, want a BatchError", err)
+	}
+	if n := leftover(); n != 0 {
+		t.Fatalf("%d objects left after batches", n)
+	}
+
+	// a notification carries its body inline
+	if err := tr.Notify(context.Background(), mustRequest(t, "POST", big)); err != nil {
+		t.Fatal(err)
+	}
+	if n := leftover(); n != 0 {
+		t.Fatalf("%d objects stored for a notification", n)
+	}
+	if body := <-received; !bytes.Equal(body, big) {
+		t.Fatalf("notified server got %d bytes", len(body))
+	}
+}
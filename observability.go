@@ -0,0 +1,25 @@
+package main
+
+// NATS message headers set by the observability options, so NATS level
+// monitoring and tracing tools can tell requests and replies apart without
+// decoding the JSON payload. They are set whatever the payload encoding.
+const (
+	HeaderObservabilityMethod = "Nats-Http-Method"
+	HeaderObservabilityStatus = "Nats-Http-Status"
+)
+
+// WithObservabilityHeaders sets Nats-Http-Method on every request message the
+// transport publishes. Off by default.
+func WithObservabilityHeaders() Option {
+	return func(t *NATSHTTPTransport) {
+		t.observabilityHeaders = true
+	}
+}
+
+// WithServerObservabilityHeaders sets Nats-Http-Status on every reply the
+// server publishes that has a known status. Off by default.
+func WithServerObservabilityHeaders() ServerOption {
+	return func(s *Server) {
+		s.observabilityHeaders = true
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestObservabilityHeaders(t *testing.T) {
+	nc := runNATS(t)
+	msgs := make(chan *nats.Msg, 16)
+	sub, _ := nc.ChanSubscribe(">", msgs)
+	defer sub.Unsubscribe()
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) })
+	serveHandler(t, nc, "svc", h, WithServerObservabilityHeaders())
+	serveHandler(t, nc, "plain", h)
+
+	for _, c := range []struct {
+		subject, method, status string
+		opts                    []Option
+	}{
+		{"svc", "DELETE", "418", []Option{WithObservabilityHeaders()}},
+		{"plain", "", "", nil},
+	} {
+		tr := NewNATSHTTPTransport(nc, c.subject, "", 5*time.Second, c.opts...)
+		req, _ := http.NewRequest("DELETE", "http://svc/", nil)
+		if _, err := tr.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+		for range 2 {
+			select {
+			case msg := <-msgs:
+				if strings.HasPrefix(msg.Subject, nats.InboxPrefix) {
+					if got := msg.Header.Get(HeaderObservabilityStatus); got != c.status {
+						t.Errorf("%s: reply has status header %q, want %q", c.subject, got, c.status)
+					}
+				} else if got := msg.Header.Get(HeaderObservabilityMethod); got != c.method {
+					t.Errorf("%s: request has method header %q, want %q", c.subject, got, c.method)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("missed a message")
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Messages normally carry a JSON envelope with the body base64 encoded in
+// it, which is easy to read on the wire but a third larger for binary
+// bodies. A raw message instead carries the body as its payload, marked with
+// Nats-Http-Payload: raw, and the envelope without the body as JSON in
+// Nats-Http-Envelope. Which one is used is decided per message from the
+// body's Content-Type.
+//
+// A raw message is framed as:
+//
+//	Nats-Http-Payload: raw
+//	Nats-Http-Envelope: {"method":"POST","url":...}  (JSON, no "body")
+//	payload: the body bytes as they are
+//
+// Everything but the body stays JSON, so tools can still read the headers.
+// The envelope header counts towards the message size limit like the
+// payload. BenchmarkBinaryPayload compares both for a binary body.
+const (
+	HeaderPayload  = "Nats-Http-Payload"
+	HeaderEnvelope = "Nats-Http-Envelope"
+)
+
+// BinaryContentType is the default choice of which bodies are sent raw:
+// everything except text, JSON, XML, JavaScript and form data. Bodies
+// without a Content-Type stay in the JSON envelope.
+func BinaryContentType(contentType string) bool {
+	if contentType == "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return false
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript",
+		"application/x-www-form-urlencoded":
+		return false
+	}
+	return true
+}
+
+// WithBinaryPayloads sends request bodies for which isBinary reports true
+// raw, and tells the server it may answer raw as well. A nil isBinary means
+// BinaryContentType. The server has to understand raw messages, which
+// servers without it don't.
+func WithBinaryPayloads(isBinary func(contentType string) bool) Option {
+	if isBinary == nil {
+		isBinary = BinaryContentType
+	}
+	return func(t *NATSHTTPTransport) {
+		t.binaryPayloads = isBinary
+	}
+}
+
+// WithServerBinaryPayloads answers raw when the client accepts it and
+// isBinary reports true for the response's Content-Type. A nil isBinary
+// means BinaryContentType. Raw requests are understood either way.
+func WithServerBinaryPayloads(isBinary func(contentType string) bool) ServerOption {
+	if isBinary == nil {
+		isBinary = BinaryContentType
+	}
+	return func(s *Server) {
+		s.binaryPayloads = isBinary
+	}
+}
+
+// encodeRaw returns the payload and envelope header of a raw message for
+// v, whose body is body.
+func encodeRaw(v any, body []byte) ([]byte, string, error) {
+	envelope, err := json.Marshal(v)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, string(envelope), nil
+}
+
+// decodePayload unmarshals msg into v, a *NATSHTTPRequest or
+// *NATSHTTPResponse, taking the body from the payload for raw messages.
+func decodePayload(msg *nats.Msg, v any) error {
+	if msg.Header.Get(HeaderPayload) != "raw" {
+		return json.Unmarshal(msg.Data, v)
+	}
+	if err := json.Unmarshal([]byte(msg.Header.Get(HeaderEnvelope)), v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case *NATSHTTPRequest:
+		v.Body = msg.Data
+	case *NATSHTTPResponse:
+		v.Body = msg.Data
+	}
+	return nil
+}
+
+func setRaw(msg *nats.Msg, envelope string) {
+	msg.Header.Set(HeaderPayload, "raw")
+	msg.Header.Set(HeaderEnvelope, envelope)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestPayloadEncodingByContentType(t *testing.T) {
+	nc := runNATS(t)
+	serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+		io.Copy(w, r.Body)
+	}), WithServerBinaryPayloads(nil))
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithBinaryPayloads(nil))
+	// watch requests and replies on the wire
+	requests, err := nc.SubscribeSync("svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replies, err := nc.SubscribeSync("_INBOX.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		contentType string
+		body        []byte
+		raw         bool
+	}{
+		{"image/png", []byte{0x89, 'P', 'N', 'G', 0, 0xff}, true},
+		{"application/json", []byte(`{"ok":true}`), false},
+	} {
+		req, _ := http.NewRequest("POST", "http://svc/", bytes.NewReader(tc.body))
+		req.Header.Set("Content-Type", tc.contentType)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !bytes.Equal(body, tc.body) {
+			t.Fatalf("%s: got body %q", tc.contentType, body)
+		}
+		for side, sub := range map[string]*nats.Subscription{"request": requests, "reply": replies} {
+			msg, err := sub.NextMsg(time.Second)
+			if err != nil {
+				t.Fatalf("%s %s: %v", tc.contentType, side, err)
+			}
+			raw := msg.Header.Get(HeaderPayload) == "raw"
+			if raw != tc.raw {
+				t.Errorf("%s %s: raw %v, want %v", tc.contentType, side, raw, tc.raw)
+			}
+			if raw && !bytes.Equal(msg.Data, tc.body) {
+				t.Errorf("%s %s: raw payload %q", tc.contentType, side, msg.Data)
+			}
+		}
+	}
+}
+
+// BenchmarkBinaryPayload echoes a 500KB binary body with the body base64
+// encoded in the JSON envelope and sent raw.
+func BenchmarkBinaryPayload(b *testing.B) {
+	body := make([]byte, 500<<10)
+	rand.Read(body)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.Copy(w, r.Body)
+	})
+	for _, c := range []struct {
+		name   string
+		client []Option
+		server []ServerOption
+	}{
+		{"json", nil, nil},
+		{"raw", []Option{WithBinaryPayloads(nil)}, []ServerOption{WithServerBinaryPayloads(nil)}},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			nc := runNATS(b)
+			serveHandler(b, nc, "svc", h, c.server...)
+			tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, c.client...)
+			b.SetBytes(int64(2 * len(body)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				req, _ := http.NewRequest("POST", "http://svc/", bytes.NewReader(body))
+				req.Header.Set("Content-Type", "application/octet-stream")
+				resp, err := tr.RoundTrip(req)
+				if err != nil {
+					b.Fatal(err)
+				}
+				got, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if len(got) != len(body) {
+					b.Fatalf("echoed %d of %d bytes", len(got), len(body))
+				}
+			}
+		})
+	}
+}
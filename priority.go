@@ -0,0 +1,149 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"strings"
+	"sync"
+)
+
+// Priority decides which waiting request gets the next free slot when the
+// server is at its concurrency limit. Higher values run first; requests of
+// equal priority run in arrival order.
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+	PriorityCritical
+)
+
+// HeaderNATSPriority carries the request priority from the client. Accepted
+// values are "low", "normal", "high" and "critical"; anything else, including
+// a missing header, means PriorityNormal. The server strips it before the
+// request goes upstream.
+const HeaderNATSPriority = "X-Nats-Priority"
+
+func headerPriority(req *NATSHTTPRequest) Priority {
+	return parsePriority(req.Header[HeaderNATSPriority])
+}
+
+func parsePriority(value string) Priority {
+	switch strings.ToLower(value) {
+	case "low":
+		return PriorityLow
+	case "high":
+		return PriorityHigh
+	case "critical":
+		return PriorityCritical
+	default:
+		return PriorityNormal
+	}
+}
+
+// String returns the priority's value for HeaderNATSPriority.
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	case PriorityCritical:
+		return "critical"
+	default:
+		return "normal"
+	}
+}
+
+type priorityKey struct{}
+
+// ContextWithPriority returns a context that gives requests made with it
+// priority p, as if they carried HeaderNATSPriority. A header set on the
+// request wins.
+func ContextWithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// priorityLimiter is a counting semaphore that hands freed slots to the
+// highest priority waiter instead of whoever happens to be scheduled first.
+type priorityLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	seq     uint64
+	waiting waitQueue
+}
+
+func newPriorityLimiter(limit int) *priorityLimiter {
+	return &priorityLimiter{limit: limit}
+}
+
+func (l *priorityLimiter) acquire(p Priority) {
+	l.mu.Lock()
+	if l.running < l.limit && len(l.waiting) == 0 {
+		l.running++
+		l.mu.Unlock()
+		return
+	}
+	w := &waiter{prio: p, seq: l.seq, ready: make(chan struct{})}
+	l.seq++
+	heap.Push(&l.waiting, w)
+	l.mu.Unlock()
+	<-w.ready
+}
+
+func (l *priorityLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiting) > 0 && l.running <= l.limit {
+		// the slot is handed over, running stays the same
+		w := heap.Pop(&l.waiting).(*waiter)
+		close(w.ready)
+		return
+	}
+	l.running--
+}
+
+// setLimit changes the number of slots. Growing wakes up waiters right away,
+// shrinking takes effect as running requests finish.
+func (l *priorityLimiter) setLimit(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = n
+	for l.running < l.limit && len(l.waiting) > 0 {
+		w := heap.Pop(&l.waiting).(*waiter)
+		close(w.ready)
+		l.running++
+	}
+}
+
+func (l *priorityLimiter) getLimit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+type waiter struct {
+	prio  Priority
+	seq   uint64
+	ready chan struct{}
+}
+
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int { return len(q) }
+func (q waitQueue) Less(i, j int) bool {
+	if q[i].prio != q[j].prio {
+		return q[i].prio > q[j].prio
+	}
+	return q[i].seq < q[j].seq
+}
+func (q waitQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *waitQueue) Push(x any)   { *q = append(*q, x.(*waiter)) }
+func (q *waitQueue) Pop() any {
+	old := *q
+	w := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return w
+}
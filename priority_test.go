@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	nc := runNATS(t)
+	var mu sync.Mutex
+	var order []string
+	release := make(chan struct{})
+	tr := serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			<-release
+			return
+		}
+		if r.Header.Get(HeaderNATSPriority) != "" {
+			t.Error("priority header reached the upstream")
+		}
+		mu.Lock()
+		order = append(order, r.URL.Path)
+		mu.Unlock()
+	}), WithMaxConcurrency(1))
+
+	var wg sync.WaitGroup
+	send := func(path, prio string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+			if prio != "" {
+				req.Header.Set(HeaderNATSPriority, prio)
+			}
+			if _, err := tr.RoundTrip(req); err != nil {
+				t.Error(err)
+			}
+		}()
+		// queue them in a known order
+		time.Sleep(50 * time.Millisecond)
+	}
+	send("/block", "")
+	send("/low", "low")
+	send("/normal", "")
+	send("/critical", "critical")
+	close(release)
+	wg.Wait()
+	if len(order) != 3 || order[0] != "/critical" || order[1] != "/normal" || order[2] != "/low" {
+		t.Fatalf("served in order %v", order)
+	}
+}
+
+func TestPriorityHeaderStripped(t *testing.T) {
+	nc := runNATS(t)
+	var got string
+	tr := serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(HeaderNATSPriority)
+	}))
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set(HeaderNATSPriority, "critical")
+	if _, err := tr.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Fatalf("upstream got priority %q", got)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// DefaultPromotedHeaderPrefix is the conventional prefix for HTTP headers
+// that should travel as NATS message headers, e.g. X-Nats-Tenant.
+const DefaultPromotedHeaderPrefix = "X-Nats-"
+
+// WithPromotedHeaders moves HTTP request headers starting with prefix out of
+// the JSON envelope and onto the NATS message as headers of the same name,
+// where subject mapping, permissions and tooling can act on them. Matching is
+// case insensitive. Use WithServerPromotedHeaders with the same prefix on the
+// server to turn them back into HTTP headers.
+func WithPromotedHeaders(prefix string) Option {
+	return func(t *NATSHTTPTransport) {
+		t.promotedPrefix = http.CanonicalHeaderKey(prefix)
+	}
+}
+
+// WithServerPromotedHeaders restores NATS message headers starting with
+// prefix into the HTTP request, see WithPromotedHeaders. Headers already in
+// the envelope win.
+func WithServerPromotedHeaders(prefix string) ServerOption {
+	return func(s *Server) {
+		s.promotedPrefix = http.CanonicalHeaderKey(prefix)
+	}
+}
+
+// promoteHeaders removes the headers matching prefix from header and returns
+// them.
+func promoteHeaders(header map[string]string, prefix string) map[string]string {
+	if prefix == "" {
+		return nil
+	}
+	var promoted map[string]string
+	for key, value := range header {
+		if !hasPrefixFold(key, prefix) {
+			continue
+		}
+		if promoted == nil {
+			promoted = make(map[string]string)
+		}
+		promoted[key] = value
+		delete(header, key)
+	}
+	return promoted
+}
+
+// restorePromotedHeaders copies the matching NATS headers of msg into req.
+func restorePromotedHeaders(msg *nats.Msg, req *NATSHTTPRequest, prefix string) {
+	if prefix == "" {
+		return
+	}
+	for key, values := range msg.Header {
+		if !hasPrefixFold(key, prefix) || len(values) == 0 {
+			continue
+		}
+		key = http.CanonicalHeaderKey(key)
+		if _, ok := req.Header[key]; ok {
+			continue
+		}
+		if req.Header == nil {
+			req.Header = make(map[string]string)
+		}
+		req.Header[key] = values[0]
+	}
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestPromotedHeaders(t *testing.T) {
+	nc := runNATS(t)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", r.Header.Get("X-Nats-Tenant"), r.Header.Get("X-Nats-Extra"), r.Header.Get("X-Other"))
+	})
+	serveHandler(t, nc, "svc", h, WithServerPromotedHeaders(DefaultPromotedHeaderPrefix))
+	msgs := make(chan *nats.Msg, 1)
+	sub, _ := nc.ChanSubscribe("svc", msgs)
+	defer sub.Unsubscribe()
+
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithPromotedHeaders("x-nats-"))
+	req, _ := http.NewRequest("GET", "http://svc/", nil)
+	req.Header.Set("X-Nats-Tenant", "acme")
+	req.Header.Set("X-Other", "kept")
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "acme  kept" {
+		t.Fatalf("upstream saw %q", body)
+	}
+	msg := <-msgs
+	var natsReq NATSHTTPRequest
+	if err := json.Unmarshal(msg.Data, &natsReq); err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Header.Get("X-Nats-Tenant"); got != "acme" {
+		t.Errorf("NATS header is %q", got)
+	}
+	if _, ok := natsReq.Header["X-Nats-Tenant"]; ok || natsReq.Header["X-Other"] != "kept" {
+		t.Errorf("envelope headers are %v", natsReq.Header)
+	}
+
+	// A header in the envelope wins over a promoted one of the same name.
+	data, _ := json.Marshal(NATSHTTPRequest{Method: "GET", URL: "http://svc/", Header: map[string]string{"X-Nats-Tenant": "envelope"}})
+	raw := nats.NewMsg("svc")
+	raw.Data = data
+	raw.Header.Set("X-Nats-Tenant", "promoted")
+	raw.Header.Set("x-nats-extra", "extra")
+	reply, err := nc.RequestMsg(raw, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	natsResp, err := tr.decodeReply(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(natsResp.Body) != "envelope extra " {
+		t.Fatalf("upstream saw %q", natsResp.Body)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// WithRateLimit limits requests arriving on subject to rate per second,
+// allowing bursts of up to burst requests. Requests over the limit get a 429
+// error envelope with a Retry-After header. It can be given once per subject
+// and is independent of WithMaxConcurrency.
+func WithRateLimit(subject string, rate float64, burst int) ServerOption {
+	return func(s *Server) {
+		if s.rateLimits == nil {
+			s.rateLimits = make(map[string]*tokenBucket)
+		}
+		s.rateLimits[subject] = newTokenBucket(rate, burst)
+	}
+}
+
+// RateLimitStats is a snapshot of one subject's rate limiter.
+type RateLimitStats struct {
+	Rate     float64 // configured requests per second
+	Tokens   float64 // requests that could be admitted right now
+	Allowed  uint64
+	Rejected uint64
+}
+
+// RateLimitStats reports the state of every configured rate limit, keyed by
+// subject.
+func (s *Server) RateLimitStats() map[string]RateLimitStats {
+	stats := make(map[string]RateLimitStats, len(s.rateLimits))
+	for subject, b := range s.rateLimits {
+		stats[subject] = b.stats(s.clock.Now())
+	}
+	return stats
+}
+
+// rateLimited reports whether msg was rejected, in which case the 429 reply
+// has already been sent.
+func (s *Server) rateLimited(msg *nats.Msg) bool {
+	b, ok := s.rateLimits[msg.Subject]
+	if !ok {
+		return false
+	}
+	allowed, retryAfter := b.take(s.clock.Now())
+	if allowed {
+		return false
+	}
+	secs := int(math.Ceil(retryAfter.Seconds()))
+	s.replyErrorHeader(msg, http.StatusTooManyRequests, "rate limit exceeded",
+		map[string]string{"Retry-After": strconv.Itoa(secs)})
+	return true
+}
+
+// IdentityRateLimit limits requests per client identity rather than per
+// subject, so one client can't starve the others.
+type IdentityRateLimit struct {
+	// Rate is the number of requests per second and Burst the bucket size
+	// each identity gets.
+	Rate  float64
+	Burst int
+	// Identity extracts the client identity from a request. By default it
+	// is the value of the X-Client-Id header. Plug in whatever your
+	// authentication already validated; a header on its own is only as
+	// trustworthy as the clients sending it.
+	Identity func(*NATSHTTPRequest) string
+	// DenyUnidentified rejects requests without an identity with a 401.
+	// Otherwise they share a single bucket.
+	DenyUnidentified bool
+}
+
+// HeaderClientID is the default source of the client identity for
+// IdentityRateLimit.
+const HeaderClientID = "X-Client-Id"
+
+// maxIdentityBuckets bounds the number of identities tracked. Past it the
+// least recently seen identity is forgotten, and starts over with a full
+// bucket should it come back.
+const maxIdentityBuckets = 10000
+
+// WithIdentityRateLimit enables per identity rate limiting. Requests over the
+// limit get a 429 error envelope with Retry-After.
+func WithIdentityRateLimit(cfg IdentityRateLimit) ServerOption {
+	return func(s *Server) {
+		if cfg.Identity == nil {
+			cfg.Identity = func(r *NATSHTTPRequest) string { return r.Header[HeaderClientID] }
+		}
+		s.identityLimit = &identityLimiter{cfg: cfg, buckets: make(map[string]*list.Element), order: list.New()}
+	}
+}
+
+type identityLimiter struct {
+	cfg     IdentityRateLimit
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	// order holds the *identityBucket values, most recently seen first
+	order *list.List
+}
+
+type identityBucket struct {
+	id     string
+	bucket *tokenBucket
+}
+
+func (l *identityLimiter) bucket(id string) *tokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.buckets[id]; ok {
+		l.order.MoveToFront(e)
+		return e.Value.(*identityBucket).bucket
+	}
+	if l.order.Len() >= maxIdentityBuckets {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.buckets, oldest.Value.(*identityBucket).id)
+	}
+	b := newTokenBucket(l.cfg.Rate, l.cfg.Burst)
+	l.buckets[id] = l.order.PushFront(&identityBucket{id: id, bucket: b})
+	return b
+}
+
+// identityLimited reports whether the request was rejected, in which case the
+// reply has already been sent.
+func (s *Server) identityLimited(msg *nats.Msg, req *NATSHTTPRequest) bool {
+	l := s.identityLimit
+	if l == nil {
+		return false
+	}
+	id := l.cfg.Identity(req)
+	if id == "" && l.cfg.DenyUnidentified {
+		s.replyError(msg, http.StatusUnauthorized, "missing client identity")
+		return true
+	}
+	now := s.clock.Now()
+	allowed, retryAfter := l.bucket(id).take(now)
+	if allowed {
+		return false
+	}
+	secs := int(math.Ceil(retryAfter.Seconds()))
+	s.replyErrorHeader(msg, http.StatusTooManyRequests, "client rate limit exceeded",
+		map[string]string{"Retry-After": strconv.Itoa(secs)})
+	return true
+}
+
+type tokenBucket struct {
+	mu       sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	last     time.Time
+	allowed  uint64
+	rejected uint64
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// take consumes a token if one is available and otherwise reports how long
+// until the next one is.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		b.allowed++
+		return true, 0
+	}
+	b.rejected++
+	if b.rate <= 0 {
+		return false, time.Second
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) stats(now time.Time) RateLimitStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	return RateLimitStats{
+		Rate:     b.rate,
+		Tokens:   b.tokens,
+		Allowed:  b.allowed,
+		Rejected: b.rejected,
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIdentityRateLimitFlood(t *testing.T) {
+	nc := runNATS(t)
+	s := NewServer(nc, "svc", WithServerClock(newFakeClock()),
+		WithHandler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})),
+		WithIdentityRateLimit(IdentityRateLimit{Rate: 1, Burst: 1}))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	nc.Flush()
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second)
+	asAlice := func() error {
+		req, _ := http.NewRequest("GET", "http://svc/", nil)
+		req.Header.Set(HeaderClientID, "alice")
+		_, err := tr.RoundTrip(req)
+		return err
+	}
+	if err := asAlice(); err != nil {
+		t.Fatal(err)
+	}
+
+	// fresh identities can't grow the limiter past its cap, nor push out
+	// a client that keeps coming back
+	l := s.identityLimit
+	for i := range 3 * maxIdentityBuckets {
+		l.bucket("flood-" + strconv.Itoa(i))
+		if i%1000 == 0 {
+			l.bucket("alice")
+		}
+	}
+	if n := len(l.buckets); n != maxIdentityBuckets || l.order.Len() != n {
+		t.Fatalf("%d identities tracked, want %d", n, maxIdentityBuckets)
+	}
+	if _, ok := l.buckets["flood-0"]; ok {
+		t.Fatal("the least recently seen identity was kept")
+	}
+	var se *ServerError
+	if err := asAlice(); !errors.As(err, &se) || se.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got %v, want a 429", err)
+	}
+}
+
+func TestSubjectRateLimit(t *testing.T) {
+	nc := runNATS(t)
+	clock := newFakeClock()
+	serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		WithServerClock(clock), WithRoutes(Route{Subject: "svc.bulk"}), WithRateLimit("svc.bulk", 1, 2))
+	do := func(subject string) error {
+		tr := NewNATSHTTPTransport(nc, subject, "", 5*time.Second)
+		req, _ := http.NewRequest("GET", "http://svc/", nil)
+		resp, err := tr.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	limited := func(err error) bool {
+		var se *ServerError
+		return errors.As(err, &se) && se.StatusCode == http.StatusTooManyRequests && se.RetryAfter == time.Second
+	}
+
+	// a burst of two, then one a second
+	for i, want := range []bool{false, false, true, true} {
+		if err := do("svc.bulk"); limited(err) != want || !want && err != nil {
+			t.Fatalf("request %d: got %v", i, err)
+		}
+	}
+	// other subjects aren't limited
+	for range 5 {
+		if err := do("svc"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.advance(500 * time.Millisecond)
+	if err := do("svc.bulk"); !limited(err) {
+		t.Fatalf("half a token: got %v", err)
+	}
+	clock.advance(500 * time.Millisecond)
+	if err := do("svc.bulk"); err != nil {
+		t.Fatalf("refilled: got %v", err)
+	}
+	// an idle bucket fills up to the burst only
+	clock.advance(time.Hour)
+	for i, want := range []bool{false, false, true} {
+		if err := do("svc.bulk"); limited(err) != want || !want && err != nil {
+			t.Fatalf("after idling, request %d: got %v", i, err)
+		}
+	}
+}
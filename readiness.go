@@ -0,0 +1,139 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// WithQueueGroup subscribes to the request subjects in the named queue
+// group, so each request goes to one server of the group instead of all.
+// The admin subject is never subscribed in a group.
+func WithQueueGroup(name string) ServerOption {
+	return func(s *Server) {
+		s.queueGroup = name
+	}
+}
+
+// WithReadinessCheck runs check every interval and takes the server out of
+// rotation while it fails, e.g. when the upstream is unreachable or a
+// circuit breaker is open. See SetReady.
+func WithReadinessCheck(check func() error, interval time.Duration) ServerOption {
+	return func(s *Server) {
+		s.readiness.check = check
+		s.readiness.interval = interval
+	}
+}
+
+// SetReady marks the server ready or not, e.g. before draining it for a
+// deploy. The server is ready when it is marked ready, which it is from the
+// start, and its readiness check, if any, last passed.
+//
+// An unready server drains its request subscriptions: requests already
+// delivered are still served, new ones go to the other members of its queue
+// group, or get no responders without one. Once ready again it subscribes
+// anew. The admin subject stays subscribed throughout.
+func (s *Server) SetReady(ready bool) {
+	s.readiness.mu.Lock()
+	s.readiness.notReady = !ready
+	s.readiness.mu.Unlock()
+	s.updateReadiness()
+}
+
+// Ready reports whether the server is taking requests.
+func (s *Server) Ready() bool {
+	s.readiness.mu.Lock()
+	defer s.readiness.mu.Unlock()
+	return !s.readiness.notReady && s.readiness.checkErr == nil
+}
+
+type readiness struct {
+	check    func() error
+	interval time.Duration
+	stop     chan struct{}
+
+	mu       sync.Mutex
+	notReady bool
+	checkErr error
+	// subscribed is whether the request subscriptions are up.
+	subscribed bool
+	handle     nats.MsgHandler
+}
+
+// startReadiness records how to subscribe again and starts the readiness
+// check.
+func (s *Server) startReadiness(handle nats.MsgHandler) {
+	r := &s.readiness
+	r.mu.Lock()
+	r.handle = handle
+	r.subscribed = true
+	r.mu.Unlock()
+	if r.check == nil || r.interval <= 0 {
+		s.updateReadiness()
+		return
+	}
+	r.stop = make(chan struct{})
+	go func() {
+		timer := s.clock.NewTimer(r.interval)
+		defer timer.Stop()
+		for {
+			err := r.check()
+			r.mu.Lock()
+			r.checkErr = err
+			r.mu.Unlock()
+			s.updateReadiness()
+			select {
+			case <-timer.C():
+				timer.Reset(r.interval)
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *Server) stopReadiness() {
+	if s.readiness.stop != nil {
+		close(s.readiness.stop)
+	}
+}
+
+// updateReadiness brings the request subscriptions in line with the
+// server's readiness.
+func (s *Server) updateReadiness() {
+	r := &s.readiness
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ready := !r.notReady && r.checkErr == nil
+	if r.handle == nil || ready == r.subscribed {
+		return
+	}
+	if ready {
+		if err := s.subscribeRequests(r.handle); err != nil {
+			s.logger.Error("resubscribing after becoming ready", "error", err)
+			return
+		}
+		s.logger.Info("server ready", "subject", s.cfg.Subject)
+	} else {
+		s.drainRequests()
+		s.logger.Info("server not ready", "subject", s.cfg.Subject, "error", r.checkErr)
+	}
+	r.subscribed = ready
+}
+
+// drainRequests drains and forgets the request subscriptions, leaving the
+// admin subscription alone.
+func (s *Server) drainRequests() {
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+	kept := s.subs[:0]
+	for _, sub := range s.subs {
+		if s.cfg.AdminSubject != "" && sub.Subject == s.cfg.AdminSubject {
+			kept = append(kept, sub)
+			continue
+		}
+		sub.Drain()
+	}
+	s.subs = kept
+}
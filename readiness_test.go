@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	nc := runNATS(t)
+	clock := newFakeClock()
+	var healthy atomic.Bool
+	healthy.Store(true)
+	check := func() error {
+		if !healthy.Load() {
+			return errors.New("upstream unreachable")
+		}
+		return nil
+	}
+	named := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, name) })
+	}
+	a := NewServer(nc, "svc", WithHandler(named("a")), WithQueueGroup("svc"), WithServerClock(clock), WithReadinessCheck(check, time.Second))
+	b := NewServer(nc, "svc", WithHandler(named("b")), WithQueueGroup("svc"))
+	for _, s := range []*Server{a, b} {
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+	}
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second)
+	// servedBy sends n requests and counts who served them
+	servedBy := func(n int) map[string]int {
+		t.Helper()
+		if err := nc.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		served := map[string]int{}
+		for range n {
+			req, _ := http.NewRequest("GET", "http://svc/", nil)
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			served[string(body)]++
+		}
+		return served
+	}
+	if served := servedBy(50); served["a"] == 0 || served["b"] == 0 {
+		t.Fatalf("queue group not shared: %v", served)
+	}
+
+	a.SetReady(false)
+	if served := servedBy(50); served["a"] != 0 || a.Ready() {
+		t.Fatalf("unready instance served %d requests", served["a"])
+	}
+	a.SetReady(true)
+	if served := servedBy(50); served["a"] == 0 {
+		t.Fatalf("ready instance got no requests: %v", served)
+	}
+
+	// a failing check takes the instance out as well, until it passes
+	clock.waitFor(t, 1)
+	healthy.Store(false)
+	clock.advance(time.Second)
+	waitSubscribed(t, a, false)
+	if served := servedBy(50); served["a"] != 0 {
+		t.Fatalf("instance failing its check served %d requests", served["a"])
+	}
+	clock.waitFor(t, 1)
+	healthy.Store(true)
+	clock.advance(time.Second)
+	waitSubscribed(t, a, true)
+	if served := servedBy(50); served["a"] == 0 {
+		t.Fatalf("recovered instance got no requests: %v", served)
+	}
+}
+
+// waitSubscribed waits for the readiness check to bring s's request
+// subscriptions up or down.
+func waitSubscribed(t *testing.T, s *Server, subscribed bool) {
+	t.Helper()
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		s.readiness.mu.Lock()
+		done := s.readiness.subscribed == subscribed
+		s.readiness.mu.Unlock()
+		if done {
+			return
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("subscribed is not %v", subscribed)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import "github.com/nats-io/nats.go"
+
+// ReplyPolicy decides what the server does with replies while its NATS
+// connection is down.
+type ReplyPolicy int
+
+const (
+	// ReplyBuffer hands replies to the connection as usual, which holds
+	// them in its reconnect buffer and flushes them once it is back. The
+	// default. Replies to clients that are still waiting get through if
+	// their own connection is back first, but those whose clients timed
+	// out during the outage go to dead inboxes, and a long outage fills the
+	// buffer (nats.ReconnectBufSize), after which publishing fails.
+	ReplyBuffer ReplyPolicy = iota
+	// ReplyDrop fails fast: replies are dropped with a logged error while
+	// the connection is down. Nothing stale is delivered and no buffer
+	// fills up, but a client that would still have waited sees a timeout,
+	// although the upstream did get the request.
+	ReplyDrop
+)
+
+// WithReconnectReplyPolicy sets what happens to replies published while the
+// connection is reconnecting. It covers complete replies and error
+// envelopes; streamed responses are paced by the client's acks, which
+// don't arrive during an outage either.
+func WithReconnectReplyPolicy(policy ReplyPolicy) ServerOption {
+	return func(s *Server) {
+		s.reconnectReplies = policy
+	}
+}
+
+// sendReply publishes a reply according to the reconnect reply policy.
+func (s *Server) sendReply(msg *nats.Msg) error {
+	if s.reconnectReplies == ReplyDrop && !s.nc.IsConnected() {
+		s.logger.Error("dropping reply while disconnected", "subject", msg.Subject, "status", s.nc.Status().String())
+		return nil
+	}
+	return s.nc.PublishMsg(msg)
+}
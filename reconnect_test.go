@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func TestReconnectReplyPolicy(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		policy    ReplyPolicy
+		bufSize   int
+		delivered bool
+		log       string
+	}{
+		{"buffer", ReplyBuffer, 0, true, ""},
+		{"drop", ReplyDrop, 0, false, "dropping reply while disconnected"},
+		// without a reconnect buffer publishing fails, which is logged
+		{"buffer unavailable", ReplyBuffer, -1, false, "failed to publish reply"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			// the NATS server restarts on the same port
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			port := l.Addr().(*net.TCPAddr).Port
+			l.Close()
+			start := func() *server.Server {
+				ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: port, NoLog: true, NoSigs: true})
+				if err != nil {
+					t.Fatal(err)
+				}
+				go ns.Start()
+				if !ns.ReadyForConnections(5 * time.Second) {
+					t.Fatal("nats server not ready")
+				}
+				return ns
+			}
+			ns := start()
+			connect := func(opts ...nats.Option) *nats.Conn {
+				opts = append(opts, nats.MaxReconnects(-1), nats.ReconnectJitter(0, 0))
+				nc, err := nats.Connect(ns.ClientURL(), opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(nc.Close)
+				return nc
+			}
+			// the client is back well before the server flushes its reply
+			serverConn := connect(nats.ReconnectWait(500*time.Millisecond), nats.ReconnectBufSize(c.bufSize))
+			clientConn := connect(nats.ReconnectWait(10 * time.Millisecond))
+
+			var logs syncBuffer
+			entered, release := make(chan struct{}), make(chan struct{})
+			s := NewServer(serverConn, "svc",
+				WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+				WithReconnectReplyPolicy(c.policy),
+				WithHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					close(entered)
+					<-release
+					io.WriteString(w, "late")
+				})))
+			if err := s.Start(); err != nil {
+				t.Fatal(err)
+			}
+			serverConn.Flush()
+
+			tr := NewNATSHTTPTransport(clientConn, "svc", "", 2*time.Second)
+			done := make(chan error, 1)
+			go func() {
+				req, _ := http.NewRequest("GET", "http://svc/", nil)
+				resp, err := tr.RoundTrip(req)
+				if err == nil {
+					resp.Body.Close()
+				}
+				done <- err
+			}()
+			<-entered
+			ns.Shutdown()
+			for serverConn.IsConnected() {
+				time.Sleep(5 * time.Millisecond)
+			}
+			// the reply is sent during the outage
+			close(release)
+			time.Sleep(100 * time.Millisecond)
+			ns = start()
+			t.Cleanup(ns.Shutdown)
+			// close the server while it can still reach NATS
+			t.Cleanup(func() { s.Close() })
+
+			err = <-done
+			if c.delivered && err != nil {
+				t.Fatalf("buffered reply not delivered: %v", err)
+			}
+			if !c.delivered && !errors.Is(err, nats.ErrTimeout) {
+				t.Fatalf("got %v, want a timeout", err)
+			}
+			if c.log != "" && !strings.Contains(logs.String(), c.log) {
+				t.Fatalf("log misses %q: %s", c.log, logs.String())
+			}
+			if got, want := s.Stats().FailedReplies, map[bool]uint64{true: 1}[c.bufSize < 0]; got != want {
+				t.Fatalf("%d failed replies, want %d", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HeaderNATSRedirects lists the redirects the server followed, as
+// "status URL" entries separated by commas, when the transport runs with
+// WithDebugHeaders and the server with WithRecordRedirects.
+const HeaderNATSRedirects = "X-NATS-Redirects"
+
+// RedirectHop is a redirect the server followed: URL answered with
+// StatusCode.
+type RedirectHop struct {
+	URL        string `json:"url"`
+	StatusCode int    `json:"statusCode"`
+}
+
+// WithRecordRedirects makes the server record the redirects it follows for
+// a request in the response's Redirects.
+func WithRecordRedirects() ServerOption {
+	return func(s *Server) {
+		s.recordRedirects = true
+	}
+}
+
+// WithMaxRedirects makes the server follow at most n redirects per request,
+// none with 0, and answer with the redirect response that would have been
+// the next one to follow. Without it the server follows up to 10 and fails
+// the request with 502 Bad Gateway on the 11th, like http.Client.
+func WithMaxRedirects(n int) ServerOption {
+	return func(s *Server) {
+		s.maxRedirects = n
+	}
+}
+
+// checkRedirects sets client's redirect policy, and with WithRecordRedirects
+// makes it append every redirect it follows to hops. The injected headers,
+// the credentials and other headers a route added, are removed from
+// redirects to another host: http.Client only does so for Authorization and
+// cookies, and a route's API key is meant for its upstream alone.
+func (s *Server) checkRedirects(client *http.Client, hops *[]RedirectHop, injected []string) {
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.URL.Host != via[0].URL.Host {
+			for _, key := range injected {
+				req.Header.Del(key)
+			}
+		}
+		if s.maxRedirects >= 0 {
+			if len(via) > s.maxRedirects {
+				return http.ErrUseLastResponse
+			}
+		} else if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		if s.recordRedirects {
+			*hops = append(*hops, RedirectHop{URL: via[len(via)-1].URL.String(), StatusCode: req.Response.StatusCode})
+		}
+		return nil
+	}
+}
+
+func formatRedirects(hops []RedirectHop) string {
+	entries := make([]string, len(hops))
+	for i, hop := range hops {
+		entries[i] = strconv.Itoa(hop.StatusCode) + " " + hop.URL
+	}
+	return strings.Join(entries, ", ")
+}
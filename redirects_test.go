@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordRedirects(t *testing.T) {
+	nc := runNATS(t)
+	mux := http.NewServeMux()
+	mux.Handle("/a", http.RedirectHandler("/b", http.StatusFound))
+	mux.Handle("/b", http.RedirectHandler("/c", http.StatusMovedPermanently))
+	mux.HandleFunc("/c", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "c") })
+	u := serveUpstream(t, nc, "svc", mux, WithRecordRedirects())
+
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithDebugHeaders())
+	resp, err := tr.RoundTrip(upstreamRequest("GET", u, "/a", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "c" {
+		t.Fatalf("got %d %q", resp.StatusCode, body)
+	}
+	want := "302 " + u.String() + "/a, 301 " + u.String() + "/b"
+	if got := resp.Header.Get(HeaderNATSRedirects); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// the envelope carries the chain for clients without debug headers too
+	tr = NewNATSHTTPTransport(nc, "svc", "", 5*time.Second)
+	natsReq, _, _ := tr.newNATSRequest(upstreamRequest("GET", u, "/a", nil), false)
+	data, _ := tr.encodeRequest(natsReq)
+	msg, err := nc.Request("svc", data, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	natsResp, err := tr.decodeReply(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(natsResp.Redirects) != 2 || natsResp.Redirects[1] != (RedirectHop{URL: u.String() + "/b", StatusCode: 301}) {
+		t.Fatalf("got %v", natsResp.Redirects)
+	}
+	if resp, _ = tr.RoundTrip(upstreamRequest("GET", u, "/a", nil)); resp.Header.Get(HeaderNATSRedirects) != "" {
+		t.Fatal("redirects header without debug headers")
+	}
+}
+
+func TestMaxRedirects(t *testing.T) {
+	// /r/n redirects to /r/n+1, up to /r/12
+	chain := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/r/"))
+		if n == 12 {
+			io.WriteString(w, "end")
+			return
+		}
+		http.Redirect(w, r, "/r/"+strconv.Itoa(n+1), http.StatusFound)
+	})
+	for _, limit := range []int{0, 2} {
+		nc := runNATS(t)
+		u := serveUpstream(t, nc, "svc", chain, WithMaxRedirects(limit))
+		tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second)
+		resp, err := tr.RoundTrip(upstreamRequest("GET", u, "/r/0", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		// the redirect that would have been followed next comes back
+		want := "/r/" + strconv.Itoa(limit+1)
+		if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != want {
+			t.Errorf("limit %d: got %d to %q, want 302 to %q", limit, resp.StatusCode, resp.Header.Get("Location"), want)
+		}
+	}
+
+	// by default the 11th redirect fails the request
+	nc := runNATS(t)
+	u := serveUpstream(t, nc, "svc", chain)
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second)
+	_, err := tr.RoundTrip(upstreamRequest("GET", u, "/r/0", nil))
+	var serr *ServerError
+	if !errors.As(err, &serr) || serr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("default: got %v, want 502", err)
+	}
+	resp, err := tr.RoundTrip(upstreamRequest("GET", u, "/r/3", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "end" {
+		t.Fatalf("9 redirects: got %d %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// WithReplyBatching holds replies back and publishes them together, once
+// size are pending or delay after the first of them, whichever comes first.
+// Only complete responses in a single message are batched; error envelopes,
+// streamed responses and everything sent ahead of a reply go out at once.
+//
+// Every batched reply waits up to delay longer, which is all it costs. What
+// it buys depends on the load: the NATS client already writes messages
+// published in quick succession to the socket together, so at moderate rates
+// batching changes little, and it helps most when many small replies are
+// published from many goroutines at once. BenchmarkReplyBatching compares
+// both for concurrent clients of an in-process handler, but measure with the
+// real load before turning it on. Close publishes what is pending.
+func WithReplyBatching(size int, delay time.Duration) ServerOption {
+	return func(s *Server) {
+		s.replyBatcher = &replyBatcher{size: max(size, 1), delay: delay}
+	}
+}
+
+type replyBatcher struct {
+	size  int
+	delay time.Duration
+	send  func(*nats.Msg) error
+	log   *slog.Logger
+	clock Clock
+
+	mu      sync.Mutex
+	pending []*nats.Msg
+	timer   Timer
+}
+
+func (b *replyBatcher) add(msg *nats.Msg) {
+	b.mu.Lock()
+	b.pending = append(b.pending, msg)
+	if len(b.pending) < b.size {
+		if b.timer == nil {
+			b.timer = b.clock.AfterFunc(b.delay, b.flush)
+		}
+		b.mu.Unlock()
+		return
+	}
+	batch := b.take()
+	b.mu.Unlock()
+	b.publish(batch)
+}
+
+// flush publishes the pending replies.
+func (b *replyBatcher) flush() {
+	b.mu.Lock()
+	batch := b.take()
+	b.mu.Unlock()
+	b.publish(batch)
+}
+
+// take returns the pending replies and stops the timer. b.mu must be held.
+func (b *replyBatcher) take() []*nats.Msg {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	batch := b.pending
+	b.pending = nil
+	return batch
+}
+
+func (b *replyBatcher) publish(batch []*nats.Msg) {
+	for _, msg := range batch {
+		if err := b.send(msg); err != nil {
+			b.log.Error("publishing batched reply", "subject", msg.Subject, "error", err)
+		}
+	}
+}
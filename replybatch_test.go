@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echoPath answers with the request path.
+var echoPath = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, r.URL.Path)
+})
+
+func TestReplyBatching(t *testing.T) {
+	nc := runNATS(t)
+	tr := serveHandler(t, nc, "svc", echoPath, WithMaxConcurrency(64), WithReplyBatching(16, time.Millisecond))
+	var wg sync.WaitGroup
+	for g := range 32 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 50 {
+				path := fmt.Sprintf("/%d/%d", g, i)
+				req, _ := http.NewRequest("GET", "http://svc"+path, nil)
+				resp, err := tr.RoundTrip(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if string(body) != path {
+					t.Errorf("request for %s got the reply for %s", path, body)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// a lone reply goes out once the delay passed
+	req, _ := http.NewRequest("GET", "http://svc/lone", nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+// BenchmarkReplyBatching compares publishing every reply directly with
+// batching them, for many concurrent clients of an in-process handler.
+func BenchmarkReplyBatching(b *testing.B) {
+	for _, c := range []struct {
+		name string
+		opts []ServerOption
+	}{
+		{"direct", nil},
+		{"size=8/delay=100µs", []ServerOption{WithReplyBatching(8, 100*time.Microsecond)}},
+		{"size=32/delay=200µs", []ServerOption{WithReplyBatching(32, 200*time.Microsecond)}},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			nc := runNATS(b)
+			tr := serveHandler(b, nc, "svc", echoPath, append([]ServerOption{WithMaxConcurrency(256)}, c.opts...)...)
+			b.SetParallelism(32)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					req, _ := http.NewRequest("GET", "http://svc/p", nil)
+					resp, err := tr.RoundTrip(req)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					resp.Body.Close()
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// HeaderNATSProbe marks a responder probe sent by CheckResponders. Servers
+// answer it directly without touching any upstream.
+const HeaderNATSProbe = "Nats-Http-Probe"
+
+// defaultProbeWindow is how long CheckResponders collects answers when the
+// context has no deadline of its own.
+const defaultProbeWindow = time.Second
+
+// CheckResponders probes the request subject and reports how many servers
+// answered before ctx expired, or within a second if ctx has no deadline.
+//
+// When nobody is subscribed the NATS server says so right away and
+// CheckResponders returns ErrNoResponders without waiting. Servers that
+// are subscribed but too slow to answer within the window are not counted;
+// if none answered in time the context error is returned instead. Servers in
+// a queue group answer once per group, not once per member.
+func (t *NATSHTTPTransport) CheckResponders(ctx context.Context) (int, error) {
+	if t.configErr != nil {
+		return 0, t.configErr
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultProbeWindow)
+		defer cancel()
+	}
+	inbox := t.newInbox()
+	sub, err := t.nc.SubscribeSync(inbox)
+	if err != nil {
+		return 0, err
+	}
+	defer sub.Unsubscribe()
+
+	probe := nats.NewMsg(t.subjectReq)
+	probe.Reply = inbox
+	probe.Header.Set(HeaderNATSProbe, "1")
+	if err := t.nc.PublishMsg(probe); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			if count > 0 && ctx.Err() != nil {
+				return count, nil
+			}
+			return count, requestError(t.nc, err)
+		}
+		if len(msg.Data) == 0 && msg.Header.Get("Status") == "503" {
+			return 0, ErrNoResponders
+		}
+		count++
+	}
+}
+
+// answerProbe replies to a CheckResponders probe and reports whether msg was
+// one.
+func (s *Server) answerProbe(msg *nats.Msg) bool {
+	if msg.Header.Get(HeaderNATSProbe) == "" {
+		return false
+	}
+	s.nc.Publish(msg.Reply, []byte("{}"))
+	return true
+}
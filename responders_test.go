@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestCheckResponders(t *testing.T) {
+	nc := runNATS(t)
+	var calls atomic.Int32
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { calls.Add(1) })
+	serveHandler(t, nc, "svc", h)
+	serveHandler(t, nc, "svc", h)
+	serveHandler(t, nc, "svc", h, WithQueueGroup("group"))
+	serveHandler(t, nc, "svc", h, WithQueueGroup("group"))
+	// subscribed, but never answers
+	nc.Subscribe("slow", func(*nats.Msg) {})
+
+	probe := func(subject string, timeout time.Duration) (int, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return NewNATSHTTPTransport(nc, subject, "", 5*time.Second).CheckResponders(ctx)
+	}
+	if n, err := probe("svc", 300*time.Millisecond); err != nil || n != 3 {
+		t.Fatalf("got %d, %v, want 3 responders", n, err)
+	}
+	if n := calls.Load(); n != 0 {
+		t.Fatalf("probes reached the upstream %d times", n)
+	}
+
+	start := time.Now()
+	if _, err := probe("nobody", 5*time.Second); !errors.Is(err, ErrNoResponders) || time.Since(start) > time.Second {
+		t.Fatalf("got %v after %s, want no responders right away", err, time.Since(start))
+	}
+	if n, err := probe("slow", 100*time.Millisecond); n != 0 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %d, %v, want the context error", n, err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Route configures requests arriving on a subject of their own. The server
+// subscribes every route's subject next to its main one and handles
+// requests on it like any other, plus the route's settings.
+type Route struct {
+	Subject string
+	// Headers are added to every upstream request of the route, e.g. a
+	// backend API key the clients never see. Client headers of the same
+	// name win unless OverrideHeaders is set. Redirects to another host
+	// go without them, and without Auth's header.
+	Headers         map[string]string
+	OverrideHeaders bool
+	// Auth supplies the credential for every upstream request of the
+	// route, see UpstreamAuth.
+	Auth UpstreamAuth
+}
+
+// UpstreamAuth returns the header carrying a credential for the upstream
+// and its value, e.g. "Authorization" and "Bearer ...". It is called for
+// every upstream request, so it can hand out refreshed tokens; see
+// RefreshingAuth. The header replaces any the client sent and is left out
+// of mirrored requests, so clients and mirrors never see it. An error fails
+// the request with 502 Bad Gateway.
+type UpstreamAuth func() (header, value string, err error)
+
+// WithUpstreamAuth sets the credential for upstream requests on the
+// server's main subject. Use Route.Auth for other routes.
+func WithUpstreamAuth(auth UpstreamAuth) ServerOption {
+	return func(s *Server) {
+		if s.routes == nil {
+			s.routes = make(map[string]*Route)
+		}
+		if s.routes[s.cfg.Subject] == nil {
+			s.routes[s.cfg.Subject] = &Route{Subject: s.cfg.Subject}
+		}
+		s.routes[s.cfg.Subject].Auth = auth
+	}
+}
+
+// AuthorizationMode says what happens to the Authorization header clients
+// send, see WithAuthorizationForwarding.
+type AuthorizationMode int
+
+const (
+	// AuthorizationForward passes the client's header to the upstream as
+	// it is, unless the route's own credentials replace it. The default.
+	AuthorizationForward AuthorizationMode = iota
+	// AuthorizationStrip removes the client's header, so the upstream only
+	// gets credentials the route configures, if any.
+	AuthorizationStrip
+	// AuthorizationReplace removes the client's header and requires the
+	// route to supply one, through an Auth returning an Authorization
+	// header or an Authorization entry in Headers. Requests on a route without are answered with 502 Bad
+	// Gateway rather than sent without credentials.
+	AuthorizationReplace
+)
+
+// WithAuthorizationForwarding sets what happens to the Authorization header
+// of client requests at the proxy boundary. Stripping keeps client
+// credentials, e.g. for the gateway in front of the clients, from leaking to
+// upstreams; replacing additionally makes sure every upstream request
+// carries the server's.
+func WithAuthorizationForwarding(mode AuthorizationMode) ServerOption {
+	return func(s *Server) {
+		s.authForwarding = mode
+	}
+}
+
+// mayHaveCredentials reports whether the route may supply an Authorization
+// header. Whether Auth does is only known once it is called.
+func (r *Route) mayHaveCredentials() bool {
+	if r == nil {
+		return false
+	}
+	if r.Auth != nil {
+		return true
+	}
+	for key := range r.Headers {
+		if http.CanonicalHeaderKey(key) == "Authorization" {
+			return true
+		}
+	}
+	return false
+}
+
+// RefreshingAuth caches the credential fetch returns until it expires on
+// clock, the real one if nil, and fetches a new one for the first request
+// after that. Requests arriving during a fetch wait for it instead of
+// fetching too.
+func RefreshingAuth(clock Clock, fetch func() (header, value string, expires time.Time, err error)) UpstreamAuth {
+	if clock == nil {
+		clock = realClock{}
+	}
+	var mu sync.Mutex
+	var header, value string
+	var expires time.Time
+	return func() (string, string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if header == "" || !clock.Now().Before(expires) {
+			h, v, e, err := fetch()
+			if err != nil {
+				return "", "", err
+			}
+			header, value, expires = h, v, e
+		}
+		return header, value, nil
+	}
+}
+
+// WithRoutes adds routes to the server. A route for the server's main
+// subject configures that subject, and subjects may contain wildcards.
+// Routes given for the same subject more than once, including through
+// WithUpstreamAuth, are merged: headers are combined and Auth is kept
+// unless replaced, later settings winning, and OverrideHeaders stays on
+// once set.
+func WithRoutes(routes ...Route) ServerOption {
+	return func(s *Server) {
+		if s.routes == nil {
+			s.routes = make(map[string]*Route)
+		}
+		for _, r := range routes {
+			if prev := s.routes[r.Subject]; prev != nil {
+				r = prev.merge(r)
+			}
+			s.routes[r.Subject] = &r
+		}
+	}
+}
+
+// merge returns r with the settings of next added.
+func (r Route) merge(next Route) Route {
+	headers := make(map[string]string, len(r.Headers)+len(next.Headers))
+	maps.Copy(headers, r.Headers)
+	maps.Copy(headers, next.Headers)
+	r.Headers = headers
+	r.OverrideHeaders = r.OverrideHeaders || next.OverrideHeaders
+	if next.Auth != nil {
+		r.Auth = next.Auth
+	}
+	return r
+}
+
+// route returns the route of the subject msg arrived on, which is the one
+// the server subscribed with, wildcards included.
+func (s *Server) route(msg *nats.Msg) *Route {
+	if msg.Sub != nil {
+		if r, ok := s.routes[msg.Sub.Subject]; ok {
+			return r
+		}
+	}
+	return s.routes[msg.Subject]
+}
+
+// applyRoute adds the route's headers to an upstream request and returns
+// the names of those it set.
+func (r *Route) applyRoute(req *http.Request) []string {
+	var set []string
+	for key, value := range r.Headers {
+		if r.OverrideHeaders || req.Header.Get(key) == "" {
+			req.Header.Set(key, value)
+			set = append(set, key)
+		}
+	}
+	return set
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRoutes(t *testing.T) {
+	nc := runNATS(t)
+	// the handler shows what reached the upstream
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"key":    r.Header.Get("X-Api-Key"),
+			"auth":   r.Header.Get("Authorization"),
+			"tenant": r.Header.Get("X-Tenant"),
+		})
+	})
+	auth := func() (string, string, error) { return "Authorization", "Bearer main", nil }
+	serveHandler(t, nc, "svc", h,
+		WithUpstreamAuth(auth),
+		WithRoutes(
+			Route{Subject: "svc", Headers: map[string]string{"X-Api-Key": "main-key"}},
+			Route{Subject: "svc.tenant.*", Headers: map[string]string{"X-Api-Key": "tenant-key", "X-Tenant": "default"}},
+			Route{Subject: "svc.tenant.*", Headers: map[string]string{"X-Tenant": "routed"}},
+		))
+
+	for _, c := range []struct {
+		subject string
+		header  http.Header
+		want    map[string]string
+	}{
+		// the route set after WithUpstreamAuth keeps its Auth
+		{"svc", nil, map[string]string{"key": "main-key", "auth": "Bearer main", "tenant": ""}},
+		// wildcard routes apply to every subject they match, merged
+		{"svc.tenant.a", nil, map[string]string{"key": "tenant-key", "auth": "", "tenant": "routed"}},
+		// client headers win without OverrideHeaders
+		{"svc.tenant.b", http.Header{"X-Tenant": {"client"}}, map[string]string{"key": "tenant-key", "auth": "", "tenant": "client"}},
+	} {
+		tr := NewNATSHTTPTransport(nc, c.subject, "", 5*time.Second)
+		req, _ := http.NewRequest("GET", "http://svc/", nil)
+		for key, values := range c.header {
+			req.Header[key] = values
+		}
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: %v", c.subject, err)
+		}
+		var got map[string]string
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		for key, want := range c.want {
+			if got[key] != want {
+				t.Errorf("%s: upstream got %s %q, want %q", c.subject, key, got[key], want)
+			}
+		}
+		// the injected headers stay on the server
+		if resp.Header.Get("X-Api-Key") != "" || req.Header.Get("X-Api-Key") != "" {
+			t.Errorf("%s: API key exposed to the client", c.subject)
+		}
+	}
+}
+
+func TestAuthorizationForwarding(t *testing.T) {
+	bearer := func() (string, string, error) { return "Authorization", "Bearer server", nil }
+	apiKey := func() (string, string, error) { return "X-Api-Key", "server", nil }
+	for _, c := range []struct {
+		name   string
+		mode   AuthorizationMode
+		route  *Route
+		status int
+		want   string
+	}{
+		{"forward", AuthorizationForward, nil, http.StatusOK, "Bearer client"},
+		{"strip", AuthorizationStrip, nil, http.StatusOK, ""},
+		{"replace with auth", AuthorizationReplace, &Route{Auth: bearer}, http.StatusOK, "Bearer server"},
+		{"replace with header", AuthorizationReplace, &Route{Headers: map[string]string{"authorization": "Basic c2VydmVy"}}, http.StatusOK, "Basic c2VydmVy"},
+		{"replace without credentials", AuthorizationReplace, nil, http.StatusBadGateway, ""},
+		{"replace with other header", AuthorizationReplace, &Route{Auth: apiKey}, http.StatusBadGateway, ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			nc := runNATS(t)
+			opts := []ServerOption{WithAuthorizationForwarding(c.mode)}
+			if c.route != nil {
+				c.route.Subject = "svc"
+				opts = append(opts, WithRoutes(*c.route))
+			}
+			tr := serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(r.Header.Get("Authorization")))
+			}), opts...)
+
+			req, _ := http.NewRequest("GET", "http://svc/", nil)
+			req.Header.Set("Authorization", "Bearer client")
+			resp, err := tr.RoundTrip(req)
+			var serr *ServerError
+			if c.status != http.StatusOK {
+				if !errors.As(err, &serr) || serr.StatusCode != c.status {
+					t.Fatalf("got %v, want %d", err, c.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != c.want {
+				t.Fatalf("upstream got Authorization %q, want %q", body, c.want)
+			}
+		})
+	}
+}
+
+func TestRouteHeadersOnRedirect(t *testing.T) {
+	nc := runNATS(t)
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Api-Key")+","+r.Header.Get("X-Token"))
+	}
+	other := httptest.NewServer(http.HandlerFunc(echo))
+	t.Cleanup(other.Close)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", echo)
+	mux.Handle("/same", http.RedirectHandler("/echo", http.StatusFound))
+	mux.Handle("/away", http.RedirectHandler(other.URL+"/echo", http.StatusFound))
+	token := func() (string, string, error) { return "X-Token", "secret-token", nil }
+	u := serveUpstream(t, nc, "svc", mux, WithRoutes(Route{Subject: "svc", Headers: map[string]string{"X-Api-Key": "secret-key"}, Auth: token}))
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second)
+
+	for path, want := range map[string]string{
+		"/same": "secret-key,secret-token",
+		// another host never sees the route's credentials
+		"/away": ",",
+	} {
+		resp, err := tr.RoundTrip(upstreamRequest("GET", u, path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != want {
+			t.Errorf("%s: upstream got %q, want %q", path, body, want)
+		}
+	}
+}
+
+func TestRouteServerCache(t *testing.T) {
+	nc := runNATS(t)
+	var hits atomic.Int32
+	u := serveUpstream(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, r.Header.Get("X-Api-Key"))
+	}), WithServerCache(NewMemoryCache(10)), WithRoutes(
+		Route{Subject: "svc.a", Headers: map[string]string{"X-Api-Key": "a"}},
+		Route{Subject: "svc.b", Headers: map[string]string{"X-Api-Key": "b"}},
+	))
+
+	// each route gets the response to its own credentials, and its own
+	// entry for the next request
+	for _, subject := range []string{"svc.a", "svc.b", "svc.a", "svc.b"} {
+		tr := NewNATSHTTPTransport(nc, subject, "", 5*time.Second)
+		resp, err := tr.RoundTrip(upstreamRequest("GET", u, "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if want := subject[len("svc."):]; string(body) != want {
+			t.Fatalf("%s: got %q, want %q", subject, body, want)
+		}
+	}
+	if hits.Load() != 2 {
+		t.Fatalf("upstream hit %d times, want 2", hits.Load())
+	}
+}
+
+func TestRouteBearerToken(t *testing.T) {
+	nc := runNATS(t)
+	clock := newFakeClock()
+	var fetches atomic.Int32
+	auth := RefreshingAuth(clock, func() (string, string, time.Time, error) {
+		n := fetches.Add(1)
+		return "Authorization", fmt.Sprintf("Bearer token-%d", n), clock.Now().Add(time.Minute), nil
+	})
+	serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("Authorization"))
+	}), WithRoutes(Route{Subject: "svc.billing", Auth: auth}))
+
+	do := func(subject string) (string, http.Header) {
+		t.Helper()
+		tr := NewNATSHTTPTransport(nc, subject, "", 5*time.Second)
+		req, _ := http.NewRequest("GET", "http://svc/", nil)
+		req.Header.Set("Authorization", "Bearer client")
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(body), resp.Header
+	}
+	for _, c := range []struct {
+		advance time.Duration
+		want    string
+		fetches int32
+	}{
+		{0, "Bearer token-1", 1},
+		{30 * time.Second, "Bearer token-1", 1},
+		// expired, so the provider is asked again
+		{30 * time.Second, "Bearer token-2", 2},
+	} {
+		clock.advance(c.advance)
+		got, header := do("svc.billing")
+		if got != c.want || fetches.Load() != c.fetches {
+			t.Fatalf("upstream got %q after %d fetches, want %q after %d", got, fetches.Load(), c.want, c.fetches)
+		}
+		if header.Get("Authorization") != "" {
+			t.Fatal("token exposed to the client")
+		}
+	}
+	// other subjects keep the client's credentials
+	if got, _ := do("svc"); got != "Bearer client" {
+		t.Fatalf("main subject sent %q", got)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+)
+
+// WithStickyRouting sends requests carrying header to one of subjects
+// chosen by the header's value, so all requests of a session reach the same
+// server instance, e.g. each instance subscribing its own subject besides
+// the shared one. Requests without the header use the transport's subject.
+//
+// Subjects are picked by rendezvous hashing: adding or removing a subject
+// only moves the sessions that hashed to it. Pinning is best effort. A
+// session moves when its subject disappears, and requests fail with no
+// responders while nobody subscribes it.
+func WithStickyRouting(header string, subjects ...string) Option {
+	return func(t *NATSHTTPTransport) {
+		t.stickyHeader = http.CanonicalHeaderKey(header)
+		t.stickySubjects = subjects
+	}
+}
+
+// WithLargeBodySubject sends requests with bodies of more than threshold
+// bytes, or of unknown length, to subject instead of the transport's
+// subject, so heavy uploads can be served by dedicated servers. This takes
+// precedence over WithStickyRouting. Only where the request message goes
+// changes: streamed and object store bodies still travel the way the server
+// on subject asks for, so it needs the same streaming and object store
+// options as the others.
+func WithLargeBodySubject(threshold int64, subject string) Option {
+	return func(t *NATSHTTPTransport) {
+		t.largeBodyThreshold = threshold
+		t.largeBodySubject = subject
+	}
+}
+
+// WithPrioritySubject sends requests of priority min or higher, by
+// HeaderNATSPriority or ContextWithPriority, to subject instead of the
+// transport's subject. It takes precedence over WithStickyRouting, but not
+// over WithLargeBodySubject.
+//
+// The convention is a subject per class next to each other: http.normal as
+// the transport's subject, and http.high given here with PriorityHigh.
+// Servers with capacity reserved for urgent work
+// subscribe http.high only, so normal load can never crowd it out; the rest
+// of the fleet subscribes http.normal. Nobody subscribing http.high makes
+// high priority requests fail with no responders rather than fall back.
+func WithPrioritySubject(min Priority, subject string) Option {
+	return func(t *NATSHTTPTransport) {
+		t.priorityMin = min
+		t.prioritySubject = subject
+	}
+}
+
+// subjectFor returns the subject to send natsReq to.
+func (t *NATSHTTPTransport) subjectFor(natsReq *NATSHTTPRequest) string {
+	if t.largeBodySubject != "" && (natsReq.bodySize < 0 || natsReq.bodySize > t.largeBodyThreshold) {
+		return t.largeBodySubject
+	}
+	if t.prioritySubject != "" {
+		value := natsReq.Header[HeaderNATSPriority]
+		if value == "" {
+			value = natsReq.promoted[HeaderNATSPriority]
+		}
+		if parsePriority(value) >= t.priorityMin {
+			return t.prioritySubject
+		}
+	}
+	key := natsReq.Header[t.stickyHeader]
+	if key == "" {
+		// the header may have been promoted to a NATS header
+		key = natsReq.promoted[t.stickyHeader]
+	}
+	if len(t.stickySubjects) == 0 || key == "" {
+		return t.subjectReq
+	}
+	var best string
+	var bestWeight uint64
+	for _, subject := range t.stickySubjects {
+		h := fnv.New64a()
+		h.Write([]byte(subject))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if w := mix64(h.Sum64()); best == "" || w > bestWeight {
+			best, bestWeight = subject, w
+		}
+	}
+	return best
+}
+
+// mix64 is the MurmurHash3 finalizer. FNV alone barely mixes its last bytes
+// into the high bits, so without it a single subject wins most comparisons.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// servedBy answers with name and the size of the request body.
+func servedBy(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		io.WriteString(w, name+" "+strconv.FormatInt(n, 10))
+	})
+}
+
+func TestLargeBodySubject(t *testing.T) {
+	nc := runNATS(t, func(o *server.Options) { o.MaxPayload = 8 << 20 })
+	serveHandler(t, nc, "svc", servedBy("normal"))
+	serveHandler(t, nc, "svc.large", servedBy("large"))
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithLargeBodySubject(1<<20, "svc.large"))
+
+	for _, c := range []struct {
+		name string
+		body io.Reader
+		want string
+	}{
+		{"small", bytes.NewReader(make([]byte, 1024)), "normal 1024"},
+		{"2MB", bytes.NewReader(make([]byte, 2<<20)), "large 2097152"},
+		// bodies without a Content-Length are measured once read
+		{"small, unknown length", io.MultiReader(bytes.NewReader(make([]byte, 10))), "normal 10"},
+		{"2MB, unknown length", io.MultiReader(bytes.NewReader(make([]byte, 2<<20))), "large 2097152"},
+	} {
+		req, _ := http.NewRequest("POST", "http://svc/upload", c.body)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, body, c.want)
+		}
+	}
+}
+
+func TestPrioritySubject(t *testing.T) {
+	nc := runNATS(t)
+	serveHandler(t, nc, "http.normal", servedBy("normal"))
+	serveHandler(t, nc, "http.high", servedBy("high"))
+	tr := NewNATSHTTPTransport(nc, "http.normal", "", 5*time.Second, WithPrioritySubject(PriorityHigh, "http.high"))
+
+	for _, c := range []struct {
+		header string
+		ctx    Priority
+		want   string
+	}{
+		{"", PriorityNormal, "normal 0"},
+		{"low", PriorityNormal, "normal 0"},
+		{"high", PriorityNormal, "high 0"},
+		{"critical", PriorityNormal, "high 0"},
+		{"", PriorityHigh, "high 0"},
+	} {
+		req, _ := http.NewRequestWithContext(ContextWithPriority(context.Background(), c.ctx), "GET", "http://svc/", nil)
+		if c.header != "" {
+			req.Header.Set(HeaderNATSPriority, c.header)
+		}
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != c.want {
+			t.Errorf("header %q, context %v: served by %q, want %q", c.header, c.ctx, body, c.want)
+		}
+	}
+}
+
+func TestStickyRouting(t *testing.T) {
+	nc := runNATS(t)
+	serveHandler(t, nc, "svc", servedBy("shared"))
+	for _, name := range []string{"a", "b", "c"} {
+		serveHandler(t, nc, "svc."+name, servedBy(name))
+	}
+	send := func(tr *NATSHTTPTransport, session string) string {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "http://svc/", nil)
+		if session != "" {
+			req.Header.Set("X-Session", session)
+		}
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithStickyRouting("x-session", "svc.a", "svc.b", "svc.c"))
+	// without c, only the sessions pinned to it move
+	fewer := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithStickyRouting("X-Session", "svc.a", "svc.b"))
+
+	if got := send(tr, ""); got != "shared 0" {
+		t.Fatalf("request without a session served by %q", got)
+	}
+	used := make(map[string]bool)
+	for i := range 30 {
+		session := "session-" + strconv.Itoa(i)
+		first := send(tr, session)
+		if again := send(tr, session); again != first {
+			t.Fatalf("%s moved from %q to %q", session, first, again)
+		}
+		if moved := send(fewer, session); first != "c 0" && moved != first {
+			t.Fatalf("%s moved from %q to %q when c went away", session, first, moved)
+		}
+		used[first] = true
+	}
+	if len(used) != 3 || used["shared 0"] {
+		t.Fatalf("sessions spread over %v", used)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RTT measures the round trip to the NATS server the transport is connected
+// to. It covers the NATS link only, not a server or its upstream, so a slow
+// request with a low RTT points at the far side of the request subject.
+func (t *NATSHTTPTransport) RTT() (time.Duration, error) {
+	rtt, err := t.nc.RTT()
+	if err != nil {
+		return 0, err
+	}
+	t.rtt.set(rtt, t.clock.Now())
+	return rtt, nil
+}
+
+// WithRTTInterval makes Stats report the NATS round trip in NATSRTT,
+// measuring it again whenever the last measurement is older than interval.
+// The measurement takes a round trip to the NATS server, so a Stats call
+// that refreshes it waits for one.
+func WithRTTInterval(interval time.Duration) Option {
+	return func(t *NATSHTTPTransport) {
+		t.rtt.interval = interval
+	}
+}
+
+// rttProbe holds the last RTT measurement.
+type rttProbe struct {
+	interval time.Duration
+
+	mu       sync.Mutex
+	last     time.Duration
+	measured time.Time
+}
+
+func (p *rttProbe) set(rtt time.Duration, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.last, p.measured = rtt, now
+}
+
+// currentRTT returns the last measurement, measuring anew first if it is
+// older than the interval. Failed measurements keep the last one.
+func (t *NATSHTTPTransport) currentRTT() time.Duration {
+	p := &t.rtt
+	p.mu.Lock()
+	stale := t.clock.Now().Sub(p.measured) >= p.interval
+	p.mu.Unlock()
+	if stale {
+		t.RTT()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.last
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTT(t *testing.T) {
+	nc := runNATS(t)
+	tr := NewNATSHTTPTransport(nc, "svc", "", time.Second, WithRTTInterval(time.Hour))
+	rtt, err := tr.RTT()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt <= 0 || rtt > time.Second {
+		t.Fatalf("implausible RTT %v to an embedded server", rtt)
+	}
+	// Stats reports the measurement until it is older than the interval
+	if got := tr.Stats().NATSRTT; got != rtt {
+		t.Fatalf("Stats reports %v, measured %v", got, rtt)
+	}
+	fresh := NewNATSHTTPTransport(nc, "svc", "", time.Second, WithRTTInterval(time.Nanosecond))
+	if got := fresh.Stats().NATSRTT; got <= 0 || got > time.Second {
+		t.Fatalf("Stats measured %v", got)
+	}
+	if got := NewNATSHTTPTransport(nc, "svc", "", time.Second).Stats().NATSRTT; got != 0 {
+		t.Fatalf("Stats reports %v without WithRTTInterval", got)
+	}
+
+	nc.Close()
+	if _, err := tr.RTT(); err == nil {
+		t.Fatal("RTT on a closed connection succeeded")
+	}
+}
@@ -0,0 +1,909 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Server answers NATSHTTPRequests published on a subject by performing them
+// against the allowed upstream hosts.
+type Server struct {
+	nc *nats.Conn
+	// cfg holds the settings Config covers. Their options set them, and
+	// the defaults are filled in once all options are applied.
+	cfg Config
+
+	priorityFunc   func(*NATSHTTPRequest) Priority
+	limiter        *priorityLimiter
+	forwardedProto bool
+
+	cors               *CORSConfig
+	routes             map[string]*Route
+	stats              statsCollector
+	auditHook          func(*NATSHTTPRequest)
+	auditRedact        []string
+	clientCompression  bool
+	deadLetter         string
+	deadLetterBodies   bool
+	configErr          error // invalid option arguments, returned by Start
+	mirror             *mirror
+	keepalive          time.Duration
+	trace              *tracer
+	recordRedirects    bool
+	maxRedirects       int
+	decodeErrors       ErrorStrategy
+	clock              Clock
+	informational      bool
+	contextKeys        []ContextKey
+	defaultContentType string
+	cache              Cache
+	queueGroup         string
+	readiness          readiness
+	binaryPayloads     func(contentType string) bool
+	uploadBudget       *uploadBudget
+	maxUploadSize      int64
+	requestBuffering   bool
+	accessLog          *accessLog
+
+	observabilityHeaders bool
+	timing               bool
+	spans                bool
+	authForwarding       AuthorizationMode
+	replyBatcher         *replyBatcher
+	tee                  *TeeConfig
+	reconnectReplies     ReplyPolicy
+	transformers         *TransformerRegistry
+	errorMapper          func(error) (int, string)
+	instanceID           string
+	stripBodies          []string
+	objectStoreBucket    string
+	promotedPrefix       string
+
+	subsMu   sync.Mutex
+	subs     []*nats.Subscription
+	inflight sync.WaitGroup
+	// started and handlers, the servers added by Handle, are guarded by
+	// subsMu too.
+	started  bool
+	handlers []*Server
+	logger   *slog.Logger
+
+	work      chan *nats.Msg
+	workersWG sync.WaitGroup
+
+	// captures collects the replies of batched requests by reply subject
+	captures sync.Map
+
+	adminNonces adminNonces
+	rateLimits  map[string]*tokenBucket
+
+	identityLimit *identityLimiter
+
+	// mu guards cfg.AllowedHosts and cfg.UpstreamTimeout, which can be
+	// changed at runtime through the admin subject.
+	mu sync.RWMutex
+}
+
+// ServerOption configures optional behaviour of a Server.
+type ServerOption func(*Server)
+
+// WithMaxConcurrency lets the server handle up to n requests at the same
+// time. Without it requests on the subscription are handled one at a time.
+func WithMaxConcurrency(n int) ServerOption {
+	return func(s *Server) {
+		s.cfg.MaxConcurrency = n
+	}
+}
+
+// WithPriorityFunc overrides how a request's priority is determined. By
+// default it is read from the X-NATS-Priority header. Priorities only matter
+// once WithMaxConcurrency is set and all slots are busy.
+func WithPriorityFunc(fn func(*NATSHTTPRequest) Priority) ServerOption {
+	return func(s *Server) {
+		s.priorityFunc = fn
+	}
+}
+
+// WithAllowedHosts replaces the default allowList of upstream hosts.
+func WithAllowedHosts(hosts ...string) ServerOption {
+	return func(s *Server) {
+		s.cfg.AllowedHosts = hosts
+	}
+}
+
+// WithAllowedMethods restricts the HTTP methods the server forwards.
+// Requests with other methods are answered with 405 Method Not Allowed and
+// an Allow header listing methods. CORS preflights answered by WithCORS are
+// not affected.
+func WithAllowedMethods(methods ...string) ServerOption {
+	return func(s *Server) {
+		s.cfg.AllowedMethods = methods
+	}
+}
+
+// WithUpstreamTimeout bounds each upstream request, see http.Client.Timeout.
+// The default of zero means no timeout.
+func WithUpstreamTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.cfg.UpstreamTimeout = d
+	}
+}
+
+// WithDefaultContentType sets the Content-Type of responses that come
+// without one. By default a missing Content-Type stays missing, also for
+// in-process handlers, whose bodies are not sniffed the way net/http does.
+func WithDefaultContentType(contentType string) ServerOption {
+	return func(s *Server) {
+		s.defaultContentType = contentType
+	}
+}
+
+// WithUpstreamTransport sets the RoundTripper used for upstream requests,
+// http.DefaultTransport by default.
+func WithUpstreamTransport(rt http.RoundTripper) ServerOption {
+	return func(s *Server) {
+		s.cfg.UpstreamTransport = rt
+	}
+}
+
+// WithLogger sets the logger used by the server, slog.Default() by default.
+func WithLogger(logger *slog.Logger) ServerOption {
+	return func(s *Server) {
+		s.cfg.Logger = logger
+	}
+}
+
+// WithForwardedProto sets X-Forwarded-Proto on upstream requests from the
+// scheme and TLS state recorded by the client. It is "https" when the client
+// saw TLS, otherwise the client's URL scheme. Requests from clients that sent
+// neither are left alone.
+func WithForwardedProto() ServerOption {
+	return func(s *Server) {
+		s.forwardedProto = true
+	}
+}
+
+func NewServer(nc *nats.Conn, subject string, opts ...ServerOption) *Server {
+	return newServer(nc, Config{Subject: subject, Options: opts})
+}
+
+// newServer applies the options of cfg on top of its fields and validates
+// the result, leaving any problem for Start to report.
+func newServer(nc *nats.Conn, cfg Config) *Server {
+	s := &Server{
+		nc:           nc,
+		cfg:          cfg,
+		priorityFunc: headerPriority,
+		clock:        realClock{},
+		maxRedirects: -1,
+	}
+	for _, opt := range cfg.Options {
+		opt(s)
+	}
+	if err := s.cfg.Validate(); err != nil {
+		s.configErr = errors.Join(s.configErr, fmt.Errorf("nats-http: invalid server config: %w", err))
+	}
+	s.cfg.setDefaults()
+	s.logger = s.cfg.Logger
+	if s.cfg.MaxConcurrency > 0 {
+		s.limiter = newPriorityLimiter(s.cfg.MaxConcurrency)
+	}
+	if s.replyBatcher != nil {
+		s.replyBatcher.send, s.replyBatcher.log, s.replyBatcher.clock = s.sendReply, s.logger, s.clock
+	}
+	return s
+}
+
+// Start subscribes the server to its subject, to the subjects of its routes
+// and of Handle, and to the admin subject when one is configured. It fails
+// without subscribing if the settings don't pass Config.Validate or an
+// option was given an invalid argument.
+func (s *Server) Start() error {
+	if s.configErr != nil {
+		return s.configErr
+	}
+	handle := s.handle
+	if s.cfg.Workers > 0 {
+		handle = s.startWorkers()
+	}
+	if err := s.subscribeRequests(handle); err != nil {
+		return err
+	}
+	if s.cfg.AdminSubject != "" {
+		if err := s.subscribe(s.cfg.AdminSubject, "", s.handleAdmin); err != nil {
+			return err
+		}
+	}
+	s.startReadiness(handle)
+	return s.startHandlers()
+}
+
+// subscribeRequests subscribes to the server's subject and those of its
+// routes.
+func (s *Server) subscribeRequests(handle nats.MsgHandler) error {
+	if err := s.subscribe(s.cfg.Subject, s.queueGroup, handle); err != nil {
+		return err
+	}
+	for subject := range s.routes {
+		if subject == s.cfg.Subject {
+			continue
+		}
+		if err := s.subscribe(subject, s.queueGroup, handle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) subscribe(subject, queue string, cb nats.MsgHandler) error {
+	sub, err := s.nc.QueueSubscribe(subject, queue, cb)
+	if err != nil {
+		return err
+	}
+	s.subsMu.Lock()
+	s.subs = append(s.subs, sub)
+	s.subsMu.Unlock()
+	return nil
+}
+
+// Close shuts the server down without losing replies. It stops accepting
+// new messages, lets the ones already received and all in-flight requests
+// finish and publish their replies, flushes the connection and leaves the
+// subscriptions removed. The connection itself stays open.
+func (s *Server) Close() error {
+	s.stopReadiness()
+	s.readiness.mu.Lock()
+	s.readiness.handle = nil
+	s.readiness.mu.Unlock()
+	s.subsMu.Lock()
+	subs := s.subs
+	s.subs = nil
+	s.subsMu.Unlock()
+
+	// Drain stops delivery and unsubscribes once the pending messages have
+	// been handled, which is when the subscription reports closed.
+	var closed []<-chan nats.SubStatus
+	var firstErr error
+	for _, sub := range subs {
+		ch := sub.StatusChanged(nats.SubscriptionClosed)
+		if err := sub.Drain(); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		closed = append(closed, ch)
+	}
+	for _, ch := range closed {
+		<-ch
+	}
+	// a subscription that failed to drain may still feed the workers
+	if firstErr == nil {
+		s.stopWorkers()
+	}
+	// requests handed to goroutines outlive their callbacks
+	s.inflight.Wait()
+	if s.replyBatcher != nil {
+		s.replyBatcher.flush()
+	}
+	if err := s.nc.Flush(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if err := s.closeHandlers(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+func (s *Server) hostAllowed(host string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Contains(s.cfg.AllowedHosts, host)
+}
+
+func (s *Server) httpClient() *http.Client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	transport := s.cfg.UpstreamTransport
+	if s.cfg.Handler != nil {
+		transport = handlerTransport{s.cfg.Handler}
+	}
+	return &http.Client{Transport: transport, Timeout: s.cfg.UpstreamTimeout}
+}
+
+func (s *Server) handle(msg *nats.Msg) {
+	if s.answerProbe(msg) {
+		return
+	}
+	if msg.Header.Get(HeaderBatch) != "" {
+		if s.limiter == nil {
+			s.handleBatch(msg)
+			return
+		}
+		s.inflight.Add(1)
+		go func() {
+			defer s.inflight.Done()
+			s.handleBatch(msg)
+		}()
+		return
+	}
+	if s.trace != nil {
+		s.trace.request(s.logger, "nats-http request", msg)
+	}
+	// Deserialize the incoming NATS request
+	natsReq := NATSHTTPRequest{receivedAt: s.clock.Now()}
+	if err := decodePayload(msg, &natsReq); err != nil {
+		if s.decodeErrors == ErrorReply {
+			s.replyErrorCode(msg, http.StatusBadRequest, ErrorCodeInvalidRequest, "invalid request: "+err.Error())
+		}
+		return
+	}
+	if s.spans {
+		natsReq.decodedAt = s.clock.Now()
+	}
+	restorePromotedHeaders(msg, &natsReq, s.promotedPrefix)
+	if s.rateLimited(msg) || s.identityLimited(msg, &natsReq) {
+		return
+	}
+
+	if s.limiter == nil {
+		s.serve(msg, &natsReq)
+		return
+	}
+	prio := s.priorityFunc(&natsReq)
+	s.inflight.Add(1)
+	go func() {
+		defer s.inflight.Done()
+		s.limiter.acquire(prio)
+		defer s.limiter.release()
+		s.serve(msg, &natsReq)
+	}()
+}
+
+func (s *Server) serve(msg *nats.Msg, natsReq *NATSHTTPRequest) {
+	nc := s.nc
+	s.stats.begin()
+	defer s.stats.end()
+	// the priority is for this server only, with or without a limiter
+	delete(natsReq.Header, HeaderNATSPriority)
+	if s.auditHook != nil {
+		s.audit(natsReq)
+	}
+	stopKeepalive := func() {}
+	if s.keepalive > 0 && natsReq.Keepalive {
+		stopKeepalive = s.startKeepalive(msg.Reply)
+		defer stopKeepalive()
+	}
+	// Any token is a valid method, so extension methods like PROPFIND or
+	// made-up verbs are forwarded as they are.
+	if !validMethod(natsReq.Method) {
+		s.replyError(msg, http.StatusBadRequest, fmt.Sprintf("invalid method %q", natsReq.Method))
+		return
+	}
+	// Make the HTTP request. A nil body lets the upstream see a request
+	// without one, an empty reader an explicitly empty body.
+	var reqBody io.Reader
+	if natsReq.HasBody || len(natsReq.Body) > 0 {
+		reqBody = bytes.NewReader(natsReq.Body)
+	}
+	httpReq, err := http.NewRequest(natsReq.Method, natsReq.URL, reqBody)
+	if err != nil {
+		s.replyError(msg, http.StatusBadRequest, "malformed request: "+err.Error())
+		return
+	}
+	httpReq = s.withContextValues(httpReq, natsReq)
+	httpReq, ok := s.checkHops(httpReq, natsReq)
+	if !ok {
+		s.replyError(msg, http.StatusLoopDetected, "hop limit exceeded")
+		return
+	}
+	if tokens := subjectTokens(msg); tokens != nil {
+		httpReq = httpReq.WithContext(context.WithValue(httpReq.Context(), subjectTokensKey{}, tokens))
+	}
+	// net/http always talks HTTP/1.1 or HTTP/2 to the upstream, whatever
+	// Proto says, so the version only reaches in-process handlers and custom
+	// upstream transports. What can be honoured is HTTP/1.0's default of not
+	// keeping the connection alive.
+	httpReq.Proto, httpReq.ProtoMajor, httpReq.ProtoMinor = protoOrDefault(natsReq.Proto, natsReq.ProtoMajor, natsReq.ProtoMinor)
+	if httpReq.ProtoMajor == 1 && httpReq.ProtoMinor == 0 && !strings.EqualFold(natsReq.Header["Connection"], "keep-alive") {
+		httpReq.Close = true
+	}
+	if natsReq.CancelSubject != "" {
+		ctx, cancel := context.WithCancel(httpReq.Context())
+		defer cancel()
+		if sub, err := nc.Subscribe(natsReq.CancelSubject, func(*nats.Msg) { cancel() }); err == nil {
+			defer sub.Unsubscribe()
+		}
+		httpReq = httpReq.WithContext(ctx)
+	}
+	if s.informational && natsReq.Informational {
+		httpReq = httpReq.WithContext(s.withInformational(httpReq.Context(), msg.Reply))
+	}
+	for key, value := range natsReq.Header {
+		httpReq.Header.Set(key, value)
+	}
+	if s.forwardedProto {
+		if proto := natsReq.forwardedProto(); proto != "" {
+			httpReq.Header.Set("X-Forwarded-Proto", proto)
+		}
+	}
+	if s.authForwarding != AuthorizationForward {
+		httpReq.Header.Del("Authorization")
+		if s.authForwarding == AuthorizationReplace && !s.route(msg).mayHaveCredentials() {
+			s.replyError(msg, http.StatusBadGateway, "no upstream credentials")
+			return
+		}
+	}
+	var injected []string
+	if route := s.route(msg); route != nil {
+		injected = route.applyRoute(httpReq)
+	}
+	// check that host header is for a allowed domain
+	if s.cfg.Handler == nil {
+		if _, ok := httpReq.Header["Host"]; !ok {
+			s.replyError(msg, http.StatusBadRequest, "missing host header")
+			return
+		}
+		if !s.hostAllowed(httpReq.Header.Get("Host")) {
+			s.replyError(msg, http.StatusForbidden, "host not allowed")
+			return
+		}
+	}
+	if s.cors != nil && isPreflight(natsReq) {
+		s.replyPreflight(msg, natsReq)
+		return
+	}
+	if s.cfg.AllowedMethods != nil && !slices.Contains(s.cfg.AllowedMethods, natsReq.Method) {
+		s.replyMethodNotAllowed(msg)
+		return
+	}
+	strip := s.stripsBody(natsReq.Method)
+	var limited *limitedUpload
+	if natsReq.BodyStream && !strip {
+		if s.cfg.Streaming == nil {
+			s.replyError(msg, http.StatusNotImplemented, "streamed request bodies are not enabled")
+			return
+		}
+		if s.maxUploadSize > 0 && natsReq.ContentLength > s.maxUploadSize {
+			s.replyError(msg, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		var release func()
+		if s.uploadBudget != nil {
+			size := s.uploadSize(natsReq.ContentLength)
+			if !s.uploadBudget.reserve(size) {
+				s.replyError(msg, http.StatusServiceUnavailable, "upload budget exhausted")
+				return
+			}
+			release = func() { s.uploadBudget.release(size) }
+		}
+		upload, err := s.openUpload(httpReq.Context(), msg)
+		if err != nil {
+			if release != nil {
+				release()
+			}
+			s.replyError(msg, http.StatusInternalServerError, "failed to open upload")
+			return
+		}
+		if release != nil {
+			upload = &budgetedUpload{ReadCloser: upload, release: release}
+		}
+		if s.maxUploadSize > 0 {
+			limited = &limitedUpload{ReadCloser: upload, remaining: s.maxUploadSize}
+			upload = limited
+		}
+		defer upload.Close()
+		httpReq.Body = upload
+		httpReq.ContentLength = -1
+		httpReq.GetBody = nil
+		if s.requestBuffering {
+			body, err := io.ReadAll(upload)
+			if errors.Is(err, errUploadTooLarge) {
+				s.replyError(msg, http.StatusRequestEntityTooLarge, "request body too large")
+				return
+			}
+			if err != nil {
+				s.replyError(msg, http.StatusBadRequest, "failed to read request body")
+				return
+			}
+			httpReq.GetBody = func() (io.ReadCloser, error) {
+				// an empty body of length 0 only counts as known as NoBody
+				if len(body) == 0 {
+					return http.NoBody, nil
+				}
+				return io.NopCloser(bytes.NewReader(body)), nil
+			}
+			httpReq.Body, _ = httpReq.GetBody()
+			httpReq.ContentLength = int64(len(body))
+			natsReq.ContentLength = int64(len(body))
+		}
+	}
+	// Restore the declared length so the upstream sees an unknown length as
+	// unknown, typically sending it chunked. Inline bodies otherwise have
+	// their exact length and object store bodies their size from the store.
+	if natsReq.BodyRef == nil && (natsReq.ContentLength < 0 || natsReq.BodyStream && natsReq.ContentLength > 0) {
+		httpReq.ContentLength = natsReq.ContentLength
+	}
+	if ref := natsReq.BodyRef; ref != nil {
+		if s.objectStoreBucket == "" || ref.Bucket != s.objectStoreBucket {
+			s.replyError(msg, http.StatusBadRequest, "object store bucket not accepted")
+			return
+		}
+		if !strings.HasPrefix(ref.Name, objectNamePrefix) {
+			s.replyError(msg, http.StatusBadRequest, "object store name not accepted")
+			return
+		}
+		switch {
+		case !strip:
+			body, size, cleanup, err := s.openObjectBody(httpReq.Context(), ref)
+			if err != nil {
+				s.replyError(msg, http.StatusBadGateway, "failed to open object store body")
+				return
+			}
+			defer cleanup()
+			httpReq.Body = body
+			httpReq.ContentLength = size
+			httpReq.GetBody = nil
+		case !ref.Keep:
+			// the client may have been first
+			if err := deleteObject(s.nc, ref); err != nil && !errors.Is(err, nats.ErrObjectNotFound) {
+				s.logger.Warn("failed to delete object store body", "bucket", ref.Bucket, "name", ref.Name, "error", err)
+			}
+		}
+	}
+	if strip {
+		stripBody(httpReq)
+	}
+
+	var tee *bodyTee
+	if s.tee != nil {
+		tee = s.openTee(natsReq)
+		defer tee.close()
+		httpReq.Body = tee.request(httpReq.Body)
+	}
+	var timing *ServerTiming
+	if s.timing {
+		timing = &ServerTiming{ReceivedAt: natsReq.receivedAt, UpstreamStart: s.clock.Now()}
+	}
+	var spans *spanRecorder
+	if s.spans {
+		spans = newSpanRecorder(natsReq)
+	}
+	var authHeader string
+	if route := s.route(msg); route != nil && route.Auth != nil {
+		authStart := s.clock.Now()
+		header, value, err := route.Auth()
+		if err != nil {
+			text := "upstream auth failed"
+			if s.cfg.VerboseErrors {
+				text += ": " + err.Error()
+			}
+			s.replyError(msg, http.StatusBadGateway, text)
+			return
+		}
+		httpReq.Header.Set(header, value)
+		authHeader = header
+		injected = append(injected, header)
+		spans.add("auth", authStart, s.clock.Now())
+	}
+	// the client's header is gone, so any left came from the route
+	if s.authForwarding == AuthorizationReplace && httpReq.Header.Get("Authorization") == "" {
+		s.replyError(msg, http.StatusBadGateway, "no upstream credentials")
+		return
+	}
+	upstreamStart := s.clock.Now()
+	client := s.httpClient()
+	var redirects []RedirectHop
+	if s.recordRedirects || s.maxRedirects >= 0 || injected != nil {
+		s.checkRedirects(client, &redirects, injected)
+	}
+	var resp *http.Response
+	if s.cache != nil {
+		resp, err = s.doCached(client, httpReq, s.route(msg))
+	} else {
+		resp, err = client.Do(httpReq)
+	}
+	if s.mirror != nil {
+		s.mirrorRequest(httpReq, natsReq, authHeader)
+	}
+	if limited != nil && limited.exceeded.Load() {
+		// The upstream may have answered before noticing the cut off body.
+		if err == nil {
+			resp.Body.Close()
+		}
+		s.replyError(msg, http.StatusRequestEntityTooLarge, "request body too large")
+		return
+	}
+	if err != nil {
+		s.replyUpstreamError(msg, err)
+		s.publishDeadLetter(msg, natsReq, upstreamErrorClass(err), err)
+		if msg.Reply == "" {
+			s.logger.Warn("notification failed", "method", natsReq.Method, "url", natsReq.URL, "error", err)
+		}
+		return
+	}
+	defer resp.Body.Close()
+	if httpReq.Method == http.MethodHead {
+		// handlers and misbehaving upstreams may send a body anyway
+		resp.Body = http.NoBody
+	}
+	resp.Body = tee.response(resp.Body)
+	if msg.Reply == "" && resp.StatusCode >= http.StatusInternalServerError {
+		s.logger.Warn("notification failed", "method", natsReq.Method, "url", natsReq.URL, "status", resp.StatusCode)
+	}
+
+	respHeaders := make(map[string]string)
+	var respHeaderValues map[string][]string
+	for key, values := range resp.Header {
+		// handlers can suppress a header with a nil value
+		if len(values) == 0 {
+			continue
+		}
+		respHeaders[key] = values[0]
+		if len(values) > 1 {
+			if respHeaderValues == nil {
+				respHeaderValues = make(map[string][]string)
+			}
+			respHeaderValues[key] = values
+		}
+	}
+	// a handler may set a nil Content-Type to keep net/http from sniffing
+	if len(resp.Header["Content-Type"]) == 0 && s.defaultContentType != "" && bodyAllowed(resp.StatusCode) {
+		respHeaders["Content-Type"] = s.defaultContentType
+	}
+	if s.cors != nil {
+		s.addCORSHeaders(respHeaders, natsReq)
+	}
+	var body []byte
+	if s.cfg.Streaming != nil && natsReq.Stream {
+		var stream io.Reader
+		if body, stream = s.splitStream(resp); stream != nil {
+			if timing != nil {
+				timing.UpstreamEnd = s.clock.Now()
+			}
+			spans.add("upstream", upstreamStart, s.clock.Now())
+			// a keepalive among the chunks would break the stream
+			stopKeepalive()
+			var counted *countingReader
+			if s.accessLog != nil {
+				counted = &countingReader{Reader: stream}
+				stream = counted
+			}
+			s.streamResponse(msg, NATSHTTPResponse{
+				Timing:       timing,
+				Redirects:    redirects,
+				Spans:        spans.list(),
+				Instance:     s.instanceID,
+				StatusCode:   resp.StatusCode,
+				Header:       respHeaders,
+				HeaderValues: respHeaderValues,
+				Proto:        resp.Proto,
+				ProtoMajor:   resp.ProtoMajor,
+				ProtoMinor:   resp.ProtoMinor,
+			}, stream, resp.ContentLength < 0)
+			if counted != nil {
+				s.logAccess(natsReq, resp.StatusCode, counted.n)
+			}
+			return
+		}
+	} else {
+		body, _ = io.ReadAll(resp.Body)
+	}
+	serializeStart := s.clock.Now()
+	spans.add("upstream", upstreamStart, serializeStart)
+	// the body is read to the end, so the trailers are in
+	var trailer map[string]string
+	for key, values := range resp.Trailer {
+		if len(values) > 0 {
+			if trailer == nil {
+				trailer = make(map[string]string)
+			}
+			trailer[key] = values[0]
+		}
+	}
+	// a buffered body has a known length, whatever the upstream's framing
+	delete(respHeaders, "Transfer-Encoding")
+	if resp.ContentLength < 0 && natsReq.Method != http.MethodHead && bodyAllowed(resp.StatusCode) {
+		respHeaders["Content-Length"] = strconv.Itoa(len(body))
+	}
+	if s.transformers != nil {
+		var err error
+		if body, err = s.transformBody(natsReq, resp.StatusCode, respHeaders, body); err != nil {
+			text := "failed to transform response"
+			if s.cfg.VerboseErrors {
+				text += ": " + err.Error()
+			}
+			s.replyError(msg, http.StatusBadGateway, text)
+			return
+		}
+	}
+	if s.clientCompression {
+		body = compressForClient(natsReq, resp.StatusCode, respHeaders, body)
+	}
+	if timing != nil {
+		timing.UpstreamEnd = s.clock.Now()
+	}
+
+	// Serialize and send the response
+	natsResp := NATSHTTPResponse{
+		StatusCode:   resp.StatusCode,
+		Header:       respHeaders,
+		HeaderValues: respHeaderValues,
+		Body:         body,
+		Proto:        resp.Proto,
+		ProtoMajor:   resp.ProtoMajor,
+		ProtoMinor:   resp.ProtoMinor,
+		Timing:       timing,
+		Redirects:    redirects,
+		Trailer:      trailer,
+		Instance:     s.instanceID,
+	}
+	if codec := negotiateHopCodec(s.cfg.HopCodecs, natsReq.AcceptEncodings); codec != "" && len(body) > 0 && len(body) >= s.cfg.CompressionThreshold {
+		if compressed, err := hopCompress(codec, body); err == nil && len(compressed) < len(body) {
+			natsResp.Body = compressed
+			natsResp.Encoding = codec
+		}
+	}
+	var respData []byte
+	var rawEnvelope string
+	if s.binaryPayloads != nil && natsReq.AcceptRaw && len(natsResp.Body) > 0 && s.binaryPayloads(respHeaders["Content-Type"]) {
+		head := natsResp
+		head.Body = nil
+		respData, rawEnvelope, _ = encodeRaw(&head, natsResp.Body)
+	} else {
+		respData, _ = json.Marshal(natsResp)
+	}
+	if spans != nil {
+		spans.add("serialize", serializeStart, s.clock.Now())
+		if rawEnvelope != "" {
+			rawEnvelope = string(appendSpans([]byte(rawEnvelope), spans.list()))
+		} else {
+			respData = appendSpans(respData, spans.list())
+		}
+	}
+	if maxPayload := s.maxPayload(); maxPayload > 0 && len(respData)+len(rawEnvelope) > maxPayload {
+		if !s.cfg.TruncateOversized {
+			s.replyError(msg, http.StatusBadGateway, "response exceeds max payload")
+			s.publishDeadLetter(msg, natsReq, DeadLetterOversized, fmt.Errorf("response of %d bytes exceeds max payload of %d", len(respData), maxPayload))
+			return
+		}
+		// a cut off compressed body can't be decompressed, so truncate the
+		// plain one
+		natsResp.Body, natsResp.Encoding = body, ""
+		rawEnvelope = ""
+		if respData, err = truncateResponse(&natsResp, maxPayload); err != nil {
+			s.replyError(msg, http.StatusBadGateway, "failed to truncate response")
+			return
+		}
+	}
+	if reply := s.newReply(msg.Reply, natsResp.StatusCode, respData, rawEnvelope); reply != nil {
+		if s.replyBatcher != nil {
+			s.replyBatcher.add(reply)
+		} else if err := s.sendReply(reply); err != nil {
+			s.replyFailed(reply.Subject, err)
+		}
+	}
+	s.stats.record(MessageStats{
+		RequestBytes:  len(msg.Data),
+		ResponseBytes: len(respData),
+		BodyBytes:     len(body),
+		Duration:      s.clock.Now().Sub(natsReq.receivedAt),
+	})
+	if s.accessLog != nil {
+		s.logAccess(natsReq, natsResp.StatusCode, int64(len(natsResp.Body)))
+	}
+}
+
+// maxPayload is the connection's message size limit, 0 without one as
+// with RoundTripLocal.
+func (s *Server) maxPayload() int {
+	if s.nc == nil {
+		return 0
+	}
+	return int(s.nc.MaxPayload())
+}
+
+// replyMethodNotAllowed answers like an upstream would, with a response
+// rather than an error envelope, so the client sees the Allow header.
+func (s *Server) replyMethodNotAllowed(msg *nats.Msg) {
+	data, _ := json.Marshal(NATSHTTPResponse{
+		StatusCode: http.StatusMethodNotAllowed,
+		Header: map[string]string{
+			"Allow":        strings.Join(s.cfg.AllowedMethods, ", "),
+			"Content-Type": "text/plain; charset=utf-8",
+		},
+		Body:     []byte("method not allowed\n"),
+		Instance: s.instanceID,
+	})
+	s.publishReply(msg.Reply, http.StatusMethodNotAllowed, data)
+}
+
+// validMethod reports whether method is empty, which means GET, or an RFC
+// 9110 token.
+func validMethod(method string) bool {
+	for _, c := range []byte(method) {
+		if !isTokenChar(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// bodyAllowed reports whether a response with status may have a body.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// publishReply sends an encoded response or error envelope for status, where
+// 0 means unknown. Notifications have no reply subject and get nothing.
+func (s *Server) publishReply(reply string, status int, data []byte) error {
+	return s.publishRawReply(reply, status, data, "")
+}
+
+// publishRawReply is publishReply for a raw message when envelope is set.
+// Batched requests don't accept raw replies, so captured replies are
+// always envelopes.
+func (s *Server) publishRawReply(reply string, status int, data []byte, envelope string) error {
+	if msg := s.newReply(reply, status, data, envelope); msg != nil {
+		return s.sendReply(msg)
+	}
+	return nil
+}
+
+// newReply returns the message for a reply, or nil when there is nothing
+// to publish: for notifications and for captured replies, which it stores.
+func (s *Server) newReply(reply string, status int, data []byte, envelope string) *nats.Msg {
+	if reply == "" {
+		return nil
+	}
+	msg := nats.NewMsg(reply)
+	msg.Data = data
+	if envelope != "" {
+		setRaw(msg, envelope)
+	}
+	if s.trace != nil {
+		s.trace.response(s.logger, "nats-http reply", msg)
+	}
+	if captured, ok := s.captures.Load(reply); ok {
+		*captured.(*[]byte) = data
+		return nil
+	}
+	if s.observabilityHeaders && status != 0 {
+		msg.Header.Set(HeaderObservabilityStatus, strconv.Itoa(status))
+	}
+	return msg
+}
+
+func (r *NATSHTTPRequest) forwardedProto() string {
+	if r.TLS {
+		return "https"
+	}
+	return r.Scheme
+}
+
+func startServer(nc *nats.Conn, subjectReq string, opts ...ServerOption) {
+	if err := NewServer(nc, subjectReq, opts...).Start(); err != nil {
+		panic(err)
+	}
+}
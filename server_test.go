@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestMalformedURL(t *testing.T) {
+	nc := runNATS(t)
+	tr := serveHandler(t, nc, "svc", http.NotFoundHandler())
+	data, _ := json.Marshal(NATSHTTPRequest{Method: "GET", URL: "http://[::1/broken"})
+	start := time.Now()
+	msg, err := nc.Request("svc", data, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("reply was not fast")
+	}
+	_, err = tr.decodeReply(msg)
+	var se *ServerError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusBadRequest || !strings.HasPrefix(se.Message, "malformed request") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestEmptyBodyVersusNoBody(t *testing.T) {
+	nc := runNATS(t)
+	hasBody := make(chan bool, 1)
+	upstream := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		hasBody <- req.Body != nil
+		return &http.Response{StatusCode: 200, Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+	})
+	s := NewServer(nc, "svc", WithAllowedHosts("example.com"), WithUpstreamTransport(upstream))
+	s.Start()
+	defer s.Close()
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second)
+
+	for _, c := range []struct {
+		method string
+		body   io.Reader
+		want   bool
+	}{
+		{"POST", bytes.NewReader(nil), true},
+		{"POST", http.NoBody, true},
+		{"GET", nil, false},
+	} {
+		req, _ := http.NewRequest(c.method, "http://example.com/", c.body)
+		req.Header.Set("Host", "example.com")
+		if _, err := tr.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-hasBody; got != c.want {
+			t.Errorf("%s with %T: upstream request has body %v, want %v", c.method, c.body, got, c.want)
+		}
+	}
+}
+
+func TestCloseAnswersRequestsInFlight(t *testing.T) {
+	for name, opts := range map[string][]ServerOption{
+		"callback":    nil,
+		"concurrency": {WithMaxConcurrency(4)},
+		"workers":     {WithWorkers(2)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			nc := runNATS(t)
+			entered, release := make(chan struct{}), make(chan struct{})
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(entered)
+				<-release
+				io.WriteString(w, "slow")
+			})
+			s := NewServer(nc, "svc", append([]ServerOption{WithHandler(h)}, opts...)...)
+			if err := s.Start(); err != nil {
+				t.Fatal(err)
+			}
+			nc.Flush()
+			tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second)
+
+			type result struct {
+				body string
+				err  error
+			}
+			res := make(chan result, 1)
+			go func() {
+				req, _ := http.NewRequest("GET", "http://svc/", nil)
+				resp, err := tr.RoundTrip(req)
+				if err != nil {
+					res <- result{err: err}
+					return
+				}
+				body, _ := io.ReadAll(resp.Body)
+				res <- result{body: string(body)}
+			}()
+			<-entered
+
+			closed := make(chan error, 1)
+			go func() { closed <- s.Close() }()
+			select {
+			case err := <-closed:
+				t.Fatalf("Close returned with a request in flight: %v", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+			close(release)
+			if err := <-closed; err != nil {
+				t.Fatal(err)
+			}
+			// the reply is out by the time Close returns
+			select {
+			case r := <-res:
+				if r.err != nil || r.body != "slow" {
+					t.Fatalf("got %q, %v", r.body, r.err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("reply lost")
+			}
+
+			req, _ := http.NewRequest("GET", "http://svc/", nil)
+			if _, err := tr.RoundTrip(req); !errors.Is(err, nats.ErrNoResponders) {
+				t.Fatalf("closed server still answers: %v", err)
+			}
+		})
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	nc := runNATS(t)
+	protos := make(chan string, 1)
+	upstream := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		protos <- fmt.Sprintf("%s %d.%d", req.Proto, req.ProtoMajor, req.ProtoMinor)
+		return &http.Response{StatusCode: 200, Proto: req.Proto, ProtoMajor: req.ProtoMajor, ProtoMinor: req.ProtoMinor, Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+	})
+	s := NewServer(nc, "svc", WithAllowedHosts("example.com"), WithUpstreamTransport(upstream))
+	s.Start()
+	defer s.Close()
+	nc.Flush()
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second)
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Host", "example.com")
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/1.0", 1, 0
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-protos; got != "HTTP/1.0 1.0" {
+		t.Fatalf("upstream got %s", got)
+	}
+	if resp.Proto != "HTTP/1.0" || resp.ProtoMajor != 1 || resp.ProtoMinor != 0 {
+		t.Fatalf("response is %s %d.%d", resp.Proto, resp.ProtoMajor, resp.ProtoMinor)
+	}
+
+	// requests from clients that don't send a version are HTTP/1.1
+	data, _ := json.Marshal(NATSHTTPRequest{Method: "GET", URL: "http://example.com/", Header: map[string]string{"Host": "example.com"}})
+	if _, err := nc.Request("svc", data, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-protos; got != "HTTP/1.1 1.1" {
+		t.Fatalf("upstream got %s", got)
+	}
+}
+
+func TestChunkedUpstream(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "second")
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	nc := runNATS(t)
+	for subject, opts := range map[string][]ServerOption{
+		"streamed": {WithServerStreaming(StreamConfig{})},
+		"buffered": nil,
+	} {
+		s := NewServer(nc, subject, append([]ServerOption{WithAllowedHosts(u.Host)}, opts...)...)
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+	}
+	nc.Flush()
+	newRequest := func() *http.Request {
+		req, _ := http.NewRequest("GET", upstream.URL, nil)
+		req.Header.Set("Host", u.Host)
+		return req
+	}
+
+	// the first chunk arrives while the upstream is still writing
+	tr := NewNATSHTTPTransport(nc, "streamed", "", 5*time.Second, WithStreaming(StreamConfig{}))
+	resp, err := tr.RoundTrip(newRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "first" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+	close(release)
+	if rest, _ := io.ReadAll(resp.Body); string(rest) != "second" {
+		t.Fatalf("got %q", rest)
+	}
+	resp.Body.Close()
+
+	tr = NewNATSHTTPTransport(nc, "buffered", "", 5*time.Second)
+	if resp, err = tr.RoundTrip(newRequest()); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ContentLength != 11 || resp.Header.Get("Content-Length") != "11" || resp.Header.Get("Transfer-Encoding") != "" || resp.TransferEncoding != nil {
+		t.Fatalf("buffered response %d %v", resp.ContentLength, resp.Header)
+	}
+}
+
+func TestAllowedMethods(t *testing.T) {
+	nc := runNATS(t)
+	var hits atomic.Int32
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits.Add(1) })
+	tr := serveHandler(t, nc, "svc", h, WithAllowedMethods("GET", "POST", "PUT", "DELETE"))
+
+	req, _ := http.NewRequest("PATCH", "http://svc/", strings.NewReader("{}"))
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET, POST, PUT, DELETE" || hits.Load() != 0 {
+		t.Fatalf("PATCH got %d, Allow %q, upstream hit %d times", resp.StatusCode, resp.Header.Get("Allow"), hits.Load())
+	}
+
+	req, _ = http.NewRequest("PUT", "http://svc/", strings.NewReader("{}"))
+	if resp, err = tr.RoundTrip(req); err != nil || resp.StatusCode != http.StatusOK || hits.Load() != 1 {
+		t.Fatalf("PUT got %v, %v", resp, err)
+	}
+}
+
+func TestExtensionMethods(t *testing.T) {
+	nc := runNATS(t)
+	methods := make(chan string, 1)
+	upstream := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		methods <- req.Method
+		return &http.Response{StatusCode: 207, Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+	})
+	s := NewServer(nc, "svc", WithAllowedHosts("example.com"), WithUpstreamTransport(upstream))
+	s.Start()
+	defer s.Close()
+	nc.Flush()
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second)
+
+	for _, method := range []string{"PROPFIND", "X-FROBNICATE.v2"} {
+		req, _ := http.NewRequest(method, "http://example.com/", nil)
+		req.Header.Set("Host", "example.com")
+		resp, err := tr.RoundTrip(req)
+		if err != nil || resp.StatusCode != 207 {
+			t.Fatalf("%s: got %v, %v", method, resp, err)
+		}
+		if got := <-methods; got != method {
+			t.Fatalf("upstream got %s, want %s", got, method)
+		}
+	}
+
+	for _, method := range []string{"BAD METHOD", "GET\r\nX-Injected: 1", "DAV(1)"} {
+		data, _ := json.Marshal(NATSHTTPRequest{Method: method, URL: "http://example.com/", Header: map[string]string{"Host": "example.com"}})
+		msg, err := nc.Request("svc", data, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var se *ServerError
+		if _, err := tr.decodeReply(msg); !errors.As(err, &se) || se.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%q: got %v", method, err)
+		}
+	}
+	select {
+	case method := <-methods:
+		t.Fatalf("invalid method %q forwarded", method)
+	default:
+	}
+}
+
+func TestUnknownContentLength(t *testing.T) {
+	nc := runNATS(t)
+	type seen struct {
+		length  int64
+		chunked bool
+		body    string
+	}
+	got := make(chan seen, 1)
+	u := serveUpstream(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- seen{r.ContentLength, slices.Contains(r.TransferEncoding, "chunked"), string(body)}
+	}))
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second)
+
+	for _, tc := range []struct {
+		name string
+		body io.Reader
+		want seen
+	}{
+		// a reader without a Len makes the length unknown
+		{"unknown", io.MultiReader(strings.NewReader("hello")), seen{-1, true, "hello"}},
+		{"known", strings.NewReader("hello"), seen{5, false, "hello"}},
+	} {
+		resp, err := tr.RoundTrip(upstreamRequest("POST", u, "/", tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if s := <-got; s != tc.want {
+			t.Errorf("%s: upstream saw %+v, want %+v", tc.name, s, tc.want)
+		}
+	}
+}
+
+func TestHeadResponseBody(t *testing.T) {
+	nc := runNATS(t)
+	// the handler answers HEAD with a body, which it shouldn't
+	tr := serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "11")
+		io.WriteString(w, "hello world")
+	}))
+	head, _ := http.NewRequest("HEAD", "http://svc/", nil)
+	natsReq, _, _ := tr.newNATSRequest(head, false)
+	data, _ := tr.encodeRequest(natsReq)
+	msg, err := nc.Request("svc", data, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	natsResp, err := tr.decodeReply(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(natsResp.Body) != 0 || natsResp.Header["Content-Length"] != "11" {
+		t.Fatalf("server sent body %q with Content-Length %q", natsResp.Body, natsResp.Header["Content-Length"])
+	}
+
+	// a server that doesn't drop it still leaves the client's body empty
+	if _, err := nc.Subscribe("old", func(msg *nats.Msg) {
+		data, _ := json.Marshal(NATSHTTPResponse{StatusCode: 200, Header: map[string]string{"Content-Length": "11"}, Body: []byte("hello world")})
+		msg.Respond(data)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tr := range []*NATSHTTPTransport{tr, NewNATSHTTPTransport(nc, "old", "", 5*time.Second)} {
+		req, _ := http.NewRequest("HEAD", "http://svc/", nil)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if len(body) != 0 || resp.ContentLength != 11 || resp.Header.Get("Content-Length") != "11" {
+			t.Fatalf("%s: got body %q with length %d", tr.subjectReq, body, resp.ContentLength)
+		}
+	}
+}
+
+func TestMissingContentType(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/typed" {
+			w.Header().Set("Content-Type", "text/csv")
+		} else {
+			// keeps net/http from sniffing one
+			w.Header()["Content-Type"] = nil
+		}
+		io.WriteString(w, "<html>not really</html>")
+	})
+	for _, c := range []struct {
+		name string
+		opts []ServerOption
+		want string
+	}{
+		{"absent", nil, ""},
+		{"default", []ServerOption{WithDefaultContentType("application/octet-stream")}, "application/octet-stream"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			nc := runNATS(t)
+			serveHandler(t, nc, "handler", h, c.opts...)
+			u := serveUpstream(t, nc, "upstream", h, c.opts...)
+			for _, subject := range []string{"handler", "upstream"} {
+				tr := NewNATSHTTPTransport(nc, subject, "", 5*time.Second)
+				resp, err := tr.RoundTrip(upstreamRequest("GET", u, "/", nil))
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if got, ok := resp.Header["Content-Type"]; c.want == "" && ok || c.want != "" && resp.Header.Get("Content-Type") != c.want {
+					t.Errorf("%s: got Content-Type %q, want %q", subject, got, c.want)
+				}
+				// a Content-Type the upstream sets is kept
+				resp, err = tr.RoundTrip(upstreamRequest("GET", u, "/typed", nil))
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if got := resp.Header.Get("Content-Type"); got != "text/csv" {
+					t.Errorf("%s: got Content-Type %q for a typed response", subject, got)
+				}
+			}
+		})
+	}
+}
+
+func TestForwardedProto(t *testing.T) {
+	nc := runNATS(t)
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Forwarded-Proto"))
+	})
+	serveHandler(t, nc, "svc", echo, WithForwardedProto())
+	serveHandler(t, nc, "plain", echo)
+
+	for _, c := range []struct {
+		subject, url string
+		tls          bool
+		want         string
+	}{
+		{"svc", "http://svc/", false, "http"},
+		{"svc", "https://svc/", false, "https"},
+		// a request an HTTPS listener received and passed on as it is
+		{"svc", "http://svc/", true, "https"},
+		{"plain", "https://svc/", true, ""},
+	} {
+		tr := NewNATSHTTPTransport(nc, c.subject, "", 5*time.Second)
+		req, _ := http.NewRequest("GET", c.url, nil)
+		if c.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != c.want {
+			t.Errorf("%s %s, TLS %v: upstream got X-Forwarded-Proto %q, want %q", c.subject, c.url, c.tls, body, c.want)
+		}
+	}
+}
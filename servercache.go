@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// WithServerCache makes the server a shared cache in front of its upstreams,
+// answering GET requests from all clients out of c.
+//
+// A 200 response is stored when its Cache-Control allows a shared cache to:
+// not no-store or private, and without a Vary header. Responses to requests
+// with Authorization are only stored when marked public or s-maxage, and
+// responses setting cookies or to requests with cookies only when marked
+// public. Set-Cookie headers are never stored.
+// Freshness comes from s-maxage, max-age or Expires, in that order; no-cache
+// responses are stored but revalidated on every use. Stale entries with an
+// ETag or Last-Modified are revalidated with If-None-Match and
+// If-Modified-Since, and a 304 refreshes them; others are refetched.
+//
+// Requests that bring their own conditional headers, or ask for no-store,
+// bypass the cache; no-cache or max-age=0 forces revalidation. Cached
+// bodies are buffered, so responses that get stored are never streamed.
+func WithServerCache(c Cache) ServerOption {
+	return func(s *Server) {
+		s.cache = c
+	}
+}
+
+// doCached performs httpReq through the server cache. Entries are kept per
+// route, as the route's headers and credentials may change the response.
+func (s *Server) doCached(client *http.Client, httpReq *http.Request, route *Route) (*http.Response, error) {
+	if httpReq.Method != http.MethodGet || httpReq.Header.Get("If-None-Match") != "" || httpReq.Header.Get("If-Modified-Since") != "" {
+		return client.Do(httpReq)
+	}
+	lookup, store := cacheRequestPolicy(httpReq)
+	if !store {
+		return client.Do(httpReq)
+	}
+	key := "GET " + httpReq.Header.Get("Host") + " " + httpReq.URL.String()
+	if route != nil {
+		key = route.Subject + " " + key
+	}
+	cached, ok := s.cache.Get(key)
+	now := s.clock.Now()
+	if ok && lookup && now.Before(cached.Expires) {
+		return cachedHTTPResponse(&cached.Response, httpReq), nil
+	}
+	// Conditional headers go on a copy, httpReq is used for mirroring.
+	upstreamReq := httpReq
+	revalidate := false
+	if ok {
+		etag, modified := cached.Response.Header["Etag"], cached.Response.Header["Last-Modified"]
+		if etag != "" || modified != "" {
+			upstreamReq = httpReq.Clone(httpReq.Context())
+			revalidate = true
+		}
+		if etag != "" {
+			upstreamReq.Header.Set("If-None-Match", etag)
+		}
+		if modified != "" {
+			upstreamReq.Header.Set("If-Modified-Since", modified)
+		}
+	}
+	resp, err := client.Do(upstreamReq)
+	if err != nil {
+		return nil, err
+	}
+	if revalidate && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		refreshed := cached.Response
+		refreshed.Header = make(map[string]string, len(cached.Response.Header))
+		for key, value := range cached.Response.Header {
+			refreshed.Header[key] = value
+		}
+		for key, values := range resp.Header {
+			if len(values) > 0 && key != "Set-Cookie" {
+				refreshed.Header[key] = values[0]
+			}
+		}
+		s.cache.Set(key, &CachedResponse{Response: refreshed, Expires: sharedCacheExpiry(&refreshed, httpReq, now)})
+		return cachedHTTPResponse(&refreshed, httpReq), nil
+	}
+	stored := NATSHTTPResponse{StatusCode: resp.StatusCode, Header: make(map[string]string)}
+	for key, values := range resp.Header {
+		if len(values) > 0 {
+			stored.Header[key] = values[0]
+		}
+	}
+	expires := sharedCacheExpiry(&stored, httpReq, now)
+	if expires.IsZero() {
+		if ok {
+			s.cache.Delete(key)
+		}
+		return resp, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	stored.Body = body
+	delete(stored.Header, "Set-Cookie")
+	for key, values := range resp.Header {
+		if len(values) > 1 && key != "Set-Cookie" {
+			if stored.HeaderValues == nil {
+				stored.HeaderValues = make(map[string][]string)
+			}
+			stored.HeaderValues[key] = values
+		}
+	}
+	s.cache.Set(key, &CachedResponse{Response: stored, Expires: expires})
+	return resp, nil
+}
+
+// sharedCacheExpiry returns until when resp may be served to anyone, now
+// for responses that have to be revalidated on every use, or the zero time
+// if it must not be stored.
+func sharedCacheExpiry(resp *NATSHTTPResponse, req *http.Request, now time.Time) time.Time {
+	if resp.StatusCode != http.StatusOK || resp.Header["Vary"] != "" {
+		return time.Time{}
+	}
+	cc := cacheDirectives(resp.Header["Cache-Control"])
+	if _, ok := cc["no-store"]; ok {
+		return time.Time{}
+	}
+	if _, ok := cc["private"]; ok {
+		return time.Time{}
+	}
+	_, public := cc["public"]
+	sMaxAge, hasSMaxAge := cc["s-maxage"]
+	if req.Header.Get("Authorization") != "" && !public && !hasSMaxAge {
+		return time.Time{}
+	}
+	if (resp.Header["Set-Cookie"] != "" || req.Header.Get("Cookie") != "") && !public {
+		return time.Time{}
+	}
+	if _, ok := cc["no-cache"]; ok {
+		return now
+	}
+	for _, maxAge := range []string{sMaxAge, cc["max-age"]} {
+		if maxAge == "" {
+			continue
+		}
+		if secs, err := strconv.Atoi(maxAge); err == nil && secs >= 0 {
+			return now.Add(time.Duration(secs) * time.Second)
+		}
+		return time.Time{}
+	}
+	if exp, err := http.ParseTime(resp.Header["Expires"]); err == nil && exp.After(now) {
+		return exp
+	}
+	return time.Time{}
+}
+
+// cachedHTTPResponse turns a cached response into one from the upstream.
+func cachedHTTPResponse(cached *NATSHTTPResponse, req *http.Request) *http.Response {
+	header := http.Header{}
+	for key, value := range cached.Header {
+		header.Set(key, value)
+	}
+	for key, values := range cached.HeaderValues {
+		header[key] = slices.Clone(values)
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(cached.StatusCode) + " " + http.StatusText(cached.StatusCode),
+		StatusCode:    cached.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(cached.Body)),
+		ContentLength: int64(len(cached.Body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServerCacheCookies(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		cacheControl string
+		setCookie    bool
+		cookie       bool
+		cached       bool
+	}{
+		{"plain", "max-age=60", false, false, true},
+		{"response sets cookie", "max-age=60", true, false, false},
+		{"request has cookie", "max-age=60", false, true, false},
+		{"public sets cookie", "public, max-age=60", true, false, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nc := runNATS(t)
+			var hits atomic.Int32
+			u := serveUpstream(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				w.Header().Set("Cache-Control", tc.cacheControl)
+				if tc.setCookie {
+					http.SetCookie(w, &http.Cookie{Name: "session", Value: "first-client"})
+				}
+				io.WriteString(w, "hello")
+			}), WithServerCache(NewMemoryCache(10)))
+			tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second)
+
+			var last *http.Response
+			for range 2 {
+				req := upstreamRequest("GET", u, "/", nil)
+				if tc.cookie {
+					req.Header.Set("Cookie", "session=mine")
+				}
+				resp, err := tr.RoundTrip(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if string(body) != "hello" {
+					t.Fatalf("got body %q", body)
+				}
+				last = resp
+			}
+			if want := map[bool]int32{true: 1, false: 2}[tc.cached]; hits.Load() != want {
+				t.Fatalf("upstream hit %d times, want %d", hits.Load(), want)
+			}
+			if tc.cached && last.Header.Get("Set-Cookie") != "" {
+				t.Fatalf("cached response has Set-Cookie %q", last.Header.Get("Set-Cookie"))
+			}
+		})
+	}
+}
+
+func TestServerCacheRevalidates(t *testing.T) {
+	nc := runNATS(t)
+	var conditional atomic.Int32
+	u := serveUpstream(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(w, "hello")
+	}), WithServerCache(NewMemoryCache(10)))
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second)
+
+	for i := range 3 {
+		resp, err := tr.RoundTrip(upstreamRequest("GET", u, "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+			t.Fatalf("request %d: got %d %q", i, resp.StatusCode, body)
+		}
+	}
+	if n := conditional.Load(); n != 2 {
+		t.Fatalf("%d conditional requests, want 2", n)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// singleFlight collapses concurrent NATS requests with the same key into one,
+// in the spirit of golang.org/x/sync/singleflight. Every waiter gets the same
+// reply message and decodes its own copy of the response from it. The
+// request runs on its own, so a waiter whose ctx ends stops waiting without
+// failing the others.
+type singleFlight struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	msg  *nats.Msg
+	err  error
+}
+
+func (g *singleFlight) do(ctx context.Context, key string, fn func() (*nats.Msg, error)) (*nats.Msg, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	c, ok := g.calls[key]
+	if !ok {
+		c = &flightCall{done: make(chan struct{})}
+		g.calls[key] = c
+		go func() {
+			c.msg, c.err = fn()
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(c.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.msg, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
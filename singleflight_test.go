@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSingleFlight(t *testing.T) {
+	nc := runNATS(t)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		io.WriteString(w, "shared")
+	}))
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithSingleFlight())
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "http://example.com/same", nil)
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if body, _ := io.ReadAll(resp.Body); string(body) != "shared" {
+				t.Errorf("got %q", body)
+			}
+		}()
+	}
+	// let every caller join the flight before it lands
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("%d NATS requests reached the server, want 1", n)
+	}
+
+	// unsafe methods are never coalesced
+	req, _ := http.NewRequest("POST", "http://example.com/same", nil)
+	if _, err := tr.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("POST was coalesced: %d calls", n)
+	}
+}
+
+func TestSingleFlightMaxTotal(t *testing.T) {
+	nc := runNATS(t)
+	release := make(chan struct{})
+	serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		io.WriteString(w, "shared")
+	}))
+	capped := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithSingleFlight(), WithMaxTotalDuration(100*time.Millisecond))
+
+	// a caller joining a flight started by another is bounded all the same
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for range 10 {
+		wg.Go(func() {
+			req, _ := http.NewRequest("GET", "http://example.com/same", nil)
+			_, err := capped.RoundTrip(req)
+			errs <- err
+		})
+	}
+	start := time.Now()
+	wg.Wait()
+	close(errs)
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("coalesced requests took %s", d)
+	}
+	for err := range errs {
+		var total *TotalTimeoutError
+		if !errors.As(err, &total) {
+			t.Fatalf("got %v, want a TotalTimeoutError", err)
+		}
+	}
+
+	// giving up leaves the shared request running for an uncapped caller
+	// in the same flight
+	uncapped := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithSingleFlight())
+	uncapped.singleFlight = capped.singleFlight
+	got := make(chan string, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "http://example.com/other", nil)
+		resp, err := uncapped.RoundTrip(req)
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		got <- string(body)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	req, _ := http.NewRequest("GET", "http://example.com/other", nil)
+	if _, err := capped.RoundTrip(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want a deadline error", err)
+	}
+	close(release)
+	if body := <-got; body != "shared" {
+		t.Fatalf("uncapped caller got %q", body)
+	}
+}
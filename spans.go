@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Span is one step of handling a request on the server, for profiling a
+// single request without a tracing backend. Start is relative to when the
+// server received the request, so spans of one response line up as a
+// waterfall whatever the clocks say.
+type Span struct {
+	Name     string        `json:"name"`
+	Start    time.Duration `json:"start"`
+	Duration time.Duration `json:"duration"`
+}
+
+// HeaderNATSSpans carries the spans of a response, added by WithDebugHeaders
+// as "name;start=ms;dur=ms" entries in the style of Server-Timing.
+const HeaderNATSSpans = "X-NATS-Spans"
+
+// WithSpanCollection makes the server return the spans of every proxied
+// response in its Spans, in order: deserialize, auth when the route has
+// UpstreamAuth, upstream, and serialize. For streamed responses upstream
+// ends with the response headers and there is no serialize span. Error
+// envelopes have no spans.
+func WithSpanCollection() ServerOption {
+	return func(s *Server) {
+		s.spans = true
+	}
+}
+
+// ResponseSpans returns the spans of a response from a transport with
+// WithDebugHeaders, or nil if the server sent none.
+func ResponseSpans(resp *http.Response) []Span {
+	var spans []Span
+	for _, entry := range strings.Split(resp.Header.Get(HeaderNATSSpans), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(entry), ";")
+		if name == "" {
+			continue
+		}
+		span := Span{Name: name}
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			ms, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			switch key {
+			case "start":
+				span.Start = time.Duration(ms * float64(time.Millisecond))
+			case "dur":
+				span.Duration = time.Duration(ms * float64(time.Millisecond))
+			}
+		}
+		spans = append(spans, span)
+	}
+	return spans
+}
+
+func formatSpans(spans []Span) string {
+	entries := make([]string, len(spans))
+	for i, span := range spans {
+		entries[i] = fmt.Sprintf("%s;start=%s;dur=%s", span.Name, formatMs(span.Start), formatMs(span.Duration))
+	}
+	return strings.Join(entries, ", ")
+}
+
+// spanRecorder collects the spans of a request. Its methods do nothing on a
+// nil recorder, which is what servers without WithSpanCollection have.
+type spanRecorder struct {
+	origin time.Time
+	spans  []Span
+}
+
+// newSpanRecorder starts with the deserialize span of natsReq.
+func newSpanRecorder(natsReq *NATSHTTPRequest) *spanRecorder {
+	r := &spanRecorder{origin: natsReq.receivedAt}
+	if !natsReq.decodedAt.IsZero() {
+		r.add("deserialize", natsReq.receivedAt, natsReq.decodedAt)
+	}
+	return r
+}
+
+func (r *spanRecorder) add(name string, start, end time.Time) {
+	if r == nil {
+		return
+	}
+	r.spans = append(r.spans, Span{Name: name, Start: start.Sub(r.origin), Duration: end.Sub(start)})
+}
+
+func (r *spanRecorder) list() []Span {
+	if r == nil {
+		return nil
+	}
+	return r.spans
+}
+
+// appendSpans adds spans to data, an encoded response without them. The
+// serialize span only ends once the response is encoded, so the spans are
+// spliced into the JSON object rather than encoded with it.
+func appendSpans(data []byte, spans []Span) []byte {
+	encoded, err := json.Marshal(spans)
+	if err != nil || len(data) < 2 || data[len(data)-1] != '}' {
+		return data
+	}
+	out := make([]byte, 0, len(data)+len(encoded)+len(`,"spans":`))
+	out = append(out, data[:len(data)-1]...)
+	out = append(out, `,"spans":`...)
+	out = append(out, encoded...)
+	return append(out, '}')
+}
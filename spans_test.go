@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSpanCollection(t *testing.T) {
+	nc := runNATS(t)
+	auth := func() (string, string, error) { return "Authorization", "Bearer server", nil }
+	serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}), WithSpanCollection(), WithRoutes(Route{Subject: "svc.auth", Auth: auth}))
+
+	for _, c := range []struct {
+		subject string
+		names   []string
+	}{
+		{"svc", []string{"deserialize", "upstream", "serialize"}},
+		{"svc.auth", []string{"deserialize", "auth", "upstream", "serialize"}},
+	} {
+		tr := NewNATSHTTPTransport(nc, c.subject, "", 5*time.Second, WithDebugHeaders())
+		req, _ := http.NewRequest("GET", "http://svc/", nil)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		spans := ResponseSpans(resp)
+		var names []string
+		for _, span := range spans {
+			names = append(names, span.Name)
+		}
+		if !slices.Equal(names, c.names) {
+			t.Fatalf("%s: got spans %v, want %v", c.subject, names, c.names)
+		}
+		// a waterfall: each span starts where the one before it ended, give
+		// or take the header's rounding to microseconds
+		for i := 1; i < len(spans); i++ {
+			if end := spans[i-1].Start + spans[i-1].Duration; spans[i].Start < end-time.Microsecond {
+				t.Errorf("%s: %s starts at %v, before %s ends at %v", c.subject, spans[i].Name, spans[i].Start, spans[i-1].Name, end)
+			}
+		}
+		if upstream := spans[slices.Index(names, "upstream")]; upstream.Duration < 20*time.Millisecond-time.Microsecond {
+			t.Errorf("%s: upstream took %v, want 20ms or more", c.subject, upstream.Duration)
+		}
+	}
+
+	// the header needs debug headers
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second)
+	req, _ := http.NewRequest("GET", "http://svc/", nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if spans := ResponseSpans(resp); spans != nil {
+		t.Fatalf("got spans %v without debug headers", spans)
+	}
+}
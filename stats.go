@@ -0,0 +1,138 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sizeBounds are the upper bounds of the message size histogram buckets.
+var sizeBounds = []int{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20}
+
+// MessageStats describes the NATS messages of one request.
+type MessageStats struct {
+	// RequestBytes is the payload size of the request message.
+	RequestBytes int
+	// ResponseBytes is the payload size of the reply as sent, with a hop
+	// compressed body; for streamed responses only the head.
+	ResponseBytes int
+	// BodyBytes is the size of the response body uncompressed; for
+	// streamed responses zero.
+	BodyBytes int
+	// Duration is the NATS round trip on a transport, and the time from
+	// receiving the request to sending the reply on a server.
+	Duration time.Duration
+}
+
+// Histogram counts values into buckets. Counts[i] holds the values up to
+// Bounds[i], the last count those above all bounds.
+type Histogram struct {
+	Bounds []int
+	Counts []uint64
+}
+
+// Stats is a snapshot of the messages a transport or server handled.
+// Comparing ResponseBytes with BodyBytes shows what hop compression saves.
+type Stats struct {
+	Requests      uint64
+	RequestBytes  uint64
+	ResponseBytes uint64
+	BodyBytes     uint64
+	RequestSizes  Histogram
+	ResponseSizes Histogram
+	// InFlight is the number of requests being handled right now, whether
+	// or not they end up recorded.
+	InFlight int64
+	// UploadBufferBytes is the memory currently reserved for streamed
+	// request bodies on a server with WithUploadBudget.
+	UploadBufferBytes int64
+	// NATSRTT is the round trip to the NATS server on a transport with
+	// WithRTTInterval, not including any server or upstream.
+	NATSRTT time.Duration
+	// FailedReplies is the number of replies a server could not publish,
+	// leaving the requester to time out.
+	FailedReplies uint64
+}
+
+// WithStatsHook calls hook with the message sizes of every request that got
+// a response from the server.
+func WithStatsHook(hook func(MessageStats)) Option {
+	return func(t *NATSHTTPTransport) {
+		t.stats.hook = hook
+	}
+}
+
+// WithServerStatsHook calls hook with the message sizes of every request
+// answered with a proxied response in a single message.
+func WithServerStatsHook(hook func(MessageStats)) ServerOption {
+	return func(s *Server) {
+		s.stats.hook = hook
+	}
+}
+
+// Stats returns the message sizes of the requests that got a response from
+// the server through RoundTrip.
+func (t *NATSHTTPTransport) Stats() Stats {
+	stats := t.stats.snapshot()
+	if t.rtt.interval > 0 {
+		stats.NATSRTT = t.currentRTT()
+	}
+	return stats
+}
+
+// Stats returns the message sizes of the requests answered with a proxied
+// response in a single message.
+func (s *Server) Stats() Stats {
+	stats := s.stats.snapshot()
+	stats.UploadBufferBytes = s.uploadBudget.inUse()
+	return stats
+}
+
+type statsCollector struct {
+	hook func(MessageStats)
+
+	inFlight      atomic.Int64
+	failedReplies atomic.Uint64
+
+	mu            sync.Mutex
+	stats         Stats
+	requestSizes  [8]uint64
+	responseSizes [8]uint64
+}
+
+func (c *statsCollector) record(m MessageStats) {
+	c.mu.Lock()
+	c.stats.Requests++
+	c.stats.RequestBytes += uint64(m.RequestBytes)
+	c.stats.ResponseBytes += uint64(m.ResponseBytes)
+	c.stats.BodyBytes += uint64(m.BodyBytes)
+	c.requestSizes[sizeBucket(m.RequestBytes)]++
+	c.responseSizes[sizeBucket(m.ResponseBytes)]++
+	c.mu.Unlock()
+	if c.hook != nil {
+		c.hook(m)
+	}
+}
+
+func (c *statsCollector) begin() { c.inFlight.Add(1) }
+func (c *statsCollector) end()   { c.inFlight.Add(-1) }
+
+func (c *statsCollector) snapshot() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.InFlight = c.inFlight.Load()
+	s.FailedReplies = c.failedReplies.Load()
+	s.RequestSizes = Histogram{Bounds: sizeBounds, Counts: append([]uint64(nil), c.requestSizes[:]...)}
+	s.ResponseSizes = Histogram{Bounds: sizeBounds, Counts: append([]uint64(nil), c.responseSizes[:]...)}
+	return s
+}
+
+func sizeBucket(n int) int {
+	for i, bound := range sizeBounds {
+		if n <= bound {
+			return i
+		}
+	}
+	return len(sizeBounds)
+}
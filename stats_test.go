@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMessageStats(t *testing.T) {
+	nc := runNATS(t)
+	// watch the wire to compare with
+	requests, _ := nc.SubscribeSync("svc")
+	replies, _ := nc.SubscribeSync("_INBOX.>")
+
+	var mu sync.Mutex
+	var server []MessageStats
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("a", 5000))
+	})
+	serveHandler(t, nc, "svc", h, WithServerHopCompression(HopCodecGzip), WithServerStatsHook(func(m MessageStats) {
+		mu.Lock()
+		server = append(server, m)
+		mu.Unlock()
+	}))
+	var client []MessageStats
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithHopCodecs(HopCodecGzip), WithStatsHook(func(m MessageStats) {
+		client = append(client, m)
+	}))
+
+	req, _ := http.NewRequest("POST", "http://svc/", strings.NewReader("hello"))
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	reqMsg, err := requests.NextMsg(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replyMsg, err := replies.NextMsg(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wire := MessageStats{RequestBytes: len(reqMsg.Data), ResponseBytes: len(replyMsg.Data), BodyBytes: 5000}
+
+	st := tr.Stats()
+	if st.Requests != 1 || st.RequestBytes != uint64(wire.RequestBytes) || st.ResponseBytes != uint64(wire.ResponseBytes) || st.BodyBytes != 5000 {
+		t.Fatalf("stats %+v, on the wire %+v", st, wire)
+	}
+	if st.ResponseBytes >= st.BodyBytes {
+		t.Fatalf("compressed reply of %d bytes for a %d byte body", st.ResponseBytes, st.BodyBytes)
+	}
+	if st.RequestSizes.Counts[sizeBucket(wire.RequestBytes)] != 1 || st.ResponseSizes.Counts[sizeBucket(wire.ResponseBytes)] != 1 {
+		t.Fatalf("histograms %v %v", st.RequestSizes, st.ResponseSizes)
+	}
+	// the server records after replying
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		mu.Lock()
+		n := len(server)
+		mu.Unlock()
+		if n > 0 || time.Since(start) > 5*time.Second {
+			break
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(client) != 1 || len(server) != 1 {
+		t.Fatalf("hooks called %d and %d times", len(client), len(server))
+	}
+	for _, m := range append(client, server...) {
+		if m.RequestBytes != wire.RequestBytes || m.ResponseBytes != wire.ResponseBytes || m.BodyBytes != wire.BodyBytes {
+			t.Fatalf("hook got %+v, on the wire %+v", m, wire)
+		}
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Streaming moves bodies as a sequence of chunk messages instead of one
+// envelope, so neither side has to hold a whole body in memory or fit it
+// into a single NATS message.
+//
+// Every chunk carries its sequence number in Nats-Http-Seq, starting at 1,
+// and the last one is marked with Nats-Http-Eof. Chunks are published with
+// the sender's ack inbox as reply subject and the receiver acknowledges each
+// chunk once the consumer has taken it, echoing the sequence number in
+// Nats-Http-Ack. The sender keeps at most Window chunks unacknowledged and
+// blocks until acks arrive, so a slow consumer holds back the producer
+// instead of piling up chunks in memory. Either side can give up by sending
+// a message with Nats-Http-Abort set to the reason.
+//
+// Responses: a client that enabled WithStreaming marks its requests with
+// Stream. A server with WithServerStreaming then answers with an envelope
+// that has Stream set and no body, followed by the body chunks on the same
+// reply subject.
+//
+// Requests: the client streams bodies larger than a chunk, or of unknown
+// length, by setting BodyStream. The server validates the request, replies
+// with a Nats-Http-Kind: ready message naming the subject to send chunks to
+// in Nats-Http-Upload, and reads the body from there while forwarding it.
+// Both sides need streaming enabled; older servers would forward an empty
+// body.
+const (
+	HeaderStreamSeq    = "Nats-Http-Seq"
+	HeaderStreamEOF    = "Nats-Http-Eof"
+	HeaderStreamAck    = "Nats-Http-Ack"
+	HeaderStreamAbort  = "Nats-Http-Abort"
+	HeaderStreamKind   = "Nats-Http-Kind"
+	HeaderStreamUpload = "Nats-Http-Upload"
+)
+
+// StreamConfig tunes chunked streaming. Zero fields take the defaults.
+type StreamConfig struct {
+	// ChunkSize is the body size of a chunk message, 64KiB by default. It
+	// has to stay below the NATS max payload.
+	ChunkSize int `json:"chunkSize,omitempty"`
+	// Window is the number of chunks that may be in flight without an ack,
+	// 8 by default.
+	Window int `json:"window,omitempty"`
+	// Timeout is how long a sender waits for an ack, and a receiver for the
+	// next chunk, before giving up. 30s by default.
+	Timeout time.Duration `json:"-"`
+	// Parallel is the number of chunks the sender publishes concurrently,
+	// at most Window; 1, sequential publishing, by default. Chunks may then
+	// arrive out of order, which receivers undo by sequence number, so the
+	// body is still read in order. Reading the body stays sequential.
+	//
+	// Publishing to one connection is buffered, so this only pays off when
+	// publishes block, e.g. on a connection that is flushing. On a link
+	// with a high round trip time it is Window that bounds throughput, to
+	// Window chunks per round trip.
+	Parallel int `json:"parallel,omitempty"`
+}
+
+func (c StreamConfig) MarshalJSON() ([]byte, error) {
+	type plain StreamConfig
+	return json.Marshal(struct {
+		plain
+		Timeout string `json:"timeout,omitempty"`
+	}{plain(c), formatDuration(c.Timeout)})
+}
+
+func (c *StreamConfig) UnmarshalJSON(data []byte) error {
+	type plain StreamConfig
+	aux := struct {
+		*plain
+		Timeout string `json:"timeout,omitempty"`
+	}{plain: (*plain)(c)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	var err error
+	c.Timeout, err = parseDuration(aux.Timeout)
+	return err
+}
+
+// ErrStreamAborted is returned when the other side gave up on a stream.
+var ErrStreamAborted = errors.New("nats-http: stream aborted")
+
+func (c StreamConfig) withDefaults() StreamConfig {
+	if c.ChunkSize <= 0 {
+		c.ChunkSize = 64 * 1024
+	}
+	if c.Window <= 0 {
+		c.Window = 8
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 30 * time.Second
+	}
+	c.Parallel = min(max(c.Parallel, 1), c.Window)
+	return c
+}
+
+// WithStreaming lets the transport receive streamed responses and stream
+// large request bodies. See StreamConfig.
+func WithStreaming(cfg StreamConfig) Option {
+	return func(t *NATSHTTPTransport) {
+		cfg = cfg.withDefaults()
+		t.streaming = &cfg
+	}
+}
+
+// WithServerStreaming lets the server stream responses to clients that ask
+// for it and accept streamed request bodies. See StreamConfig.
+func WithServerStreaming(cfg StreamConfig) ServerOption {
+	return func(s *Server) {
+		cfg = cfg.withDefaults()
+		s.cfg.Streaming = &cfg
+	}
+}
+
+// WithStreamThreshold makes the server stream only responses of at least n
+// bytes and send smaller ones inline in a single message, which is cheaper.
+// The decision is made from Content-Length; when that is unknown the server
+// buffers up to n bytes to find out. Clients handle both transparently.
+// Without it every response to a streaming client is streamed.
+func WithStreamThreshold(n int64) ServerOption {
+	return func(s *Server) {
+		s.cfg.StreamThreshold = n
+	}
+}
+
+// splitStream decides whether resp is streamed. It returns the whole body
+// for inline responses, or the reader to stream from.
+func (s *Server) splitStream(resp *http.Response) ([]byte, io.Reader) {
+	n := s.cfg.StreamThreshold
+	switch {
+	case n <= 0 || resp.ContentLength >= n:
+		return nil, resp.Body
+	case resp.ContentLength >= 0:
+		body, _ := io.ReadAll(resp.Body)
+		return body, nil
+	}
+	head, _ := io.ReadAll(io.LimitReader(resp.Body, n))
+	if int64(len(head)) < n {
+		return head, nil
+	}
+	return nil, io.MultiReader(bytes.NewReader(head), resp.Body)
+}
+
+// sendChunks publishes r to subject in chunks, waiting for acks on ackSub
+// whenever the window is full. With flush every read is sent as it returns
+// instead of filling up the chunk first, so a body produced bit by bit, like
+// a chunked upstream response, reaches the receiver as it arrives.
+func sendChunks(nc *nats.Conn, subject string, ackSub *nats.Subscription, r io.Reader, cfg *StreamConfig, flush bool) error {
+	buf := make([]byte, cfg.ChunkSize)
+	var seq, acked uint64
+	publish, done := nc.PublishMsg, func() error { return nil }
+	if cfg.Parallel > 1 {
+		p := newParallelPublisher(nc, cfg.Parallel)
+		defer p.wait()
+		publish, done = p.publish, p.wait
+	}
+	for {
+		var n int
+		var err error
+		if flush {
+			n, err = io.ReadAtLeast(r, buf, 1)
+		} else {
+			n, err = io.ReadFull(r, buf)
+		}
+		eof := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !eof {
+			abortStream(nc, subject, err.Error())
+			return err
+		}
+		// besides waiting for a full window, take what already arrived so an
+		// abort is noticed right away
+		for seq-acked >= uint64(cfg.Window) || pending(ackSub) {
+			ack, err := ackSub.NextMsg(cfg.Timeout)
+			if err != nil {
+				abortStream(nc, subject, "ack timeout")
+				return fmt.Errorf("nats-http: waiting for stream ack: %w", err)
+			}
+			if ack.Header.Get(HeaderStreamAbort) != "" {
+				return ErrStreamAborted
+			}
+			if a, err := strconv.ParseUint(ack.Header.Get(HeaderStreamAck), 10, 64); err == nil && a > acked {
+				acked = a
+			}
+		}
+		seq++
+		chunk := nats.NewMsg(subject)
+		chunk.Reply = ackSub.Subject
+		chunk.Header.Set(HeaderStreamSeq, strconv.FormatUint(seq, 10))
+		if eof {
+			chunk.Header.Set(HeaderStreamEOF, "1")
+		}
+		chunk.Data = append([]byte(nil), buf[:n]...)
+		if err := publish(chunk); err != nil {
+			return err
+		}
+		if eof {
+			return done()
+		}
+	}
+}
+
+// parallelPublisher publishes up to n messages at a time in the
+// background. A failed publish is returned by the next call.
+type parallelPublisher struct {
+	nc  *nats.Conn
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+func newParallelPublisher(nc *nats.Conn, n int) *parallelPublisher {
+	return &parallelPublisher{nc: nc, sem: make(chan struct{}, n)}
+}
+
+func (p *parallelPublisher) publish(msg *nats.Msg) error {
+	p.mu.Lock()
+	err := p.err
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	p.sem <- struct{}{}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() { <-p.sem }()
+		if err := p.nc.PublishMsg(msg); err != nil {
+			p.mu.Lock()
+			p.err = err
+			p.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+func (p *parallelPublisher) wait() error {
+	p.wg.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// nextMsg is sub.NextMsg that also returns when ctx is done, with its
+// error.
+func nextMsg(ctx context.Context, sub *nats.Subscription, timeout time.Duration) (*nats.Msg, error) {
+	wctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	msg, err := sub.NextMsgWithContext(wctx)
+	if err != nil && ctx.Err() == nil && wctx.Err() != nil {
+		return nil, nats.ErrTimeout
+	}
+	return msg, err
+}
+
+func pending(sub *nats.Subscription) bool {
+	n, _, _ := sub.Pending()
+	return n > 0
+}
+
+func abortStream(nc *nats.Conn, subject, reason string) {
+	msg := nats.NewMsg(subject)
+	msg.Header.Set(HeaderStreamAbort, reason)
+	nc.PublishMsg(msg)
+}
+
+// maxReorder bounds the chunks a receiver holds back waiting for an earlier
+// one. Senders never have more than their window in flight.
+const maxReorder = 1024
+
+// chunkReader reassembles a chunked body arriving on sub and acks every
+// chunk as it is handed to the consumer. Chunks arriving ahead of their
+// turn wait in early. Closing it before the end, or ctx ending, aborts the
+// stream, so the sender stops instead of waiting for acks.
+type chunkReader struct {
+	ctx        context.Context
+	nc         *nats.Conn
+	sub        *nats.Subscription
+	timeout    time.Duration
+	ackSubject string
+	next       uint64
+	early      map[uint64]*nats.Msg
+	buf        []byte
+	eof        bool
+	err        error
+}
+
+func newChunkReader(ctx context.Context, nc *nats.Conn, sub *nats.Subscription, timeout time.Duration) *chunkReader {
+	return &chunkReader{ctx: ctx, nc: nc, sub: sub, timeout: timeout, next: 1}
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+		if cr.eof {
+			return 0, io.EOF
+		}
+		cr.err = cr.nextChunk()
+	}
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
+func (cr *chunkReader) nextChunk() error {
+	msg, ok := cr.early[cr.next]
+	for !ok {
+		var err error
+		if msg, err = nextMsg(cr.ctx, cr.sub, cr.timeout); err != nil {
+			if cr.nc.IsClosed() {
+				return ErrConnectionClosed
+			}
+			if cr.ctx.Err() != nil {
+				return err
+			}
+			return fmt.Errorf("nats-http: waiting for stream chunk: %w", err)
+		}
+		if reason := msg.Header.Get(HeaderStreamAbort); reason != "" {
+			return fmt.Errorf("%w: %s", ErrStreamAborted, reason)
+		}
+		seq, err := strconv.ParseUint(msg.Header.Get(HeaderStreamSeq), 10, 64)
+		if err != nil || seq < cr.next || seq >= cr.next+maxReorder {
+			return fmt.Errorf("nats-http: stream chunk %q out of order, want %d", msg.Header.Get(HeaderStreamSeq), cr.next)
+		}
+		if ok = seq == cr.next; !ok {
+			if cr.early == nil {
+				cr.early = make(map[uint64]*nats.Msg)
+			}
+			cr.early[seq] = msg
+		}
+	}
+	delete(cr.early, cr.next)
+	seq := cr.next
+	cr.next++
+	cr.buf = msg.Data
+	cr.eof = msg.Header.Get(HeaderStreamEOF) != ""
+	if msg.Reply != "" {
+		cr.ackSubject = msg.Reply
+		ack := nats.NewMsg(msg.Reply)
+		ack.Header.Set(HeaderStreamAck, strconv.FormatUint(seq, 10))
+		cr.nc.PublishMsg(ack)
+	}
+	return nil
+}
+
+func (cr *chunkReader) Close() error {
+	if !cr.eof && (cr.err == nil || cr.ctx.Err() != nil) && cr.ackSubject != "" {
+		abortStream(cr.nc, cr.ackSubject, "receiver closed")
+	}
+	return cr.sub.Unsubscribe()
+}
+
+// streamRequest publishes a request on a private inbox, uploads body in
+// chunks when it is set, and returns the first reply together with the
+// still open inbox subscription so a streamed response body can be read
+// from it. Informational responses before it go to onInformational. It
+// gives up when ctx is done.
+func (t *NATSHTTPTransport) streamRequest(ctx context.Context, req *nats.Msg, body io.Reader, onInformational func(int, textproto.MIMEHeader) error, deadline time.Time) (*nats.Msg, *nats.Subscription, error) {
+	inbox := t.newInbox()
+	sub, err := t.nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err := t.exchangeStream(ctx, sub, req, body, onInformational, deadline)
+	if err != nil {
+		sub.Unsubscribe()
+		return nil, nil, err
+	}
+	return msg, sub, nil
+}
+
+// exchangeStream sends req and waits for the final reply, but not past
+// deadline unless it is zero.
+func (t *NATSHTTPTransport) exchangeStream(ctx context.Context, sub *nats.Subscription, req *nats.Msg, body io.Reader, onInformational func(int, textproto.MIMEHeader) error, deadline time.Time) (*nats.Msg, error) {
+	req.Reply = sub.Subject
+	if err := t.nc.PublishMsg(req); err != nil {
+		return nil, err
+	}
+	until := deadline
+	if t.keepaliveMax > 0 {
+		if keepaliveUntil := t.clock.Now().Add(max(t.keepaliveMax, t.Timeout())); until.IsZero() || keepaliveUntil.Before(until) {
+			until = keepaliveUntil
+		}
+	}
+	msg, err := nextFinalReply(ctx, sub, t.clock, t.Timeout(), until, onInformational)
+	if err != nil || body == nil || msg.Header.Get(HeaderStreamKind) != "ready" {
+		// anything but a ready message is the server's final answer, e.g.
+		// an error envelope for a request it refused up front
+		return msg, err
+	}
+
+	ackSub, err := t.nc.SubscribeSync(t.newInbox())
+	if err != nil {
+		return nil, err
+	}
+	defer ackSub.Unsubscribe()
+	// a server that is done before reading the whole body aborts the
+	// upload, but has answered by then
+	err = sendChunks(t.nc, msg.Header.Get(HeaderStreamUpload), ackSub, body, t.streaming, false)
+	if err != nil && !errors.Is(err, ErrStreamAborted) {
+		return nil, err
+	}
+	return nextFinalReply(ctx, sub, t.clock, t.Timeout(), until, onInformational)
+}
+
+func nextReply(ctx context.Context, sub *nats.Subscription, timeout time.Duration) (*nats.Msg, error) {
+	msg, err := nextMsg(ctx, sub, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.Data) == 0 && msg.Header.Get("Status") == "503" {
+		return nil, nats.ErrNoResponders
+	}
+	return msg, nil
+}
+
+// openUpload tells the client where to send the request body and returns a
+// reader for it that gives up when ctx is done.
+func (s *Server) openUpload(ctx context.Context, msg *nats.Msg) (io.ReadCloser, error) {
+	sub, err := s.nc.SubscribeSync(s.nc.NewInbox())
+	if err != nil {
+		return nil, err
+	}
+	ready := nats.NewMsg(msg.Reply)
+	ready.Header.Set(HeaderStreamKind, "ready")
+	ready.Header.Set(HeaderStreamUpload, sub.Subject)
+	if err := s.nc.PublishMsg(ready); err != nil {
+		sub.Unsubscribe()
+		return nil, err
+	}
+	return newChunkReader(ctx, s.nc, sub, s.cfg.Streaming.Timeout), nil
+}
+
+// streamResponse sends the response head followed by the body in chunks,
+// flushing every read for bodies of unknown length.
+func (s *Server) streamResponse(msg *nats.Msg, head NATSHTTPResponse, body io.Reader, flush bool) error {
+	ackSub, err := s.nc.SubscribeSync(s.nc.NewInbox())
+	if err != nil {
+		return err
+	}
+	defer ackSub.Unsubscribe()
+	head.Stream = true
+	head.StreamAck = ackSub.Subject
+	data, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+	if err := s.publishReply(msg.Reply, head.StatusCode, data); err != nil {
+		return err
+	}
+	return sendChunks(s.nc, msg.Reply, ackSub, body, s.cfg.Streaming, flush)
+}
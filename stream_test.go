@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestSendChunksPausesOnFullWindow(t *testing.T) {
+	nc := runNATS(t)
+	chunks, err := nc.SubscribeSync("chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ackSub, err := nc.SubscribeSync(nc.NewInbox())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := StreamConfig{ChunkSize: 4, Window: 2, Timeout: 5 * time.Second}.withDefaults()
+	body := bytes.Repeat([]byte("abcd"), 5)
+	done := make(chan error, 1)
+	go func() { done <- sendChunks(nc, "chunks", ackSub, bytes.NewReader(body), &cfg, false) }()
+
+	// without acks the sender stops at the window
+	var got []*nats.Msg
+	for range cfg.Window {
+		msg, err := chunks.NextMsg(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, msg)
+	}
+	if msg, err := chunks.NextMsg(200 * time.Millisecond); err == nil {
+		t.Fatalf("chunk %s sent with a full window", msg.Header.Get(HeaderStreamSeq))
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("sender returned with acks outstanding: %v", err)
+	default:
+	}
+
+	// every ack opens the window for one more chunk
+	ack := func(seq int) {
+		msg := nats.NewMsg(ackSub.Subject)
+		msg.Header.Set(HeaderStreamAck, strconv.Itoa(seq))
+		nc.PublishMsg(msg)
+	}
+	for seq := 1; ; seq++ {
+		ack(seq)
+		if got[len(got)-1].Header.Get(HeaderStreamEOF) != "" {
+			break
+		}
+		msg, err := chunks.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("no chunk after ack %d: %v", seq, err)
+		}
+		got = append(got, msg)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	var out []byte
+	for i, msg := range got {
+		if msg.Header.Get(HeaderStreamSeq) != strconv.Itoa(i+1) {
+			t.Fatalf("chunk %d has seq %s", i+1, msg.Header.Get(HeaderStreamSeq))
+		}
+		out = append(out, msg.Data...)
+	}
+	if !bytes.Equal(out, body) {
+		t.Fatalf("got %q", out)
+	}
+}
+
+func TestSendChunksAckTimeout(t *testing.T) {
+	nc := runNATS(t)
+	chunks, _ := nc.SubscribeSync("chunks")
+	ackSub, _ := nc.SubscribeSync(nc.NewInbox())
+	cfg := StreamConfig{ChunkSize: 4, Window: 1, Timeout: 100 * time.Millisecond}.withDefaults()
+	err := sendChunks(nc, "chunks", ackSub, io.LimitReader(zeros{}, 64), &cfg, false)
+	if err == nil {
+		t.Fatal("sender didn't give up on a stalled receiver")
+	}
+	// the receiver is told
+	for {
+		msg, err := chunks.NextMsg(time.Second)
+		if err != nil {
+			t.Fatal("no abort sent")
+		}
+		if msg.Header.Get(HeaderStreamAbort) != "" {
+			break
+		}
+	}
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestCancelInterruptsStreamedRequests(t *testing.T) {
+	for name, c := range map[string]struct {
+		client []Option
+		server []ServerOption
+	}{
+		"streaming": {[]Option{WithStreaming(StreamConfig{})}, []ServerOption{WithServerStreaming(StreamConfig{})}},
+		"keepalive": {[]Option{WithKeepalive(time.Minute)}, []ServerOption{WithServerKeepalive(50 * time.Millisecond)}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			nc := runNATS(t)
+			release := make(chan struct{})
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release })
+			serveHandler(t, nc, "svc", h, c.server...)
+			t.Cleanup(func() { close(release) })
+			tr := NewNATSHTTPTransport(nc, "svc", "", 30*time.Second, c.client...)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(100*time.Millisecond, cancel)
+			req, _ := http.NewRequestWithContext(ctx, "GET", "http://svc/", nil)
+			start := time.Now()
+			_, err := tr.RoundTrip(req)
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("got %v", err)
+			}
+			if d := time.Since(start); d > 5*time.Second {
+				t.Fatalf("took %v to notice the cancellation", d)
+			}
+		})
+	}
+}
+
+func TestCancelInterruptsStreamedBody(t *testing.T) {
+	nc := runNATS(t)
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first")
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	t.Cleanup(upstream.Close)
+	u, _ := url.Parse(upstream.URL)
+	s := NewServer(nc, "svc", WithAllowedHosts(u.Host), WithServerStreaming(StreamConfig{}))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	t.Cleanup(func() { close(release) })
+	nc.Flush()
+	tr := NewNATSHTTPTransport(nc, "svc", "", 30*time.Second, WithStreaming(StreamConfig{}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", upstream.URL, nil)
+	req.Header.Set("Host", u.Host)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "first" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := resp.Body.Read(buf); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("took %v to notice the cancellation", d)
+	}
+}
+
+func TestEarlyCloseStopsStream(t *testing.T) {
+	nc := runNATS(t)
+	aborted := make(chan bool, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := bytes.Repeat([]byte("x"), 1024)
+		for range 100000 {
+			if _, err := w.Write(chunk); err != nil {
+				aborted <- true
+				return
+			}
+		}
+		aborted <- false
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	s := NewServer(nc, "svc", WithAllowedHosts(u.Host), WithServerStreaming(StreamConfig{ChunkSize: 1024, Window: 2}))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	nc.Flush()
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithStreaming(StreamConfig{}))
+
+	req, _ := http.NewRequest("GET", upstream.URL, nil)
+	req.Header.Set("Host", u.Host)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(resp.Body, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	select {
+	case ok := <-aborted:
+		if !ok {
+			t.Fatal("upstream wrote the whole body")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream not cancelled")
+	}
+}
+
+// delayLink forwards between a client and the NATS server at addr with
+// delay added in each direction, simulating a link with a round trip time
+// of twice delay. It returns the address to connect to.
+func delayLink(tb testing.TB, addr string, delay time.Duration) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			client, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", addr)
+			if err != nil {
+				client.Close()
+				return
+			}
+			tb.Cleanup(func() { client.Close(); server.Close() })
+			go delayCopy(server, client, delay)
+			go delayCopy(client, server, delay)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// delayCopy copies from src to dst, writing each read delay after it
+// happened.
+func delayCopy(dst, src net.Conn, delay time.Duration) {
+	type packet struct {
+		data []byte
+		at   time.Time
+	}
+	packets := make(chan packet, 4096)
+	go func() {
+		defer dst.Close()
+		for p := range packets {
+			time.Sleep(time.Until(p.at))
+			if _, err := dst.Write(p.data); err != nil {
+				return
+			}
+		}
+	}()
+	defer close(packets)
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			packets <- packet{bytes.Clone(buf[:n]), time.Now().Add(delay)}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// BenchmarkParallelChunks uploads a streamed body over a link with a 4ms
+// round trip, publishing chunks sequentially and in parallel.
+func BenchmarkParallelChunks(b *testing.B) {
+	const size = 2 << 20
+	nc := runNATS(b)
+	serveHandler(b, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}), WithServerStreaming(StreamConfig{}))
+	u, _ := url.Parse(nc.ConnectedUrl())
+	client, err := nats.Connect("nats://" + delayLink(b, u.Host, 2*time.Millisecond))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(client.Close)
+
+	for _, parallel := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("parallel=%d", parallel), func(b *testing.B) {
+			cfg := StreamConfig{ChunkSize: 32 << 10, Window: 8, Parallel: parallel}
+			tr := NewNATSHTTPTransport(client, "svc", "", 30*time.Second, WithStreaming(cfg))
+			b.SetBytes(size)
+			b.ResetTimer()
+			for range b.N {
+				req, _ := http.NewRequest("POST", "http://svc/", io.LimitReader(zeros{}, size))
+				resp, err := tr.RoundTrip(req)
+				if err != nil {
+					b.Fatal(err)
+				}
+				resp.Body.Close()
+			}
+		})
+	}
+}
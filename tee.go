@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// TeeConfig configures WithBodyTee.
+type TeeConfig struct {
+	// Open returns the sinks the request and the response body of a
+	// request are copied to. Either may be nil to skip that body. Sinks
+	// that are io.Closers are closed once the request is done.
+	Open func(req *NATSHTTPRequest) (request, response io.Writer)
+	// MaxBytes limits how much of each body is copied, 0 meaning all of
+	// it. Longer bodies are still forwarded in full.
+	MaxBytes int64
+	// Redact, if set, is given a copy of every piece of a body before it
+	// goes to the sink and returns what to write instead. Pieces are split
+	// wherever reads happen to end, so a pattern can span two of them.
+	Redact func(p []byte) []byte
+}
+
+// WithBodyTee copies the bodies of every request to the sinks cfg.Open
+// returns as they pass through, e.g. for a compliance audit trail: the
+// request body as it is sent upstream, and the response body as it comes
+// back, before any compression for the NATS hop. Streamed bodies are copied
+// chunk by chunk, so nothing is buffered for the tee.
+//
+// The copying happens in the request path: a slow sink slows the request
+// down, and memory is only saved if the sink doesn't hold on to the bytes
+// either. Sinks should buffer or hand off. Write errors stop the copy of
+// that body without failing the request.
+func WithBodyTee(cfg TeeConfig) ServerOption {
+	return func(s *Server) {
+		s.tee = &cfg
+	}
+}
+
+// bodyTee copies the bodies of one request.
+type bodyTee struct {
+	req, resp *teeBody
+}
+
+func (s *Server) openTee(natsReq *NATSHTTPRequest) *bodyTee {
+	reqSink, respSink := s.tee.Open(natsReq)
+	t := &bodyTee{}
+	if reqSink != nil {
+		t.req = &teeBody{sink: reqSink, w: reqSink, remaining: s.tee.MaxBytes, redact: s.tee.Redact}
+	}
+	if respSink != nil {
+		t.resp = &teeBody{sink: respSink, w: respSink, remaining: s.tee.MaxBytes, redact: s.tee.Redact}
+	}
+	return t
+}
+
+// request wraps the upstream request body.
+func (t *bodyTee) request(body io.ReadCloser) io.ReadCloser {
+	if t == nil || t.req == nil || body == nil || body == http.NoBody {
+		return body
+	}
+	t.req.ReadCloser = body
+	return t.req
+}
+
+// response wraps the upstream response body.
+func (t *bodyTee) response(body io.ReadCloser) io.ReadCloser {
+	if t == nil || t.resp == nil {
+		return body
+	}
+	t.resp.ReadCloser = body
+	return t.resp
+}
+
+func (t *bodyTee) close() {
+	for _, b := range []*teeBody{t.req, t.resp} {
+		if b != nil {
+			b.closeSink()
+		}
+	}
+}
+
+type teeBody struct {
+	io.ReadCloser
+	sink   io.Writer
+	redact func([]byte) []byte
+
+	// The upstream may still be reading the request body when the request
+	// is done, so the sink is guarded.
+	mu        sync.Mutex
+	w         io.Writer
+	remaining int64
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.copy(p[:n])
+	}
+	return n, err
+}
+
+func (b *teeBody) copy(p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.w == nil {
+		return
+	}
+	limited := b.remaining > 0
+	if limited {
+		p = p[:min(int64(len(p)), b.remaining)]
+		b.remaining -= int64(len(p))
+	}
+	if b.redact != nil {
+		p = b.redact(append([]byte(nil), p...))
+	}
+	if _, err := b.w.Write(p); err != nil || limited && b.remaining == 0 {
+		b.w = nil
+	}
+}
+
+func (b *teeBody) closeSink() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.w = nil
+	if c, ok := b.sink.(io.Closer); ok {
+		c.Close()
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// teeSink collects what the tee copies and reports when it is closed.
+type teeSink struct {
+	syncBuffer
+	closed chan struct{}
+}
+
+func (s *teeSink) Close() error {
+	close(s.closed)
+	return nil
+}
+
+func (s *teeSink) wait(t *testing.T) string {
+	t.Helper()
+	select {
+	case <-s.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sink not closed")
+	}
+	return s.String()
+}
+
+func TestBodyTee(t *testing.T) {
+	reqBody := bytes.Repeat([]byte("request secret "), 10000)
+	for _, c := range []struct {
+		name      string
+		cfg       StreamConfig
+		streaming bool
+		maxBytes  int64
+		redact    func([]byte) []byte
+	}{
+		{name: "buffered"},
+		{name: "streamed", streaming: true, cfg: StreamConfig{ChunkSize: 4 << 10}},
+		{name: "limited", maxBytes: 100},
+		{name: "redacted", redact: func(p []byte) []byte { return bytes.ReplaceAll(p, []byte("e"), []byte("*")) }},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			nc := runNATS(t)
+			forwarded := make(chan []byte, 1)
+			reqSink := &teeSink{closed: make(chan struct{})}
+			respSink := &teeSink{closed: make(chan struct{})}
+			opts := []ServerOption{WithBodyTee(TeeConfig{
+				Open:     func(*NATSHTTPRequest) (io.Writer, io.Writer) { return reqSink, respSink },
+				MaxBytes: c.maxBytes,
+				Redact:   c.redact,
+			})}
+			var clientOpts []Option
+			if c.streaming {
+				opts = append(opts, WithServerStreaming(c.cfg), WithStreamThreshold(1))
+				clientOpts = append(clientOpts, WithStreaming(c.cfg))
+			}
+			u := serveUpstream(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				forwarded <- body
+				w.Write(bytes.ToUpper(body))
+			}), opts...)
+			tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, clientOpts...)
+
+			req := upstreamRequest("POST", u, "/", bytes.NewReader(reqBody))
+			if c.streaming {
+				req.ContentLength = -1
+			}
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			received, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			sent := <-forwarded
+			if !bytes.Equal(sent, reqBody) || !bytes.Equal(received, bytes.ToUpper(reqBody)) {
+				t.Fatalf("bodies changed on the way: sent %d, received %d bytes", len(sent), len(received))
+			}
+			want := func(body []byte) string {
+				if c.maxBytes > 0 {
+					body = body[:c.maxBytes]
+				}
+				if c.redact != nil {
+					body = c.redact(body)
+				}
+				return string(body)
+			}
+			if got := reqSink.wait(t); got != want(sent) {
+				t.Errorf("request sink got %d bytes, want %d", len(got), len(want(sent)))
+			}
+			if got := respSink.wait(t); got != want(received) {
+				t.Errorf("response sink got %d bytes, want %d", len(got), len(want(received)))
+			}
+		})
+	}
+}
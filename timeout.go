@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is the request timeout of transports made by
+// NewTransportURL.
+const DefaultTimeout = 5 * time.Second
+
+const (
+	// adaptiveWindow is the number of recent latencies the adaptive timeout
+	// is computed from.
+	adaptiveWindow = 200
+	// adaptiveMinSamples is the number of latencies needed before the
+	// adaptive timeout replaces the configured one.
+	adaptiveMinSamples = 20
+)
+
+// WithTimeout sets the request timeout, replacing the one passed to the
+// constructor.
+func WithTimeout(d time.Duration) Option {
+	return func(t *NATSHTTPTransport) {
+		t.timeout = d
+	}
+}
+
+// WithMaxTotalDuration bounds the whole of a RoundTrip to d, however long
+// keepalives and hedges would otherwise let it run. The transport timeout
+// still applies to each attempt and each wait for a reply, and whichever
+// runs out first ends the request: with d it fails with a
+// TotalTimeoutError, any hedges still waiting are abandoned, and with
+// WithCancelPropagation the server is told to cancel. A streamed response
+// body is read after RoundTrip returned and is not bounded. A request
+// coalesced by WithSingleFlight stops waiting for the shared reply at its
+// deadline, leaving the other callers waiting.
+func WithMaxTotalDuration(d time.Duration) Option {
+	return func(t *NATSHTTPTransport) {
+		t.maxTotal = d
+	}
+}
+
+// TotalTimeoutError is returned by RoundTrip when the request took longer
+// than WithMaxTotalDuration allows. It matches context.DeadlineExceeded
+// with errors.Is.
+type TotalTimeoutError struct {
+	Limit time.Duration
+}
+
+func (e *TotalTimeoutError) Error() string {
+	return fmt.Sprintf("nats-http: request exceeded max total duration of %s", e.Limit)
+}
+
+// Timeout reports true, as for net.Error.
+func (e *TotalTimeoutError) Timeout() bool { return true }
+
+func (e *TotalTimeoutError) Unwrap() error { return context.DeadlineExceeded }
+
+// withMaxTotal bounds ctx by the max total duration, returning the deadline
+// or the zero time without one.
+func (t *NATSHTTPTransport) withMaxTotal(ctx context.Context) (context.Context, time.Time, context.CancelFunc) {
+	if t.maxTotal <= 0 {
+		return ctx, time.Time{}, func() {}
+	}
+	deadline := t.clock.Now().Add(t.maxTotal)
+	ctx, cancel := withTimeout(ctx, t.clock, t.maxTotal)
+	return ctx, deadline, cancel
+}
+
+// WithAdaptiveTimeout derives the timeout of each request from the latencies
+// of recent ones, as their 99th percentile times multiplier, kept between
+// min and max. The latencies are kept in a ring of the last 200 requests
+// that got a reply or timed out, a timeout counting as a latency of the
+// timeout it hit so a slowing backend pushes the timeout up. Until 20
+// requests are recorded the timeout passed to NewNATSHTTPTransport is used.
+func WithAdaptiveTimeout(multiplier float64, min, max time.Duration) Option {
+	return func(t *NATSHTTPTransport) {
+		t.adaptive = &adaptiveTimeout{multiplier: multiplier, min: min, max: max}
+	}
+}
+
+// Timeout returns the timeout the next request gets.
+func (t *NATSHTTPTransport) Timeout() time.Duration {
+	if t.adaptive == nil {
+		return t.timeout
+	}
+	return t.adaptive.timeout(t.timeout)
+}
+
+type adaptiveTimeout struct {
+	multiplier float64
+	min, max   time.Duration
+
+	mu        sync.Mutex
+	latencies [adaptiveWindow]time.Duration
+	n         int
+	next      int
+}
+
+func (a *adaptiveTimeout) observe(latency time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.latencies[a.next] = latency
+	a.next = (a.next + 1) % adaptiveWindow
+	a.n = min(a.n+1, adaptiveWindow)
+}
+
+func (a *adaptiveTimeout) timeout(fallback time.Duration) time.Duration {
+	a.mu.Lock()
+	if a.n < adaptiveMinSamples {
+		a.mu.Unlock()
+		return fallback
+	}
+	latencies := slices.Clone(a.latencies[:a.n])
+	a.mu.Unlock()
+	slices.Sort(latencies)
+	p99 := latencies[(len(latencies)*99-1)/100]
+	return min(max(time.Duration(float64(p99)*a.multiplier), a.min), a.max)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveTimeout(t *testing.T) {
+	nc := runNATS(t)
+	clock := newFakeClock()
+	// the upstream takes as long on the clock as the request asks for
+	serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d, _ := time.ParseDuration(r.Header.Get("X-Latency"))
+		clock.advance(d)
+	}))
+	tr := NewNATSHTTPTransport(nc, "svc", "", 10*time.Second, WithClock(clock),
+		WithAdaptiveTimeout(2, 50*time.Millisecond, 300*time.Millisecond))
+	do := func(n int, latency time.Duration) {
+		t.Helper()
+		for range n {
+			req, _ := http.NewRequest("GET", "http://svc/", nil)
+			req.Header.Set("X-Latency", latency.String())
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+	}
+	for _, c := range []struct {
+		n       int
+		latency time.Duration
+		want    time.Duration
+	}{
+		// the configured timeout until there are enough samples
+		{19, time.Millisecond, 10 * time.Second},
+		// then twice the 99th percentile, but no less than the minimum
+		{1, time.Millisecond, 50 * time.Millisecond},
+		{20, 40 * time.Millisecond, 80 * time.Millisecond},
+		// with fewer than 100 samples the slowest is the 99th percentile
+		{1, 70 * time.Millisecond, 140 * time.Millisecond},
+		{1, 130 * time.Millisecond, 260 * time.Millisecond},
+		// up to the maximum
+		{1, 250 * time.Millisecond, 300 * time.Millisecond},
+	} {
+		do(c.n, c.latency)
+		if got := tr.Timeout(); got != c.want {
+			t.Fatalf("after %d requests taking %v: timeout %v, want %v", c.n, c.latency, got, c.want)
+		}
+	}
+}
+
+func TestMaxTotalDuration(t *testing.T) {
+	nc := runNATS(t)
+	var calls atomic.Int32
+	done := make(chan struct{})
+	defer close(done)
+	// the upstream never answers
+	serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-done
+	}), WithMaxConcurrency(20), WithServerKeepalive(20*time.Millisecond))
+
+	for _, c := range []struct {
+		name   string
+		opts   []Option
+		copies int32
+	}{
+		// hedges every 50ms, up to 10 of them
+		{"hedging", []Option{WithHedging(50*time.Millisecond, 10)}, 2},
+		// keepalives every 20ms, for up to a minute
+		{"keepalive", []Option{WithKeepalive(time.Minute)}, 1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			calls.Store(0)
+			opts := append(c.opts, WithMaxTotalDuration(175*time.Millisecond))
+			tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, opts...)
+			req, _ := http.NewRequest("GET", "http://svc/", nil)
+			start := time.Now()
+			_, err := tr.RoundTrip(req)
+			var total *TotalTimeoutError
+			if !errors.As(err, &total) || !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("got %v, want a TotalTimeoutError", err)
+			}
+			if d := time.Since(start); d > time.Second {
+				t.Fatalf("gave up after %s", d)
+			}
+			sent := calls.Load()
+			if sent < c.copies || sent > 5 {
+				t.Fatalf("%d copies sent within the cap", sent)
+			}
+			// no more copies are sent after giving up
+			time.Sleep(100 * time.Millisecond)
+			if n := calls.Load(); n != sent {
+				t.Fatalf("%d copies sent after giving up", n-sent)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ServerTiming is stamped into responses by servers running WithTiming. With
+// the client's own round trip time it splits latency into queueing, upstream
+// and NATS transit:
+//
+//	queued   = UpstreamStart - ReceivedAt
+//	upstream = UpstreamEnd - UpstreamStart
+//	transit  = round trip - (UpstreamEnd - ReceivedAt)
+//
+// Differences within one ServerTiming are exact; comparing them to client
+// timestamps is subject to clock skew. For streamed responses UpstreamEnd is
+// when the response headers arrived.
+type ServerTiming struct {
+	ReceivedAt    time.Time `json:"receivedAt"`
+	UpstreamStart time.Time `json:"upstreamStart"`
+	UpstreamEnd   time.Time `json:"upstreamEnd"`
+}
+
+// Debug headers derived from ServerTiming, added by WithDebugHeaders.
+const (
+	HeaderNATSServerMs   = "X-NATS-Server-Ms"
+	HeaderNATSUpstreamMs = "X-NATS-Upstream-Ms"
+	HeaderNATSTransitMs  = "X-NATS-Transit-Ms"
+)
+
+// WithTiming makes the server include a ServerTiming in every response.
+func WithTiming() ServerOption {
+	return func(s *Server) {
+		s.timing = true
+	}
+}
+
+func setTimingHeaders(h http.Header, st *ServerTiming, latency time.Duration) {
+	server := st.UpstreamEnd.Sub(st.ReceivedAt)
+	h.Set(HeaderNATSServerMs, formatMs(server))
+	h.Set(HeaderNATSUpstreamMs, formatMs(st.UpstreamEnd.Sub(st.UpstreamStart)))
+	h.Set(HeaderNATSTransitMs, formatMs(latency-server))
+}
+
+func formatMs(d time.Duration) string {
+	return strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', 3, 64)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+
+	"github.com/nats-io/nats.go"
+)
+
+// SensitiveHeaders are always redacted by trace logging, on top of the
+// headers passed to WithTraceLogging and WithServerTraceLogging.
+var SensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// WithTraceLogging logs every serialized request and reply through
+// slog.Default(), for diagnosing serialization mismatches. Bodies are cut to
+// maxBodyBytes, where a negative value logs them whole, and the values of
+// SensitiveHeaders and redact are replaced by RedactedValue. Off by default;
+// it logs at info level and is not meant for production.
+func WithTraceLogging(maxBodyBytes int, redact ...string) Option {
+	return func(t *NATSHTTPTransport) {
+		t.trace = newTracer(maxBodyBytes, redact)
+	}
+}
+
+// WithServerTraceLogging is the server side of WithTraceLogging and logs
+// through the logger set with WithLogger.
+func WithServerTraceLogging(maxBodyBytes int, redact ...string) ServerOption {
+	return func(s *Server) {
+		s.trace = newTracer(maxBodyBytes, redact)
+	}
+}
+
+type tracer struct {
+	maxBody int
+	redact  []string
+}
+
+func newTracer(maxBody int, redact []string) *tracer {
+	tr := &tracer{maxBody: maxBody}
+	for _, key := range slices.Concat(SensitiveHeaders, redact) {
+		tr.redact = append(tr.redact, http.CanonicalHeaderKey(key))
+	}
+	return tr
+}
+
+// request logs a NATSHTTPRequest message. Data that doesn't decode is
+// only logged by size, as it can't be redacted.
+func (tr *tracer) request(logger *slog.Logger, msg string, m *nats.Msg) {
+	var natsReq NATSHTTPRequest
+	if err := decodePayload(m, &natsReq); err != nil {
+		logger.Info(msg, "bytes", len(m.Data), "error", err)
+		return
+	}
+	body := natsReq.Body
+	natsReq.Body = nil
+	natsReq.Header = tr.redactHeader(natsReq.Header)
+	envelope, _ := json.Marshal(natsReq)
+	logger.Info(msg, "envelope", string(envelope), "body", tr.truncate(body), "bodyBytes", len(body))
+}
+
+// response logs a NATSHTTPResponse message, error envelopes included.
+func (tr *tracer) response(logger *slog.Logger, msg string, m *nats.Msg) {
+	var natsResp NATSHTTPResponse
+	if err := decodePayload(m, &natsResp); err != nil {
+		logger.Info(msg, "bytes", len(m.Data), "error", err)
+		return
+	}
+	body := natsResp.Body
+	natsResp.Body = nil
+	natsResp.Header = tr.redactHeader(natsResp.Header)
+	if natsResp.HeaderValues != nil {
+		natsResp.HeaderValues = maps.Clone(natsResp.HeaderValues)
+		for key := range natsResp.HeaderValues {
+			if slices.Contains(tr.redact, http.CanonicalHeaderKey(key)) {
+				natsResp.HeaderValues[key] = []string{RedactedValue}
+			}
+		}
+	}
+	envelope, _ := json.Marshal(natsResp)
+	logger.Info(msg, "envelope", string(envelope), "body", tr.truncate(body), "bodyBytes", len(body))
+}
+
+func (tr *tracer) redactHeader(header map[string]string) map[string]string {
+	return redactHeaders(header, tr.redact)
+}
+
+func (tr *tracer) truncate(data []byte) string {
+	if tr.maxBody >= 0 && len(data) > tr.maxBody {
+		data = data[:tr.maxBody]
+	}
+	return string(data)
+}
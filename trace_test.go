@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent writes.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestTraceLoggingRedacts(t *testing.T) {
+	var clientLog, serverLog syncBuffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&clientLog, nil)))
+
+	nc := runNATS(t)
+	serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "server-cookie"})
+		w.Header().Set("X-Secret", "server-secret")
+		w.Write([]byte("response body"))
+	}),
+		WithLogger(slog.New(slog.NewTextHandler(&serverLog, nil))),
+		WithServerTraceLogging(4, "X-Secret"),
+	)
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithTraceLogging(4, "x-secret"))
+
+	req, _ := http.NewRequest("POST", "http://svc/", strings.NewReader("request body"))
+	req.Header.Set("Authorization", "Bearer client-token")
+	req.Header.Set("X-Secret", "client-secret")
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for side, log := range map[string]string{"client": clientLog.String(), "server": serverLog.String()} {
+		if !strings.Contains(log, "nats-http request") || !strings.Contains(log, "nats-http reply") {
+			t.Fatalf("%s log misses envelopes: %s", side, log)
+		}
+		for _, secret := range []string{"client-token", "client-secret", "server-cookie", "server-secret", "request body", "response body"} {
+			if strings.Contains(log, secret) {
+				t.Errorf("%s log contains %q: %s", side, secret, log)
+			}
+		}
+		if !strings.Contains(log, RedactedValue) {
+			t.Errorf("%s log has nothing redacted: %s", side, log)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Transformer rewrites a response body.
+type Transformer func(body []byte) ([]byte, error)
+
+// TransformerRegistry holds the transformers for each content type, for
+// servers in front of upstreams that serve several kinds of content.
+type TransformerRegistry struct {
+	mu     sync.RWMutex
+	byType map[string][]Transformer
+}
+
+// NewTransformerRegistry returns an empty registry.
+func NewTransformerRegistry() *TransformerRegistry {
+	return &TransformerRegistry{byType: make(map[string][]Transformer)}
+}
+
+// Register adds t for responses of contentType, a media type like
+// "text/html" without parameters. Transformers for a type run in the order
+// they were registered, each getting the body the previous one returned.
+func (r *TransformerRegistry) Register(contentType string, t Transformer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := strings.ToLower(contentType)
+	r.byType[key] = append(r.byType[key], t)
+}
+
+func (r *TransformerRegistry) lookup(contentType string) []Transformer {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.byType[mediaType]
+}
+
+// WithTransformers runs the transformers of r registered for the
+// Content-Type of a response over its body, and sets Content-Length to the
+// length of the result. Bodies with a Content-Encoding are left alone, as
+// are streamed responses, which are never held in full. A transformer
+// error is answered with 502.
+func WithTransformers(r *TransformerRegistry) ServerOption {
+	return func(s *Server) {
+		s.transformers = r
+	}
+}
+
+// transformBody runs the transformers for the response over body.
+func (s *Server) transformBody(natsReq *NATSHTTPRequest, status int, header map[string]string, body []byte) ([]byte, error) {
+	if natsReq.Method == http.MethodHead || !bodyAllowed(status) {
+		return body, nil
+	}
+	if encoding := header["Content-Encoding"]; encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return body, nil
+	}
+	transformers := s.transformers.lookup(header["Content-Type"])
+	if len(transformers) == 0 {
+		return body, nil
+	}
+	for _, t := range transformers {
+		var err error
+		if body, err = t(body); err != nil {
+			return nil, err
+		}
+	}
+	header["Content-Length"] = strconv.Itoa(len(body))
+	return body, nil
+}
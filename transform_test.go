@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestTransformers(t *testing.T) {
+	nc := runNATS(t)
+	r := NewTransformerRegistry()
+	r.Register("text/html", func(body []byte) ([]byte, error) { return bytes.ToUpper(body), nil })
+	r.Register("TEXT/HTML", func(body []byte) ([]byte, error) { return append(body, "<!-- proxied -->"...), nil })
+	r.Register("image/png", func([]byte) ([]byte, error) { return nil, errors.New("not an image") })
+	tr := serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Content-Length", "9")
+			io.WriteString(w, "<p>hi</p>")
+		case "/json":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"p":"<p>hi</p>"}`)
+		case "/png":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, "png")
+		}
+	}), WithTransformers(r))
+	get := func(path string) (*http.Response, string, error) {
+		req, _ := http.NewRequest("GET", "http://svc"+path, nil)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			return nil, "", err
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body), nil
+	}
+
+	// both HTML transformers run in order, and the length follows
+	resp, body, err := get("/html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "<P>HI</P><!-- proxied -->"; body != want || resp.ContentLength != int64(len(want)) || resp.Header.Get("Content-Length") != "25" {
+		t.Fatalf("html: got %q with length %d", body, resp.ContentLength)
+	}
+	if _, body, err = get("/json"); err != nil || body != `{"p":"<p>hi</p>"}` {
+		t.Fatalf("json: got %q, %v", body, err)
+	}
+	_, _, err = get("/png")
+	var serr *ServerError
+	if !errors.As(err, &serr) || serr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("failing transformer: got %v, want 502", err)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// Headers set on responses cut short by WithTruncateOversized.
+const (
+	HeaderTruncated             = "X-Truncated"
+	HeaderOriginalContentLength = "X-Original-Content-Length"
+)
+
+// WithTruncateOversized makes the server send as much of a response as fits
+// in a single NATS message instead of failing when the full response does
+// not. Truncated responses carry "X-Truncated: true" and the full body size
+// in X-Original-Content-Length; Content-Length is dropped since it would no
+// longer match the body.
+func WithTruncateOversized() ServerOption {
+	return func(s *Server) {
+		s.cfg.TruncateOversized = true
+	}
+}
+
+// truncateResponse shrinks resp.Body so the encoded envelope fits into
+// maxPayload bytes and returns the encoded envelope.
+func truncateResponse(resp *NATSHTTPResponse, maxPayload int) ([]byte, error) {
+	body := resp.Body
+	header := make(map[string]string, len(resp.Header)+2)
+	for k, v := range resp.Header {
+		header[k] = v
+	}
+	delete(header, "Content-Length")
+	header[HeaderTruncated] = "true"
+	header[HeaderOriginalContentLength] = strconv.Itoa(len(body))
+	resp.Header = header
+
+	resp.Body = nil
+	empty, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	// the body goes from null to a quoted base64 string, which takes four
+	// bytes for every three of the body
+	avail := maxPayload - len(empty) - 2
+	n := max(avail/4*3, 0)
+	resp.Body = body[:min(n, len(body))]
+	return json.Marshal(resp)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+func TestTruncateOversized(t *testing.T) {
+	nc := runNATS(t, func(o *server.Options) { o.MaxPayload = 64 << 10 })
+	big := bytes.Repeat([]byte("0123456789"), 20000)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(big)))
+		w.Write(big)
+	})
+	tr := serveHandler(t, nc, "svc", h, WithTruncateOversized())
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.Header.Get(HeaderTruncated) != "true" || resp.Header.Get(HeaderOriginalContentLength) != strconv.Itoa(len(big)) {
+		t.Fatalf("header %v", resp.Header)
+	}
+	if resp.Header.Get("Content-Length") != "" {
+		t.Fatal("Content-Length kept on a truncated body")
+	}
+	if len(body) == 0 || len(body) >= 64<<10 || !bytes.Equal(body, big[:len(body)]) {
+		t.Fatalf("body of %d bytes is not a prefix below the limit", len(body))
+	}
+
+	// without the option the response is refused
+	tr = serveHandler(t, nc, "strict", h)
+	_, err = tr.RoundTrip(req)
+	var se *ServerError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusBadGateway {
+		t.Fatalf("got %v", err)
+	}
+}
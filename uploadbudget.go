@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// WithMaxUploadSize limits streamed request bodies to n bytes. The size is
+// settled before the body is sent: the client announces it in the request,
+// and the server rejects larger ones with 413 Content Too Large instead of
+// asking for the body. Bodies of unknown size are cut off once they exceed
+// n, which also fails the request with 413.
+func WithMaxUploadSize(n int64) ServerOption {
+	return func(s *Server) {
+		s.maxUploadSize = n
+	}
+}
+
+// WithRequestBuffering makes the server receive streamed request bodies in
+// full before calling the upstream, instead of passing them on chunk by
+// chunk as they arrive, which is the default. Inline bodies are in the
+// request message and always buffered.
+//
+// A buffered body costs memory for its whole size, which WithUploadBudget
+// doesn't account for, so bound it with WithMaxUploadSize. In exchange the
+// upstream gets an exact Content-Length, and net/http can send the body
+// again: when following a 307 or 308 redirect, and when retrying on a
+// keep-alive connection the upstream closed meanwhile. A streamed body can
+// be sent once, so then the redirect is passed back as it is, and the
+// retry doesn't happen and the request fails with 502 Bad Gateway.
+func WithRequestBuffering(buffer bool) ServerOption {
+	return func(s *Server) {
+		s.requestBuffering = buffer
+	}
+}
+
+var errUploadTooLarge = errors.New("nats-http: upload exceeds the maximum size")
+
+// limitedUpload fails reads past the maximum upload size.
+type limitedUpload struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  atomic.Bool
+}
+
+func (u *limitedUpload) Read(p []byte) (int, error) {
+	n, err := u.ReadCloser.Read(p)
+	if u.remaining -= int64(n); u.remaining < 0 {
+		u.exceeded.Store(true)
+		return 0, errUploadTooLarge
+	}
+	return n, err
+}
+
+// WithUploadBudget caps the memory held for streamed request bodies across
+// all requests in flight at n bytes. Each upload reserves what its window
+// of unacknowledged chunks can take, at most StreamConfig.Window chunks,
+// until the request is done. Uploads that would exceed the budget are
+// rejected with 503 Service Unavailable. Without it uploads are unlimited.
+func WithUploadBudget(n int64) ServerOption {
+	return func(s *Server) {
+		s.uploadBudget = &uploadBudget{limit: n}
+	}
+}
+
+type uploadBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+}
+
+func (b *uploadBudget) reserve(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+func (b *uploadBudget) release(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+}
+
+func (b *uploadBudget) inUse() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// uploadSize is what an upload of a body of the given length, -1 if
+// unknown, can buffer.
+func (s *Server) uploadSize(contentLength int64) int64 {
+	size := int64(s.cfg.Streaming.Window) * int64(s.cfg.Streaming.ChunkSize)
+	if contentLength > 0 {
+		size = min(size, contentLength)
+	}
+	return size
+}
+
+// budgetedUpload releases its reservation when closed.
+type budgetedUpload struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (u *budgetedUpload) Close() error {
+	u.once.Do(u.release)
+	return u.ReadCloser.Close()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// readCounter counts the bytes read from it, safe to check while reading.
+type readCounter struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *readCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func TestMaxUploadSizeRejectsBeforeBody(t *testing.T) {
+	const limit, size = 64 << 10, 1 << 20
+	nc := runNATS(t)
+	var served atomic.Int32
+	cfg := StreamConfig{ChunkSize: 16 << 10}
+	tr := serveHandler(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served.Add(1)
+		io.Copy(io.Discard, r.Body)
+	}), WithServerStreaming(cfg), WithMaxUploadSize(limit))
+	tr = NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithStreaming(cfg))
+
+	for _, known := range []bool{true, false} {
+		body := &readCounter{r: bytes.NewReader(make([]byte, size))}
+		req, _ := http.NewRequest("POST", "http://svc/", body)
+		req.ContentLength = -1
+		if known {
+			req.ContentLength = size
+		}
+		_, err := tr.RoundTrip(req)
+		var serr *ServerError
+		if !errors.As(err, &serr) || serr.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Fatalf("known size %v: got %v, want 413", known, err)
+		}
+		// Announced sizes are refused before any chunk is sent, others
+		// once the limit is passed.
+		if sent := body.n.Load(); known && sent != 0 || sent >= size {
+			t.Errorf("known size %v: %d bytes of the body were read", known, sent)
+		}
+	}
+	if n := served.Load(); n != 1 {
+		t.Errorf("handler saw %d requests, want only the unknown size one", n)
+	}
+}
+
+func TestRequestBuffering(t *testing.T) {
+	for _, buffer := range []bool{true, false} {
+		nc := runNATS(t)
+		type seen struct {
+			length  int64
+			chunked bool
+			size    int64
+		}
+		got := make(chan seen, 1)
+		cfg := StreamConfig{ChunkSize: 16 << 10}
+		u := serveUpstream(t, nc, "svc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n, _ := io.Copy(io.Discard, r.Body)
+			got <- seen{r.ContentLength, slices.Contains(r.TransferEncoding, "chunked"), n}
+		}), WithServerStreaming(cfg), WithRequestBuffering(buffer))
+		tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithStreaming(cfg))
+
+		for _, size := range []int64{0, 1 << 20} {
+			// a body of unknown length is streamed, even when empty
+			req := upstreamRequest("POST", u, "/", io.LimitReader(zeros{}, size))
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			want := seen{-1, true, size}
+			if buffer {
+				want = seen{size, false, size}
+			}
+			if s := <-got; s != want {
+				t.Errorf("buffering %v, %d bytes: upstream saw %+v, want %+v", buffer, size, s, want)
+			}
+		}
+	}
+}
+
+func TestUploadBudget(t *testing.T) {
+	const chunk = 16 << 10
+	nc := runNATS(t)
+	cfg := StreamConfig{ChunkSize: chunk}
+	// an upload reserves a window of chunks
+	window := int64(cfg.withDefaults().Window) * chunk
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	s := NewServer(nc, "svc", WithHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hold" {
+			started <- struct{}{}
+			<-release
+		}
+		io.Copy(io.Discard, r.Body)
+	})), WithServerStreaming(cfg), WithMaxConcurrency(4), WithUploadBudget(window))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	tr := NewNATSHTTPTransport(nc, "svc", "", 5*time.Second, WithStreaming(cfg))
+	upload := func(path string) error {
+		req, _ := http.NewRequest("POST", "http://svc"+path, bytes.NewReader(make([]byte, 1<<20)))
+		resp, err := tr.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	// the held upload takes the whole budget
+	errc := make(chan error, 1)
+	go func() { errc <- upload("/hold") }()
+	<-started
+	if used := s.Stats().UploadBufferBytes; used != window {
+		t.Fatalf("%d bytes in use, want a window", used)
+	}
+	var serr *ServerError
+	if err := upload("/"); !errors.As(err, &serr) || serr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got %v over the budget, want 503", err)
+	}
+
+	// and gives it back when done
+	close(release)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	// the reservation is released once the reply is out
+	for start := time.Now(); s.Stats().UploadBufferBytes != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("%d bytes still in use", s.Stats().UploadBufferBytes)
+		}
+	}
+	if err := upload("/"); err != nil {
+		t.Fatal(err)
+	}
+}
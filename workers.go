@@ -0,0 +1,48 @@
+package main
+
+import "github.com/nats-io/nats.go"
+
+// WithWorkers hands messages from the subscription to a pool of n worker
+// goroutines through a channel buffering up to n messages. NATS delivers a
+// subscription's messages to its callback one at a time, so without workers
+// or WithMaxConcurrency requests are handled sequentially. Workers bound the
+// parallelism explicitly: when all of them are busy and the buffer is full,
+// further messages wait in the subscription's pending queue.
+//
+// Combined with WithMaxConcurrency the workers do the parsing and rate
+// limiting while the limiter still bounds how many requests reach the
+// upstream at once.
+func WithWorkers(n int) ServerOption {
+	return func(s *Server) {
+		s.cfg.Workers = n
+	}
+}
+
+// startWorkers starts the pool and returns the subscription callback that
+// feeds it.
+func (s *Server) startWorkers() nats.MsgHandler {
+	s.work = make(chan *nats.Msg, s.cfg.Workers)
+	for range s.cfg.Workers {
+		s.workersWG.Add(1)
+		go func() {
+			defer s.workersWG.Done()
+			for msg := range s.work {
+				s.handle(msg)
+			}
+		}()
+	}
+	return func(msg *nats.Msg) {
+		s.work <- msg
+	}
+}
+
+// stopWorkers lets the workers finish the queued messages and waits for
+// them. The subscription must no longer deliver.
+func (s *Server) stopWorkers() {
+	if s.work == nil {
+		return
+	}
+	close(s.work)
+	s.workersWG.Wait()
+	s.work = nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"testing"
+)
+
+// BenchmarkWorkers compares server throughput for a CPU-bound handler with
+// the default callback per message, a concurrency limit and a worker pool.
+func BenchmarkWorkers(b *testing.B) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data := make([]byte, 16<<10)
+		for range 8 {
+			sum := sha256.Sum256(data)
+			copy(data, sum[:])
+		}
+		w.Write(data[:32])
+	})
+	for name, opts := range map[string][]ServerOption{
+		"callback":       nil,
+		"maxconcurrency": {WithMaxConcurrency(8)},
+		"workers":        {WithWorkers(8)},
+	} {
+		b.Run(name, func(b *testing.B) {
+			nc := runNATS(b)
+			tr := serveHandler(b, nc, "svc", h, opts...)
+			b.SetParallelism(4)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					req, _ := http.NewRequest("GET", "http://svc/", nil)
+					resp, err := tr.RoundTrip(req)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					resp.Body.Close()
+				}
+			})
+		})
+	}
+}